@@ -3,6 +3,7 @@ package control
 import (
 	"github.com/andrebq/learn-system-design/control"
 	"github.com/andrebq/learn-system-design/internal/cmdutil"
+	"github.com/andrebq/learn-system-design/internal/metrics"
 	"github.com/urfave/cli/v2"
 )
 
@@ -16,6 +17,8 @@ func Cmd() *cli.Command {
 
 func serveCmd() *cli.Command {
 	var bind string = "127.0.0.1:9002"
+	var adminBind string
+	var ttl = control.DefaultTTL
 	return &cli.Command{
 		Name:  "serve",
 		Usage: "Runs the control plane that is used to run and configure simulations",
@@ -27,10 +30,28 @@ func serveCmd() *cli.Command {
 				Destination: &bind,
 				Value:       bind,
 			},
+			&cli.StringFlag{
+				Name:        "admin-bind",
+				Usage:       "Address which exposes the OpenMetrics endpoint at /metrics, disabled when empty",
+				EnvVars:     []string{"LSD_CONTROL_PLANE_ADMIN_BIND"},
+				Destination: &adminBind,
+				Value:       adminBind,
+			},
+			&cli.DurationFlag{
+				Name:        "ttl",
+				Usage:       "How long servers and stressors stay healthy without heartbeats, they are suspect after the TTL and gone after twice the TTL",
+				EnvVars:     []string{"LSD_CONTROL_PLANE_TTL"},
+				Destination: &ttl,
+				Value:       ttl,
+			},
 		},
 		Action: func(ctx *cli.Context) error {
-			h := control.Handler()
-			return cmdutil.RunHTTPServer(ctx.Context, h, bind)
+			reg := metrics.NewRegistry()
+			h := control.Handler(
+				control.WithMetrics(reg),
+				control.WithTTL(ttl),
+				control.WithReaper(ctx.Context))
+			return cmdutil.RunWithAdmin(ctx.Context, h, bind, adminBind, reg)
 		},
 	}
 }
@@ -34,6 +34,9 @@ func localFleetCmd() *cli.Command {
 		services   = cli.StringSlice{}
 		baseBinary = os.Args[0]
 		stressors  = 4
+		watch      = false
+
+		traceEndpoint = ""
 	)
 	return &cli.Command{
 		Name:  "serve-local",
@@ -42,6 +45,7 @@ func localFleetCmd() *cli.Command {
 			stringFlag("baseBinary", "Path to the lsd binary", &baseBinary),
 			stringFlag("scriptBase", "Path to the folder which holds all handler scripts", &scriptBase),
 			stringFlag("bindIface", "IP of the interface to bind fleet processes", &bindIface),
+			stringFlag("traceEndpoint", "OTLP/HTTP endpoint which receives spans from services and stressors (eg.: http://127.0.0.1:4318)", &traceEndpoint),
 			&cli.IntFlag{
 				Name:        "basePort",
 				Usage:       "Lowest port to use when firing up new fleet processes",
@@ -59,9 +63,15 @@ func localFleetCmd() *cli.Command {
 				Destination: &stressors,
 				Value:       stressors,
 			},
+			&cli.BoolFlag{
+				Name:        "watch",
+				Usage:       "Reload service scripts whenever they change",
+				Destination: &watch,
+				Value:       watch,
+			},
 		},
 		Action: func(ctx *cli.Context) error {
-			m := fleet.NewManager(baseBinary, bindIface, basePort, scriptBase, stressors, services.Value())
+			m := fleet.NewManager(baseBinary, bindIface, basePort, scriptBase, stressors, services.Value(), watch, traceEndpoint)
 			return m.Run(ctx.Context)
 		},
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/andrebq/learn-system-design/cmd/lsd/control"
 	"github.com/andrebq/learn-system-design/cmd/lsd/fleet"
@@ -18,8 +19,13 @@ import (
 )
 
 func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
+	go func() {
+		<-ctx.Done()
+		// servers drain before stopping, a second signal stops the process right away
+		cancel()
+	}()
 	log := logutil.Acquire(logutil.WithLogger(ctx, logpkg.Logger))
 	var logLevel string = zerolog.InfoLevel.String()
 	app := &cli.App{
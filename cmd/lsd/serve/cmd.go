@@ -1,8 +1,12 @@
 package serve
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/andrebq/learn-system-design/handler"
 	"github.com/andrebq/learn-system-design/internal/cmdutil"
+	"github.com/andrebq/learn-system-design/internal/metrics"
 	"github.com/urfave/cli/v2"
 )
 
@@ -12,6 +16,20 @@ func Cmd() *cli.Command {
 	var handlerFile string = "./scripts/handler.lua"
 	var publicEndpoint string = ""
 	var controlEndpoint string = "http://127.0.0.1:9002/"
+	var traceEndpoint string
+	var adminBind string
+	var poolSize int = handler.DefaultPoolSize
+	var watch bool
+	var balancer string = "random"
+	var weight int = 1
+	var drainPeriod = handler.DefaultDrainPeriod
+	var trustedProxies cli.StringSlice
+	var limits = handler.Limits{Timeout: handler.DefaultTimeout}
+	var admission = handler.AdmissionConfig{
+		QueueTimeout: time.Second,
+		Policy:       handler.QueueFIFO,
+		ShedStatus:   http.StatusServiceUnavailable,
+	}
 	return &cli.Command{
 		Name:  "serve",
 		Usage: "Serve the configured handler at the designated port",
@@ -23,6 +41,13 @@ func Cmd() *cli.Command {
 				Value:       bind,
 				Destination: &bind,
 			},
+			&cli.StringFlag{
+				Name:        "admin-bind",
+				Usage:       "Address which exposes the OpenMetrics endpoint at /metrics, disabled when empty",
+				EnvVars:     []string{"LSD_SERVE_ADMIN_BIND"},
+				Value:       adminBind,
+				Destination: &adminBind,
+			},
 			&cli.StringFlag{
 				Name:        "init-file",
 				Usage:       "File with initialization logic",
@@ -57,13 +82,121 @@ This argument is mandatory!
 				Value:       controlEndpoint,
 				Destination: &controlEndpoint,
 			},
+			&cli.StringFlag{
+				Name:        "trace-endpoint",
+				Usage:       "OTLP/HTTP endpoint which receives the spans of this instance (eg.: http://127.0.0.1:4318), tracing is disabled when empty",
+				EnvVars:     []string{"LSD_SERVE_TRACE_ENDPOINT", "OTEL_EXPORTER_OTLP_ENDPOINT"},
+				Value:       traceEndpoint,
+				Destination: &traceEndpoint,
+			},
+			&cli.IntFlag{
+				Name:        "pool-size",
+				Usage:       "Maximum number of idle Lua states kept to serve requests (0 disables pooling)",
+				EnvVars:     []string{"LSD_SERVE_POOL_SIZE"},
+				Value:       poolSize,
+				Destination: &poolSize,
+			},
+			&cli.BoolFlag{
+				Name:        "watch",
+				Usage:       "Reload handler, init and module scripts whenever they change",
+				EnvVars:     []string{"LSD_SERVE_WATCH"},
+				Value:       watch,
+				Destination: &watch,
+			},
+			&cli.StringFlag{
+				Name:        "balancer",
+				Usage:       "Default strategy used to call other services (random, round_robin, weighted_round_robin, least_outstanding, p2c, consistent_hash)",
+				EnvVars:     []string{"LSD_SERVE_BALANCER"},
+				Value:       balancer,
+				Destination: &balancer,
+			},
+			&cli.IntFlag{
+				Name:        "weight",
+				Usage:       "Weight of this instance, used by weighted load-balancers",
+				EnvVars:     []string{"LSD_SERVE_WEIGHT"},
+				Value:       weight,
+				Destination: &weight,
+			},
+			&cli.IntFlag{
+				Name:        "max-concurrency",
+				Usage:       "Maximum number of requests executed at the same time (0 means unlimited)",
+				EnvVars:     []string{"LSD_SERVE_MAX_CONCURRENCY"},
+				Value:       admission.MaxConcurrency,
+				Destination: &admission.MaxConcurrency,
+			},
+			&cli.IntFlag{
+				Name:        "queue-size",
+				Usage:       "How many requests can wait for a free slot when max-concurrency is reached",
+				EnvVars:     []string{"LSD_SERVE_QUEUE_SIZE"},
+				Value:       admission.QueueSize,
+				Destination: &admission.QueueSize,
+			},
+			&cli.DurationFlag{
+				Name:        "queue-timeout",
+				Usage:       "Maximum time a request waits in the queue before being rejected",
+				EnvVars:     []string{"LSD_SERVE_QUEUE_TIMEOUT"},
+				Value:       admission.QueueTimeout,
+				Destination: &admission.QueueTimeout,
+			},
+			&cli.StringFlag{
+				Name:        "queue-policy",
+				Usage:       "Order used to take requests from the queue (fifo, lifo or codel)",
+				EnvVars:     []string{"LSD_SERVE_QUEUE_POLICY"},
+				Value:       admission.Policy,
+				Destination: &admission.Policy,
+			},
+			&cli.IntFlag{
+				Name:        "shed-status",
+				Usage:       "Status code used to reject requests (503 or 429)",
+				EnvVars:     []string{"LSD_SERVE_SHED_STATUS"},
+				Value:       admission.ShedStatus,
+				Destination: &admission.ShedStatus,
+			},
+			&cli.DurationFlag{
+				Name:        "timeout",
+				Usage:       "Maximum time a request can spend executing the handler script (0 disables the limit)",
+				EnvVars:     []string{"LSD_SERVE_TIMEOUT"},
+				Value:       limits.Timeout,
+				Destination: &limits.Timeout,
+			},
+			&cli.Int64Flag{
+				Name:        "max-instructions",
+				Usage:       "Maximum number of Lua instructions executed by a request (0 disables the limit)",
+				EnvVars:     []string{"LSD_SERVE_MAX_INSTRUCTIONS"},
+				Value:       limits.Instructions,
+				Destination: &limits.Instructions,
+			},
+			&cli.DurationFlag{
+				Name:        "drain-period",
+				Usage:       "How long the instance keeps serving requests after leaving the control plane, when asked to stop",
+				EnvVars:     []string{"LSD_SERVE_DRAIN_PERIOD"},
+				Value:       drainPeriod,
+				Destination: &drainPeriod,
+			},
+			&cli.StringSliceFlag{
+				Name:        "trusted-proxy",
+				Usage:       "Address or network (CIDR) of a proxy allowed to set the client address with X-Forwarded-For, can be repeated",
+				EnvVars:     []string{"LSD_SERVE_TRUSTED_PROXY"},
+				Destination: &trustedProxies,
+			},
 		},
 		Action: func(c *cli.Context) error {
-			h, err := handler.NewHandler(c.Context, initFile, handlerFile, cmdutil.GetInstanceName(), publicEndpoint, controlEndpoint)
+			reg := metrics.NewRegistry()
+			h, err := handler.NewHandler(c.Context, initFile, handlerFile, cmdutil.GetInstanceName(), publicEndpoint, controlEndpoint,
+				handler.WithPoolSize(poolSize),
+				handler.WithWatch(watch),
+				handler.WithBalancer(balancer),
+				handler.WithWeight(weight),
+				handler.WithAdmission(admission),
+				handler.WithLimits(limits),
+				handler.WithTracing(traceEndpoint),
+				handler.WithMetrics(reg),
+				handler.WithDrainPeriod(drainPeriod),
+				handler.WithTrustedProxies(trustedProxies.Value()))
 			if err != nil {
 				return err
 			}
-			return cmdutil.RunHTTPServer(c.Context, h, bind)
+			return cmdutil.RunWithAdmin(c.Context, h, bind, adminBind, reg)
 		},
 	}
 }
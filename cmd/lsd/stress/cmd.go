@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/andrebq/learn-system-design/internal/cmdutil"
+	"github.com/andrebq/learn-system-design/internal/metrics"
 	"github.com/andrebq/learn-system-design/stress"
 	"github.com/urfave/cli/v2"
 )
@@ -27,6 +28,9 @@ func serveCmd() *cli.Command {
 	var bind string = "127.0.0.1:9001"
 	var publicEndpoint string
 	var controlEndpoint string = "http://127.0.0.1:9000"
+	var traceEndpoint string
+	var adminBind string
+	var drainPeriod = stress.DefaultDrainPeriod
 	return &cli.Command{
 		Name:  "serve",
 		Usage: "Serve the API that allows clients to run stress tests",
@@ -38,6 +42,13 @@ func serveCmd() *cli.Command {
 				Destination: &bind,
 				Value:       bind,
 			},
+			&cli.StringFlag{
+				Name:        "admin-bind",
+				Usage:       "Address which exposes the OpenMetrics endpoint at /metrics, disabled when empty",
+				EnvVars:     []string{"LSD_STRESS_SERVE_ADMIN_BIND"},
+				Destination: &adminBind,
+				Value:       adminBind,
+			},
 			&cli.StringFlag{
 				Name: "public-endpoint",
 				Usage: `Endpoint used when sending registration information to control plane.
@@ -58,10 +69,28 @@ This argument is mandatory!
 				Value:       controlEndpoint,
 				Destination: &controlEndpoint,
 			},
+			&cli.StringFlag{
+				Name:        "trace-endpoint",
+				Usage:       "OTLP/HTTP endpoint which receives the spans of stress tests (eg.: http://127.0.0.1:4318), tracing is disabled when empty",
+				EnvVars:     []string{"LSD_STRESSOR_SERVE_TRACE_ENDPOINT", "OTEL_EXPORTER_OTLP_ENDPOINT"},
+				Value:       traceEndpoint,
+				Destination: &traceEndpoint,
+			},
+			&cli.DurationFlag{
+				Name:        "drain-period",
+				Usage:       "How long the stressor waits after leaving the control plane, when asked to stop",
+				EnvVars:     []string{"LSD_STRESS_SERVE_DRAIN_PERIOD"},
+				Destination: &drainPeriod,
+				Value:       drainPeriod,
+			},
 		},
 		Action: func(ctx *cli.Context) error {
-			h := stress.Handler(ctx.Context, cmdutil.GetInstanceName(), controlEndpoint, publicEndpoint)
-			return cmdutil.RunHTTPServer(ctx.Context, h, bind)
+			reg := metrics.NewRegistry()
+			h := stress.Handler(ctx.Context, cmdutil.GetInstanceName(), controlEndpoint, publicEndpoint,
+				stress.WithTracing(traceEndpoint),
+				stress.WithMetrics(reg),
+				stress.WithDrainPeriod(drainPeriod))
+			return cmdutil.RunWithAdmin(ctx.Context, h, bind, adminBind, reg)
 		},
 	}
 }
@@ -0,0 +1,240 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrebq/learn-system-design/internal/mutex"
+	"github.com/andrebq/learn-system-design/internal/randdist"
+	"github.com/andrebq/learn-system-design/internal/render"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// FaultLatency delays requests before they reach the handler
+	FaultLatency = "latency"
+	// FaultError returns an error status without running the handler
+	FaultError = "error"
+	// FaultDrop closes the connection without sending a response
+	FaultDrop = "drop"
+	// FaultHang never answers, requests wait until the client gives up
+	FaultHang = "hang"
+)
+
+type (
+	// Fault is injected by instances into the requests they serve.
+	//
+	// Faults without Service and Instance apply to every instance in the fleet.
+	Fault struct {
+		ID       string `json:"id"`
+		Service  string `json:"service,omitempty"`
+		Instance string `json:"instance,omitempty"`
+		Kind     string `json:"kind"`
+		// Rate (0-1) of requests affected by the fault, every request is affected when absent
+		Rate *float64 `json:"rate,omitempty"`
+		// Status used by error faults
+		Status int `json:"status,omitempty"`
+		// LatencyMs is the delay added by latency faults, in milliseconds
+		LatencyMs *randdist.Distribution `json:"latencyMs,omitempty"`
+		// TTLSeconds is how long the fault stays active, use 0 to keep it until it is expired manually
+		TTLSeconds float64   `json:"ttlSeconds,omitempty"`
+		ExpiresAt  time.Time `json:"expiresAt,omitempty"`
+	}
+
+	faultList struct {
+		next  int
+		items []*Fault
+	}
+)
+
+// Applies returns true if the fault should be injected by the given instance
+func (f *Fault) Applies(service, instance string) bool {
+	return (f.Service == "" || f.Service == service) &&
+		(f.Instance == "" || f.Instance == instance)
+}
+
+// Active returns false once the fault expired
+func (f *Fault) Active(now time.Time) bool {
+	return f.ExpiresAt.IsZero() || now.Before(f.ExpiresAt)
+}
+
+func (f *Fault) validate() error {
+	f.Kind = strings.ToLower(strings.TrimSpace(f.Kind))
+	switch f.Kind {
+	case FaultLatency:
+		if f.LatencyMs == nil {
+			return fmt.Errorf("latency faults require a latency distribution")
+		}
+		if err := f.LatencyMs.Validate(); err != nil {
+			return err
+		}
+	case FaultError:
+		if f.Status == 0 {
+			f.Status = http.StatusInternalServerError
+		}
+		if f.Status < 400 || f.Status > 599 {
+			return fmt.Errorf("error faults require a 4xx or 5xx status")
+		}
+	case FaultDrop, FaultHang:
+	default:
+		return fmt.Errorf("unknown fault kind %q", f.Kind)
+	}
+	if f.Rate == nil {
+		all := 1.0
+		f.Rate = &all
+	}
+	if *f.Rate < 0 || *f.Rate > 1 {
+		return fmt.Errorf("rate must be between 0 and 1")
+	}
+	if f.TTLSeconds < 0 {
+		return fmt.Errorf("ttl cannot be negative")
+	}
+	return nil
+}
+
+func (fl *faultList) addFault(f Fault) *Fault {
+	fl.next++
+	f.ID = "fault-" + strconv.Itoa(fl.next)
+	if f.TTLSeconds > 0 {
+		f.ExpiresAt = time.Now().Add(time.Duration(f.TTLSeconds * float64(time.Second)))
+	}
+	fl.items = append(fl.items, &f)
+	return &f
+}
+
+func (fl *faultList) expire(id string) bool {
+	for i, v := range fl.items {
+		if v.ID == id {
+			copy(fl.items[i:], fl.items[i+1:])
+			fl.items[len(fl.items)-1] = nil
+			fl.items = fl.items[:len(fl.items)-1]
+			return true
+		}
+	}
+	return false
+}
+
+func (fl *faultList) trim() {
+	now := time.Now()
+	active := fl.items[:0]
+	for _, v := range fl.items {
+		if v.Active(now) {
+			active = append(active, v)
+		}
+	}
+	for i := len(active); i < len(fl.items); i++ {
+		fl.items[i] = nil
+	}
+	fl.items = active
+}
+
+func (c *control) createFault(rw http.ResponseWriter, req *http.Request) {
+	f := Fault{}
+	if err := render.ReadJSONOrFail(rw, req, &f); err != nil {
+		return
+	}
+	if err := f.validate(); err != nil {
+		render.WriteError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	var created *Fault
+	mutex.Run(c.globalLock.Exclusive(), func() {
+		created = c.faults.addFault(f)
+	})
+	render.WriteJSON(rw, http.StatusCreated, created)
+}
+
+func (c *control) listFaults(rw http.ResponseWriter, req *http.Request) {
+	var buf []byte
+	var err error
+	mutex.Run(c.globalLock.Exclusive(), func() {
+		c.faults.trim()
+		buf, err = json.Marshal(c.faults.items)
+	})
+	if err != nil {
+		render.WriteError(rw, http.StatusInternalServerError, "Bad server, could not handle the request")
+		return
+	}
+	render.WriteJSONRaw(rw, http.StatusOK, buf)
+}
+
+func (c *control) deleteFault(rw http.ResponseWriter, req *http.Request) {
+	id := httprouter.ParamsFromContext(req.Context()).ByName("id")
+	var found bool
+	mutex.Run(c.globalLock.Exclusive(), func() {
+		found = c.faults.expire(id)
+	})
+	if !found {
+		render.WriteError(rw, http.StatusNotFound, "Fault not found")
+		return
+	}
+	render.WriteSuccess(rw, http.StatusOK, "Fault expired")
+}
+
+// createFaultForm is used by the dashboard to create faults
+func (c *control) createFaultForm(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, "Unable to parse form body", http.StatusBadRequest)
+		return
+	}
+	var parseErr error
+	number := func(name string) float64 {
+		s := strings.TrimSpace(req.FormValue(name))
+		if s == "" {
+			return 0
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil && parseErr == nil {
+			parseErr = fmt.Errorf("%v must be a number", name)
+		}
+		return v
+	}
+	f := Fault{
+		Service:    strings.TrimSpace(req.FormValue("service")),
+		Instance:   strings.TrimSpace(req.FormValue("instance")),
+		Kind:       req.FormValue("kind"),
+		TTLSeconds: number("ttl"),
+	}
+	if strings.TrimSpace(req.FormValue("rate")) != "" {
+		rate := number("rate")
+		f.Rate = &rate
+	}
+	switch f.Kind {
+	case FaultError:
+		f.Status = int(number("status"))
+	case FaultLatency:
+		f.LatencyMs = &randdist.Distribution{
+			Kind:   req.FormValue("latency.kind"),
+			Min:    number("latency.min"),
+			Max:    number("latency.max"),
+			Mean:   number("latency.mean"),
+			StdDev: number("latency.stdDev"),
+			Shape:  number("latency.shape"),
+		}
+	}
+	if parseErr != nil {
+		http.Error(rw, fmt.Sprintf("Invalid fault: %v", parseErr), http.StatusBadRequest)
+		return
+	}
+	if err := f.validate(); err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid fault: %v", err), http.StatusBadRequest)
+		return
+	}
+	mutex.Run(c.globalLock.Exclusive(), func() {
+		c.faults.addFault(f)
+	})
+	http.Redirect(rw, req, "/", http.StatusSeeOther)
+}
+
+// expireFaultForm is used by the dashboard to expire faults
+func (c *control) expireFaultForm(rw http.ResponseWriter, req *http.Request) {
+	id := httprouter.ParamsFromContext(req.Context()).ByName("id")
+	mutex.Run(c.globalLock.Exclusive(), func() {
+		c.faults.expire(id)
+	})
+	http.Redirect(rw, req, "/", http.StatusSeeOther)
+}
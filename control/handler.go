@@ -14,17 +14,30 @@ import (
 	"time"
 
 	"github.com/andrebq/learn-system-design/internal/logutil"
+	"github.com/andrebq/learn-system-design/internal/metrics"
 	"github.com/andrebq/learn-system-design/internal/mutex"
 	"github.com/andrebq/learn-system-design/internal/render"
 	"github.com/julienschmidt/httprouter"
 )
 
 type (
+	// Option changes how the control plane is configured
+	Option func(*options)
+
+	options struct {
+		metrics *metrics.Registry
+		ttl     time.Duration
+		reaper  context.Context
+	}
+
 	control struct {
 		globalLock mutex.Zone
+		ttl        time.Duration
 		stressors  *stressorList
 		services   *serviceList
 		instances  *instanceList
+		faults     *faultList
+		broker     *broker
 	}
 
 	instanceList struct {
@@ -40,44 +53,131 @@ type (
 	}
 
 	Instance struct {
-		Name                string            `json:"name"`
-		LastPing            time.Time         `json:"lastPing,omitempty"`
-		TimeSinceLastPingMs int64             `json:"timeSinceLastPingMs,omitempty"`
-		Services            map[string]string `json:"services"`
-		Metrics             struct {
-			Requests int64 `json:"requests"`
+		Name                string                `json:"name"`
+		LastPing            time.Time             `json:"lastPing,omitempty"`
+		TimeSinceLastPingMs int64                 `json:"timeSinceLastPingMs,omitempty"`
+		Services            map[string]string     `json:"services"`
+		ScriptVersion       int64                 `json:"scriptVersion"`
+		ScriptError         string                `json:"scriptError,omitempty"`
+		Breakers            map[string]string     `json:"breakers,omitempty"`
+		Caches              map[string]CacheStats `json:"caches,omitempty"`
+		// Statuses counts the requests answered by each status code
+		Statuses map[string]int64 `json:"statuses,omitempty"`
+		// CallLatencyMs is the average latency of calls to each service
+		CallLatencyMs map[string]float64 `json:"callLatencyMs,omitempty"`
+		// Window holds the requests served since the previous heartbeat
+		Window  *WindowStats `json:"window,omitempty"`
+		Metrics struct {
+			Requests     int64   `json:"requests"`
+			InFlight     int64   `json:"inFlight"`
+			LatencyAvgMs float64 `json:"latencyAvgMs"`
+			PoolCapacity int64   `json:"poolCapacity"`
+			PoolIdle     int64   `json:"poolIdle"`
+			PoolHits     int64   `json:"poolHits"`
+			PoolMisses   int64   `json:"poolMisses"`
+
+			Running        int64   `json:"running"`
+			QueueDepth     int64   `json:"queueDepth"`
+			QueueWaitAvgMs float64 `json:"queueWaitAvgMs"`
+			Shed           int64   `json:"shed"`
+
+			Calls              int64   `json:"calls"`
+			CallAttempts       int64   `json:"callAttempts"`
+			Retries            int64   `json:"retries"`
+			RetriesDenied      int64   `json:"retriesDenied"`
+			RetryAmplification float64 `json:"retryAmplification"`
+
+			FaultsInjected int64 `json:"faultsInjected"`
+
+			ScriptTimeouts            int64 `json:"scriptTimeouts"`
+			InstructionLimitsExceeded int64 `json:"instructionLimitsExceeded"`
+
+			MessagesConsumed int64 `json:"messagesConsumed"`
+			MessagesFailed   int64 `json:"messagesFailed"`
+
+			StorageKeys      int64 `json:"storageKeys"`
+			StoragePoolSize  int64 `json:"storagePoolSize"`
+			StorageInUse     int64 `json:"storageInUse"`
+			StorageWaiting   int64 `json:"storageWaiting"`
+			StorageLockWaits int64 `json:"storageLockWaits"`
+
+			Routes map[string]int64 `json:"routes,omitempty"`
 		} `json:"metrics"`
 	}
 
+	CacheStats struct {
+		Hits      int64   `json:"hits"`
+		Misses    int64   `json:"misses"`
+		Evictions int64   `json:"evictions"`
+		Entries   int64   `json:"entries"`
+		HitRatio  float64 `json:"hitRatio"`
+	}
+
 	Stressor struct {
+		Heartbeat
 		BaseEndpoint   string `json:"baseEndpoint"`
 		Name           string `json:"name"`
 		TestInProgress bool   `json:"testInProgress"`
 	}
 
+	// Registry is the information instances fetch from the control plane
+	Registry struct {
+		Servers []*Server `json:"servers"`
+		Faults  []*Fault  `json:"faults"`
+	}
+
 	Server struct {
+		Heartbeat
 		Service  string `json:"service"`
 		Endpoint string `json:"endpoint"`
+		Weight   int    `json:"weight,omitempty"`
 	}
 )
 
-func Handler() http.Handler {
+func Handler(opts ...Option) http.Handler {
+	o := options{ttl: DefaultTTL}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	r := httprouter.New()
 	c := &control{
+		ttl:       o.ttl,
 		services:  &serviceList{},
 		stressors: &stressorList{},
 		instances: &instanceList{
 			items: make(map[string]*Instance),
 		},
+		faults: &faultList{},
+		broker: newBroker(),
 	}
 	r.HandlerFunc("PUT", "/register/service/:service", c.registerServer)
 	r.HandlerFunc("PUT", "/register/stressor/:name", c.registerStressor)
 	r.HandlerFunc("PUT", "/register/instance/:name", c.registerInstance)
+	r.HandlerFunc("DELETE", "/register/service/:service", c.deregisterServer)
+	r.HandlerFunc("DELETE", "/register/stressor/:name", c.deregisterStressor)
+	r.HandlerFunc("DELETE", "/register/instance/:name", c.deregisterInstance)
 	r.HandlerFunc("GET", "/registry", c.getRegistry)
 	r.HandlerFunc("GET", "/static/styles/:style", c.renderCss)
 	r.HandlerFunc("POST", "/actions/trigger-stressor/:name", c.triggerStressor)
+	r.HandlerFunc("POST", "/faults", c.createFault)
+	r.HandlerFunc("GET", "/faults", c.listFaults)
+	r.HandlerFunc("DELETE", "/faults/:id", c.deleteFault)
+	r.HandlerFunc("POST", "/actions/create-fault", c.createFaultForm)
+	r.HandlerFunc("POST", "/actions/expire-fault/:id", c.expireFaultForm)
+	r.HandlerFunc("GET", "/queue", c.getQueues)
+	r.HandlerFunc("POST", "/queue/topics/:topic/messages", c.publishMessage)
+	r.HandlerFunc("POST", "/queue/topics/:topic/groups/:group/receive", c.receiveMessages)
+	r.HandlerFunc("POST", "/queue/topics/:topic/groups/:group/ack", c.ackMessages)
+	r.HandlerFunc("POST", "/queue/topics/:topic/groups/:group/nack", c.nackMessages)
 	r.HandlerFunc("GET", "/", c.getDashboard)
-	return r
+	if o.reaper != nil {
+		go c.runReaper(o.reaper)
+	}
+	if o.metrics == nil {
+		return r
+	}
+	o.metrics.Collect(c.collectMetrics)
+	return metrics.NewHTTPMetrics(o.metrics).Handler(r, metrics.FirstSegment)
 }
 
 func (c *control) renderCss(rw http.ResponseWriter, req *http.Request) {
@@ -143,12 +243,46 @@ func (c *control) registerInstance(rw http.ResponseWriter, req *http.Request) {
 	render.WriteSuccess(rw, http.StatusOK, "Instance added to the list")
 }
 
+func (c *control) deregisterServer(rw http.ResponseWriter, req *http.Request) {
+	service := httprouter.ParamsFromContext(req.Context()).ByName("service")
+	r := Server{}
+	if err := render.ReadJSONOrFail(rw, req, &r); err != nil {
+		return
+	}
+	endpoint := strings.TrimRight(r.Endpoint, "/")
+	mutex.Run(c.globalLock.Exclusive(), func() {
+		c.services.removeServer(service, endpoint)
+	})
+	render.WriteSuccess(rw, http.StatusOK, "Server removed from the list")
+}
+
+func (c *control) deregisterStressor(rw http.ResponseWriter, req *http.Request) {
+	name := httprouter.ParamsFromContext(req.Context()).ByName("name")
+	mutex.Run(c.globalLock.Exclusive(), func() {
+		c.stressors.removeStressor(name)
+	})
+	render.WriteSuccess(rw, http.StatusOK, "Stressor removed from the list")
+}
+
+func (c *control) deregisterInstance(rw http.ResponseWriter, req *http.Request) {
+	name := httprouter.ParamsFromContext(req.Context()).ByName("name")
+	mutex.Run(c.globalLock.Exclusive(), func() {
+		delete(c.instances.items, name)
+	})
+	render.WriteSuccess(rw, http.StatusOK, "Instance removed from the list")
+}
+
 func (c *control) getDashboard(rw http.ResponseWriter, req *http.Request) {
 	var buf bytes.Buffer
+	mutex.Run(c.globalLock.Exclusive(), func() {
+		c.faults.trim()
+		c.reap(time.Now())
+	})
+	queues := c.broker.stats()
 	err := mutex.RunErr(c.globalLock.Shared(), func() error {
 		defaultStressorTarget := "http://invalid.localhost"
 		for _, s := range c.services.items {
-			if s.Service == "frontend" {
+			if s.Service == "frontend" && s.Healthy() {
 				defaultStressorTarget = s.Endpoint
 			}
 		}
@@ -156,11 +290,17 @@ func (c *control) getDashboard(rw http.ResponseWriter, req *http.Request) {
 			Servers               []*Server
 			Stressors             []*Stressor
 			Instances             map[string]*Instance
+			ServiceStats          map[string]*WindowStats
+			Faults                []*Fault
+			Queues                []QueueStats
 			DefaultStressorTarget string
 		}{
 			Servers:               c.services.items,
 			Stressors:             c.stressors.items,
 			Instances:             c.instances.items,
+			ServiceStats:          serviceWindows(c.instances.items),
+			Faults:                c.faults.items,
+			Queues:                queues,
 			DefaultStressorTarget: defaultStressorTarget,
 		})
 	})
@@ -181,16 +321,24 @@ func (c *control) getRegistry(rw http.ResponseWriter, req *http.Request) {
 	var err error
 	mutex.Run(c.globalLock.Exclusive(), func() {
 		c.instances.trim()
+		c.faults.trim()
+		c.reap(time.Now())
 	})
 	mutex.Run(c.globalLock.Shared(), func() {
+		// gone entries are only kept to be displayed in the dashboard
+		servers, stressors := c.registered()
 		buf, err = json.Marshal(struct {
-			Servers   []*Server            `json:"servers"`
-			Stressors []*Stressor          `json:"stressor"`
-			Instances map[string]*Instance `json:"instances"`
+			Servers      []*Server               `json:"servers"`
+			Stressors    []*Stressor             `json:"stressor"`
+			Instances    map[string]*Instance    `json:"instances"`
+			ServiceStats map[string]*WindowStats `json:"serviceStats"`
+			Faults       []*Fault                `json:"faults"`
 		}{
-			Servers:   c.services.items,
-			Stressors: c.stressors.items,
-			Instances: c.instances.items,
+			Servers:      servers,
+			Stressors:    stressors,
+			Instances:    c.instances.items,
+			ServiceStats: serviceWindows(c.instances.items),
+			Faults:       c.faults.items,
 		})
 	})
 	if err != nil {
@@ -233,24 +381,51 @@ func (c *control) triggerStressor(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (sl *stressorList) addStressor(s Stressor) {
+	now := time.Now()
 	for _, v := range sl.items {
 		if v.BaseEndpoint == s.BaseEndpoint {
 			v.TestInProgress = s.TestInProgress
+			v.beat(now)
 			return
 		}
 	}
+	s.beat(now)
 	sl.items = append(sl.items, &s)
 }
 
+// removeStressor marks the stressor as gone, it is forgotten by reap
+func (sl *stressorList) removeStressor(name string) {
+	now := time.Now()
+	for _, v := range sl.items {
+		if v.Name == name {
+			v.deregister(now)
+		}
+	}
+}
+
 func (sl *serviceList) addServer(s Server) {
+	now := time.Now()
 	for _, v := range sl.items {
 		if v.Service == s.Service && v.Endpoint == s.Endpoint {
+			v.Weight = s.Weight
+			v.beat(now)
 			return
 		}
 	}
+	s.beat(now)
 	sl.items = append(sl.items, &s)
 }
 
+// removeServer marks the server as gone, it is forgotten by reap
+func (sl *serviceList) removeServer(service, endpoint string) {
+	now := time.Now()
+	for _, v := range sl.items {
+		if v.Service == service && v.Endpoint == endpoint {
+			v.deregister(now)
+		}
+	}
+}
+
 func (il *instanceList) addInstance(i Instance) {
 	il.items[i.Name] = &i
 	il.trim()
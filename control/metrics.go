@@ -0,0 +1,75 @@
+package control
+
+import (
+	"time"
+
+	"github.com/andrebq/learn-system-design/internal/metrics"
+	"github.com/andrebq/learn-system-design/internal/mutex"
+)
+
+// WithMetrics registers the metrics of the control plane in r, including the numbers
+// reported by each instance, so they can be scraped from a single place
+func WithMetrics(r *metrics.Registry) Option {
+	return func(o *options) {
+		o.metrics = r
+	}
+}
+
+// collectMetrics exposes the state of the simulation
+func (c *control) collectMetrics(e *metrics.Emitter) {
+	queues := c.broker.stats()
+	mutex.Run(c.globalLock.Shared(), func() {
+		servers := map[[2]string]int{}
+		for _, s := range c.services.items {
+			servers[[2]string{s.Service, s.State}]++
+		}
+		for key, count := range servers {
+			e.Gauge("lsd_control_servers", "Servers registered for each service, by state", float64(count), "service", key[0], "state", key[1])
+		}
+		stressors := map[string]int{}
+		for _, s := range c.stressors.items {
+			stressors[s.State]++
+		}
+		for state, count := range stressors {
+			e.Gauge("lsd_control_stressors", "Stressors registered in the control plane, by state", float64(count), "state", state)
+		}
+		now := time.Now()
+		active := 0
+		for _, f := range c.faults.items {
+			if f.Active(now) {
+				active++
+			}
+		}
+		e.Gauge("lsd_control_faults_active", "Faults currently injected", float64(active))
+		e.Gauge("lsd_control_instances", "Instances which reported their metrics", float64(len(c.instances.items)))
+		for name, i := range c.instances.items {
+			m := i.Metrics
+			e.Counter("lsd_instance_requests", "Requests received by the instance", float64(m.Requests), "instance", name)
+			e.Gauge("lsd_instance_requests_in_flight", "Requests being served by the instance", float64(m.InFlight), "instance", name)
+			e.Gauge("lsd_instance_latency_avg_seconds", "Average time taken by the instance to answer requests", m.LatencyAvgMs/1000, "instance", name)
+			for status, count := range i.Statuses {
+				e.Counter("lsd_instance_responses", "Requests answered by the instance, by status code", float64(count), "instance", name, "status", status)
+			}
+			for service, latency := range i.CallLatencyMs {
+				e.Gauge("lsd_instance_call_latency_avg_seconds", "Average time taken by calls from the instance to each service", latency/1000, "instance", name, "service", service)
+			}
+			e.Gauge("lsd_instance_last_ping_age_seconds", "Time since the instance reported its metrics", now.Sub(i.LastPing).Seconds(), "instance", name)
+		}
+		for service, w := range serviceWindows(c.instances.items) {
+			e.Gauge("lsd_service_request_rate", "Requests per second served by all instances of the service during their last window", w.RequestRate, "service", service)
+			e.Gauge("lsd_service_error_ratio", "Fraction of requests answered with 5xx or dropped during the last window", w.ErrorRate, "service", service)
+			for q, v := range map[string]float64{"0.5": w.Latency.P50Ms, "0.9": w.Latency.P90Ms, "0.99": w.Latency.P99Ms, "1": w.Latency.MaxMs} {
+				e.Gauge("lsd_service_latency_seconds", "Latency quantiles of the service during the last window", v/1000, "service", service, "quantile", q)
+			}
+		}
+	})
+	for _, q := range queues {
+		e.Counter("lsd_queue_published", "Messages published to the topic", float64(q.Published), "topic", q.Topic, "group", q.Group)
+		e.Gauge("lsd_queue_ready", "Messages waiting to be delivered", float64(q.Ready), "topic", q.Topic, "group", q.Group)
+		e.Gauge("lsd_queue_in_flight", "Messages delivered but not acknowledged", float64(q.InFlight), "topic", q.Topic, "group", q.Group)
+		e.Counter("lsd_queue_acked", "Messages acknowledged by consumers", float64(q.Acked), "topic", q.Topic, "group", q.Group)
+		e.Counter("lsd_queue_redelivered", "Messages delivered more than once", float64(q.Redelivered), "topic", q.Topic, "group", q.Group)
+		e.Counter("lsd_queue_dead_lettered", "Messages moved to the dead letter topic", float64(q.DeadLettered), "topic", q.Topic, "group", q.Group)
+		e.Gauge("lsd_queue_lag_seconds", "Age of the oldest message which was not acknowledged", q.LagSeconds, "topic", q.Topic, "group", q.Group)
+	}
+}
@@ -0,0 +1,452 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrebq/learn-system-design/internal/render"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// DeadLetterSuffix is appended to the name of a topic to get the topic which receives
+	// messages that could not be processed after MaxAttempts deliveries
+	DeadLetterSuffix = ".dlq"
+
+	// DefaultVisibilityTimeout is how long a received message is hidden from other consumers
+	DefaultVisibilityTimeout = 30 * time.Second
+	// DefaultMaxAttempts is how many times a message is delivered before going to the dead-letter topic
+	DefaultMaxAttempts = 5
+	// maxWait limits how long a receive call can wait for new messages
+	maxWait = 20 * time.Second
+	// maxBacklog is how many messages are kept by topics without consumer groups
+	maxBacklog = 10_000
+)
+
+type (
+	// QueueMessage is a message published to a topic
+	QueueMessage struct {
+		ID          string          `json:"id"`
+		Topic       string          `json:"topic"`
+		Body        json.RawMessage `json:"body"`
+		PublishedAt time.Time       `json:"publishedAt"`
+		// Attempts is how many times the message was delivered to the group, including this one
+		Attempts int `json:"attempts"`
+	}
+
+	// ReceiveRequest controls how messages are received by a consumer group
+	ReceiveRequest struct {
+		Max                      int     `json:"max"`
+		VisibilityTimeoutSeconds float64 `json:"visibilityTimeoutSeconds"`
+		WaitSeconds              float64 `json:"waitSeconds"`
+		MaxAttempts              int     `json:"maxAttempts"`
+	}
+
+	// QueueStats describes the state of a consumer group, topics without groups
+	// are reported with an empty group and all their messages as Ready
+	QueueStats struct {
+		Topic        string  `json:"topic"`
+		Group        string  `json:"group,omitempty"`
+		Published    int64   `json:"published"`
+		Ready        int     `json:"ready"`
+		InFlight     int     `json:"inFlight"`
+		Acked        int64   `json:"acked"`
+		Redelivered  int64   `json:"redelivered"`
+		DeadLettered int64   `json:"deadLettered"`
+		LagSeconds   float64 `json:"lagSeconds"`
+	}
+
+	// broker is an in-memory message queue with at-least-once delivery.
+	//
+	// Each consumer group receives a copy of every message published to the topic,
+	// and inside a group each message is delivered to a single consumer at a time.
+	// Messages that are not acknowledged before their visibility timeout expires
+	// are delivered again.
+	broker struct {
+		sync.Mutex
+		next   int64
+		topics map[string]*topic
+	}
+
+	topic struct {
+		name      string
+		published int64
+		// backlog keeps messages published before any group subscribed to the topic
+		backlog []*QueueMessage
+		groups  map[string]*consumerGroup
+	}
+
+	consumerGroup struct {
+		name        string
+		maxAttempts int
+		ready       []*QueueMessage
+		inflight    map[string]*delivery
+		// signal is closed (and replaced) when new messages are ready
+		signal chan struct{}
+
+		acked        int64
+		redelivered  int64
+		deadLettered int64
+	}
+
+	delivery struct {
+		msg      *QueueMessage
+		deadline time.Time
+	}
+)
+
+func newBroker() *broker {
+	return &broker{topics: make(map[string]*topic)}
+}
+
+func (b *broker) topic(name string) *topic {
+	t := b.topics[name]
+	if t == nil {
+		t = &topic{name: name, groups: make(map[string]*consumerGroup)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+func (b *broker) publish(topicName string, body json.RawMessage) *QueueMessage {
+	b.Lock()
+	defer b.Unlock()
+	b.next++
+	msg := &QueueMessage{
+		ID:          "msg-" + strconv.FormatInt(b.next, 10),
+		Topic:       topicName,
+		Body:        body,
+		PublishedAt: time.Now(),
+	}
+	b.enqueue(b.topic(topicName), msg)
+	return msg
+}
+
+func (b *broker) enqueue(t *topic, msg *QueueMessage) {
+	t.published++
+	if len(t.groups) == 0 {
+		if len(t.backlog) >= maxBacklog {
+			t.backlog[0] = nil
+			t.backlog = t.backlog[1:]
+		}
+		t.backlog = append(t.backlog, msg)
+		return
+	}
+	for _, g := range t.groups {
+		cp := *msg
+		g.push(&cp)
+	}
+}
+
+// group returns the consumer group, the first group of a topic receives its backlog
+func (b *broker) group(t *topic, name string, maxAttempts int) *consumerGroup {
+	g := t.groups[name]
+	if g == nil {
+		g = &consumerGroup{name: name, inflight: make(map[string]*delivery), signal: make(chan struct{})}
+		if len(t.groups) == 0 {
+			g.ready, t.backlog = t.backlog, nil
+		}
+		t.groups[name] = g
+	}
+	if maxAttempts > 0 {
+		g.maxAttempts = maxAttempts
+	}
+	if g.maxAttempts <= 0 {
+		g.maxAttempts = DefaultMaxAttempts
+	}
+	return g
+}
+
+// receive returns up to req.Max messages, waiting up to req.WaitSeconds if none is available
+func (b *broker) receive(ctx context.Context, topicName, groupName string, req ReceiveRequest) []*QueueMessage {
+	if req.Max <= 0 {
+		req.Max = 1
+	}
+	visibility := DefaultVisibilityTimeout
+	if req.VisibilityTimeoutSeconds > 0 {
+		visibility = time.Duration(req.VisibilityTimeoutSeconds * float64(time.Second))
+	}
+	wait := time.Duration(req.WaitSeconds * float64(time.Second))
+	if wait > maxWait {
+		wait = maxWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		b.Lock()
+		t := b.topic(topicName)
+		g := b.group(t, groupName, req.MaxAttempts)
+		now := time.Now()
+		b.requeueExpired(t, g, now)
+		var msgs []*QueueMessage
+		for len(msgs) < req.Max && len(g.ready) > 0 {
+			msg := g.ready[0]
+			g.ready[0] = nil
+			g.ready = g.ready[1:]
+			msg.Attempts++
+			g.inflight[msg.ID] = &delivery{msg: msg, deadline: now.Add(visibility)}
+			cp := *msg
+			msgs = append(msgs, &cp)
+		}
+		signal := g.signal
+		b.Unlock()
+		if len(msgs) > 0 || wait <= 0 {
+			return msgs
+		}
+		select {
+		case <-signal:
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// ack removes the messages from the group, returns how many were acknowledged
+func (b *broker) ack(topicName, groupName string, ids []string) int {
+	b.Lock()
+	defer b.Unlock()
+	t := b.topics[topicName]
+	if t == nil || t.groups[groupName] == nil {
+		return 0
+	}
+	g := t.groups[groupName]
+	count := 0
+	for _, id := range ids {
+		if _, ok := g.inflight[id]; ok {
+			delete(g.inflight, id)
+			g.acked++
+			count++
+		}
+	}
+	return count
+}
+
+// nack makes the messages available again, without waiting for the visibility timeout
+func (b *broker) nack(topicName, groupName string, ids []string) int {
+	b.Lock()
+	defer b.Unlock()
+	t := b.topics[topicName]
+	if t == nil || t.groups[groupName] == nil {
+		return 0
+	}
+	g := t.groups[groupName]
+	count := 0
+	for _, id := range ids {
+		if d, ok := g.inflight[id]; ok {
+			delete(g.inflight, id)
+			b.redeliver(t, g, d.msg)
+			count++
+		}
+	}
+	return count
+}
+
+// requeueExpired makes messages whose visibility timeout expired available again
+func (b *broker) requeueExpired(t *topic, g *consumerGroup, now time.Time) {
+	for id, d := range g.inflight {
+		if now.Before(d.deadline) {
+			continue
+		}
+		delete(g.inflight, id)
+		b.redeliver(t, g, d.msg)
+	}
+}
+
+// redeliver puts msg back in the group, or in the dead-letter topic if it was delivered too many times
+func (b *broker) redeliver(t *topic, g *consumerGroup, msg *QueueMessage) {
+	if msg.Attempts >= g.maxAttempts {
+		g.deadLettered++
+		dead := *msg
+		dead.Topic = t.name + DeadLetterSuffix
+		dead.Attempts = 0
+		b.enqueue(b.topic(dead.Topic), &dead)
+		return
+	}
+	g.redelivered++
+	g.push(msg)
+}
+
+func (g *consumerGroup) push(msg *QueueMessage) {
+	g.ready = append(g.ready, msg)
+	close(g.signal)
+	g.signal = make(chan struct{})
+}
+
+// stats returns the state of every topic and group, sorted by name
+func (b *broker) stats() []QueueStats {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	var stats []QueueStats
+	for _, t := range b.topics {
+		if len(t.groups) == 0 {
+			s := QueueStats{Topic: t.name, Published: t.published, Ready: len(t.backlog)}
+			if len(t.backlog) > 0 {
+				s.LagSeconds = now.Sub(t.backlog[0].PublishedAt).Seconds()
+			}
+			stats = append(stats, s)
+			continue
+		}
+		for _, g := range t.groups {
+			b.requeueExpired(t, g, now)
+			s := QueueStats{
+				Topic:        t.name,
+				Group:        g.name,
+				Published:    t.published,
+				Ready:        len(g.ready),
+				InFlight:     len(g.inflight),
+				Acked:        g.acked,
+				Redelivered:  g.redelivered,
+				DeadLettered: g.deadLettered,
+			}
+			// lag is the age of the oldest message which was not acknowledged yet
+			var oldest time.Time
+			for _, m := range g.ready {
+				if oldest.IsZero() || m.PublishedAt.Before(oldest) {
+					oldest = m.PublishedAt
+				}
+			}
+			for _, d := range g.inflight {
+				if oldest.IsZero() || d.msg.PublishedAt.Before(oldest) {
+					oldest = d.msg.PublishedAt
+				}
+			}
+			if !oldest.IsZero() {
+				s.LagSeconds = now.Sub(oldest).Seconds()
+			}
+			stats = append(stats, s)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Topic != stats[j].Topic {
+			return stats[i].Topic < stats[j].Topic
+		}
+		return stats[i].Group < stats[j].Group
+	})
+	return stats
+}
+
+func (c *control) publishMessage(rw http.ResponseWriter, req *http.Request) {
+	topic := httprouter.ParamsFromContext(req.Context()).ByName("topic")
+	var body struct {
+		Body json.RawMessage `json:"body"`
+	}
+	if err := render.ReadJSONOrFail(rw, req, &body); err != nil {
+		return
+	}
+	if len(body.Body) == 0 {
+		render.WriteError(rw, http.StatusBadRequest, "Message body is required")
+		return
+	}
+	render.WriteJSON(rw, http.StatusCreated, c.broker.publish(topic, body.Body))
+}
+
+func (c *control) receiveMessages(rw http.ResponseWriter, req *http.Request) {
+	params := httprouter.ParamsFromContext(req.Context())
+	var r ReceiveRequest
+	if err := render.ReadJSONOrFail(rw, req, &r); err != nil {
+		return
+	}
+	msgs := c.broker.receive(req.Context(), params.ByName("topic"), params.ByName("group"), r)
+	if msgs == nil {
+		msgs = []*QueueMessage{}
+	}
+	render.WriteJSON(rw, http.StatusOK, msgs)
+}
+
+func (c *control) ackMessages(rw http.ResponseWriter, req *http.Request) {
+	c.settleMessages(rw, req, c.broker.ack)
+}
+
+func (c *control) nackMessages(rw http.ResponseWriter, req *http.Request) {
+	c.settleMessages(rw, req, c.broker.nack)
+}
+
+func (c *control) settleMessages(rw http.ResponseWriter, req *http.Request, settle func(topic, group string, ids []string) int) {
+	params := httprouter.ParamsFromContext(req.Context())
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := render.ReadJSONOrFail(rw, req, &body); err != nil {
+		return
+	}
+	count := settle(params.ByName("topic"), params.ByName("group"), body.IDs)
+	render.WriteJSON(rw, http.StatusOK, struct {
+		Count int `json:"count"`
+	}{Count: count})
+}
+
+func (c *control) getQueues(rw http.ResponseWriter, req *http.Request) {
+	render.WriteJSON(rw, http.StatusOK, c.broker.stats())
+}
+
+// Publish sends a message to the broker running in the control plane
+func Publish(ctx context.Context, controlEndpoint string, topic string, body json.RawMessage) (*QueueMessage, error) {
+	var msg QueueMessage
+	err := queueRequest(ctx, controlEndpoint, fmt.Sprintf("/queue/topics/%v/messages", url.PathEscape(topic)), struct {
+		Body json.RawMessage `json:"body"`
+	}{Body: body}, http.StatusCreated, &msg)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Receive waits for messages published to topic, on behalf of the given consumer group
+func Receive(ctx context.Context, controlEndpoint string, topic, group string, req ReceiveRequest) ([]*QueueMessage, error) {
+	var msgs []*QueueMessage
+	err := queueRequest(ctx, controlEndpoint, fmt.Sprintf("/queue/topics/%v/groups/%v/receive", url.PathEscape(topic), url.PathEscape(group)), req, http.StatusOK, &msgs)
+	return msgs, err
+}
+
+// Ack tells the broker that the messages were processed and must not be delivered again
+func Ack(ctx context.Context, controlEndpoint string, topic, group string, ids ...string) error {
+	return queueRequest(ctx, controlEndpoint, fmt.Sprintf("/queue/topics/%v/groups/%v/ack", url.PathEscape(topic), url.PathEscape(group)), struct {
+		IDs []string `json:"ids"`
+	}{IDs: ids}, http.StatusOK, nil)
+}
+
+// Nack tells the broker that the messages could not be processed and should be delivered again
+func Nack(ctx context.Context, controlEndpoint string, topic, group string, ids ...string) error {
+	return queueRequest(ctx, controlEndpoint, fmt.Sprintf("/queue/topics/%v/groups/%v/nack", url.PathEscape(topic), url.PathEscape(group)), struct {
+		IDs []string `json:"ids"`
+	}{IDs: ids}, http.StatusOK, nil)
+}
+
+func queueRequest(ctx context.Context, controlEndpoint string, path string, body interface{}, expectedStatus int, out interface{}) error {
+	controlEndpoint = strings.TrimRight(controlEndpoint, "/")
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", controlEndpoint+path, bytes.NewBuffer(buf))
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != expectedStatus {
+		return fmt.Errorf("control: unexpected status from queue at %v, status %v", controlEndpoint, res.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("control: unable to decode response from queue, cause %v", err)
+	}
+	return nil
+}
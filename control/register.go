@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -21,7 +22,7 @@ func RegisterStressor(ctx context.Context, controlEndpoint string, name string,
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%v/register/stressor/%v", controlEndpoint, name), bytes.NewBuffer(buf))
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%v/register/stressor/%v", controlEndpoint, url.PathEscape(name)), bytes.NewBuffer(buf))
 	if err != nil {
 		return err
 	}
@@ -45,7 +46,7 @@ func RegisterInstance(ctx context.Context, controlEndpoint string, data Instance
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%v/register/instance/%v", controlEndpoint, name), bytes.NewBuffer(buf))
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%v/register/instance/%v", controlEndpoint, url.PathEscape(name)), bytes.NewBuffer(buf))
 	if err != nil {
 		return err
 	}
@@ -62,16 +63,22 @@ func RegisterInstance(ctx context.Context, controlEndpoint string, data Instance
 
 // Register calls the endpoint registration
 func Register(ctx context.Context, controlEndpoint string, service string, publicEndpoint string) error {
-	controlEndpoint = strings.TrimRight(controlEndpoint, "/")
-	body := Server{
+	return RegisterServer(ctx, controlEndpoint, Server{
 		Service:  service,
 		Endpoint: publicEndpoint,
-	}
+	})
+}
+
+// RegisterServer calls the endpoint registration, including the
+// weight used by load-balancers
+func RegisterServer(ctx context.Context, controlEndpoint string, body Server) error {
+	service, publicEndpoint := body.Service, body.Endpoint
+	controlEndpoint = strings.TrimRight(controlEndpoint, "/")
 	buf, err := json.Marshal(body)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%v/register/service/%v", controlEndpoint, service), bytes.NewBuffer(buf))
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%v/register/service/%v", controlEndpoint, url.PathEscape(service)), bytes.NewBuffer(buf))
 	if err != nil {
 		return err
 	}
@@ -88,10 +95,18 @@ func Register(ctx context.Context, controlEndpoint string, service string, publi
 
 // Services returns the list of services that are registered
 func Services(ctx context.Context, controlEndpoint string) ([]*Server, error) {
-	controlEndpoint = strings.TrimRight(controlEndpoint, "/")
-	var registry struct {
-		Servers []*Server `json:"servers"`
+	registry, err := FetchRegistry(ctx, controlEndpoint)
+	if err != nil {
+		return nil, err
 	}
+	return registry.Servers, nil
+}
+
+// FetchRegistry returns the services that are registered and the faults
+// that should be injected by instances
+func FetchRegistry(ctx context.Context, controlEndpoint string) (*Registry, error) {
+	controlEndpoint = strings.TrimRight(controlEndpoint, "/")
+	var registry Registry
 	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%v/registry", controlEndpoint), nil)
 	if err != nil {
 		return nil, err
@@ -100,6 +115,7 @@ func Services(ctx context.Context, controlEndpoint string) ([]*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("control: unable to fetch servers from %v, status %v", controlEndpoint, res.Status)
 	}
@@ -107,5 +123,42 @@ func Services(ctx context.Context, controlEndpoint string) ([]*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("control: unable to decode response from control, cause %v", err)
 	}
-	return registry.Servers, nil
+	return &registry, nil
+}
+
+// DeregisterServer removes the endpoint from the servers of the service,
+// so other instances stop sending requests to it
+func DeregisterServer(ctx context.Context, controlEndpoint string, body Server) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return deregister(ctx, controlEndpoint, fmt.Sprintf("service/%v", url.PathEscape(body.Service)), buf)
+}
+
+// DeregisterInstance removes the metrics of the instance from the control plane
+func DeregisterInstance(ctx context.Context, controlEndpoint string, name string) error {
+	return deregister(ctx, controlEndpoint, fmt.Sprintf("instance/%v", url.PathEscape(name)), nil)
+}
+
+// DeregisterStressor removes the stressor from the control plane
+func DeregisterStressor(ctx context.Context, controlEndpoint string, name string) error {
+	return deregister(ctx, controlEndpoint, fmt.Sprintf("stressor/%v", url.PathEscape(name)), nil)
+}
+
+func deregister(ctx context.Context, controlEndpoint string, path string, body []byte) error {
+	controlEndpoint = strings.TrimRight(controlEndpoint, "/")
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%v/register/%v", controlEndpoint, path), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("control: unable to deregister %v at %v. Status %v", path, controlEndpoint, res.Status)
+	}
+	return nil
 }
@@ -0,0 +1,33 @@
+package control
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegisterEscapesNames(t *testing.T) {
+	ctx := context.Background()
+	controlPlane := httptest.NewServer(Handler())
+	defer controlPlane.Close()
+
+	server := Server{Service: "orders v2?region=eu", Endpoint: "http://orders.localhost"}
+	if err := RegisterServer(ctx, controlPlane.URL, server); err != nil {
+		t.Fatal(err)
+	}
+	servers, err := Services(ctx, controlPlane.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].Service != server.Service {
+		t.Fatalf("service should be registered with its full name, got %v", servers)
+	}
+	if err := DeregisterServer(ctx, controlPlane.URL, server); err != nil {
+		t.Fatal(err)
+	}
+	if servers, err = Services(ctx, controlPlane.URL); err != nil {
+		t.Fatal(err)
+	} else if len(servers) != 0 {
+		t.Fatalf("service should be removed, got %v", servers)
+	}
+}
@@ -1,10 +1,17 @@
 package control
 
-import "html/template"
+import (
+	"fmt"
+	"html/template"
+)
 
 var (
-	rootTmpl = template.Must(template.New("__root__").Parse(
+	rootTmpl = template.Must(template.New("__root__").Funcs(template.FuncMap{
+		"percent": func(v float64) string { return fmt.Sprintf("%.1f%%", v*100) },
+	}).Parse(
 		`
+{{define "latency"}}{{ printf "%.1f / %.1f / %.1f / %.1f" .P50Ms .P90Ms .P99Ms .MaxMs }}ms{{end}}
+{{define "heartbeat"}}{{ .State }} ({{ .LastHeartbeat.Format "15:04:05" }}){{end}}
 {{define "index.html"}}
 {{ $defaultTarget := .DefaultStressorTarget }}
 <!doctype html>
@@ -15,20 +22,223 @@ var (
 		<link rel="stylesheet" href="/static/styles/theme.css">
 	</head>
 	<body>
+		<article class="content">
+			<h1>Traffic by service</h1>
+			<table>
+				<thead>
+					<tr>
+						<th>Service</th>
+						<th>Instances</th>
+						<th>Requests per second (in flight)</th>
+						<th>Error rate</th>
+						<th>Requests per second by status class</th>
+						<th>Latency (p50 / p90 / p99 / max)</th>
+					</tr>
+				</thead>
+				<tbody>
+				{{ range $service, $window := .ServiceStats }}
+					<tr>
+						<td>{{ $service }}</td>
+						<td>{{ $window.Instances }}</td>
+						<td>{{ printf "%.1f" $window.RequestRate }} ({{ $window.InFlight }})</td>
+						<td>{{ percent $window.ErrorRate }}</td>
+						<td>
+							{{ range $class, $rate := $window.ClassRates }}
+							<div>{{ $class }}: {{ printf "%.1f" $rate }}</div>
+							{{ end }}
+						</td>
+						<td>{{ template "latency" $window.Latency }}</td>
+					</tr>
+				{{ end }}
+				</tbody>
+			</table>
+		</article>
 		<article class="content">
 			<h1>Instances</h1>
 			<table>
 				<thead>
 					<tr>
 						<th>Name</th>
+						<th>Script version</th>
 						<th>Number of requests</th>
+						<th>Last window (requests per second, error rate, latency)</th>
+						<th>Running / queued (avg wait, shed)</th>
+						<th>Lua states (idle / capacity)</th>
+						<th>Pool hits / misses</th>
+						<th>Outgoing calls (attempts, retries, denied)</th>
+						<th>Requests per route</th>
+						<th>Circuit breakers</th>
+						<th>Faults injected</th>
+						<th>Limits exceeded (timeout / instructions)</th>
+						<th>Storage connections (in use / pool, waiting)</th>
+						<th>Caches (hit ratio, entries, evictions)</th>
+						<th>Messages (consumed / failed)</th>
 					</tr>
 				</thead>
 				<tbody>
 				{{ range $instanceName, $data := .Instances }}
 					<tr>
 						<td>{{ $data.Name }}</td>
-						<td>{{ $data.Metrics.Requests }}</td>
+						<td>
+							{{ $data.ScriptVersion }}
+							{{ if $data.ScriptError }}
+							(reload failed: {{ $data.ScriptError }})
+							{{ end }}
+						</td>
+						<td>
+							{{ $data.Metrics.Requests }}
+							<div>in flight: {{ $data.Metrics.InFlight }}, avg: {{ printf "%.1f" $data.Metrics.LatencyAvgMs }}ms</div>
+							{{ range $status, $count := $data.Statuses }}
+							<div>{{ $status }}: {{ $count }}</div>
+							{{ end }}
+						</td>
+						<td>
+							{{ with $data.Window }}
+							{{ printf "%.1f" .RequestRate }}/s, {{ percent .ErrorRate }} errors
+							<div>{{ template "latency" .Latency }}</div>
+							{{ end }}
+						</td>
+						<td>
+							{{ $data.Metrics.Running }} / {{ $data.Metrics.QueueDepth }}
+							({{ printf "%.1f" $data.Metrics.QueueWaitAvgMs }}ms, {{ $data.Metrics.Shed }})
+						</td>
+						<td>{{ $data.Metrics.PoolIdle }} / {{ $data.Metrics.PoolCapacity }}</td>
+						<td>{{ $data.Metrics.PoolHits }} / {{ $data.Metrics.PoolMisses }}</td>
+						<td>
+							{{ $data.Metrics.Calls }}
+							({{ $data.Metrics.CallAttempts }}, {{ $data.Metrics.Retries }}, {{ $data.Metrics.RetriesDenied }})
+							{{ if $data.Metrics.Calls }}
+							<div>amplification: {{ printf "%.2f" $data.Metrics.RetryAmplification }}x</div>
+							{{ end }}
+							{{ range $service, $latency := $data.CallLatencyMs }}
+							<div>{{ $service }}: {{ printf "%.1f" $latency }}ms</div>
+							{{ end }}
+						</td>
+						<td>
+							{{ range $route, $count := $data.Metrics.Routes }}
+							<div>{{ $route }}: {{ $count }}</div>
+							{{ end }}
+						</td>
+						<td>
+							{{ range $target, $state := $data.Breakers }}
+							<div>{{ $target }}: {{ $state }}</div>
+							{{ end }}
+						</td>
+						<td>{{ $data.Metrics.FaultsInjected }}</td>
+						<td>{{ $data.Metrics.ScriptTimeouts }} / {{ $data.Metrics.InstructionLimitsExceeded }}</td>
+						<td>
+							{{ $data.Metrics.StorageInUse }} / {{ $data.Metrics.StoragePoolSize }}, {{ $data.Metrics.StorageWaiting }}
+							{{ if $data.Metrics.StorageKeys }}
+							<div>keys: {{ $data.Metrics.StorageKeys }}, lock waits: {{ $data.Metrics.StorageLockWaits }}</div>
+							{{ end }}
+						</td>
+						<td>
+							{{ range $name, $cache := $data.Caches }}
+							<div>
+								{{ $name }}: {{ printf "%.2f" $cache.HitRatio }}
+								({{ $cache.Hits }} hits / {{ $cache.Misses }} misses),
+								{{ $cache.Entries }}, {{ $cache.Evictions }}
+							</div>
+							{{ end }}
+						</td>
+						<td>{{ $data.Metrics.MessagesConsumed }} / {{ $data.Metrics.MessagesFailed }}</td>
+					</tr>
+				{{ end }}
+				</tbody>
+			</table>
+		</article>
+		<article class="content">
+			<h1>Faults</h1>
+			<table>
+				<thead>
+					<tr>
+						<th>ID</th>
+						<th>Target</th>
+						<th>Fault</th>
+						<th>Rate</th>
+						<th>Expires</th>
+						<th></th>
+					</tr>
+				</thead>
+				<tbody>
+				{{ range $idx, $data := .Faults }}
+					<tr>
+						<td>{{ $data.ID }}</td>
+						<td>
+							{{ if $data.Service }}service {{ $data.Service }}{{ end }}
+							{{ if $data.Instance }}instance {{ $data.Instance }}{{ end }}
+							{{ if not (or $data.Service $data.Instance) }}all instances{{ end }}
+						</td>
+						<td>
+							{{ $data.Kind }}
+							{{ if $data.Status }}({{ $data.Status }}){{ end }}
+							{{ if $data.LatencyMs }}({{ $data.LatencyMs }} ms){{ end }}
+						</td>
+						<td>{{ $data.Rate }}</td>
+						<td>{{ if $data.ExpiresAt.IsZero }}never{{ else }}{{ $data.ExpiresAt.Format "15:04:05" }}{{ end }}</td>
+						<td>
+							<form method="POST" action="/actions/expire-fault/{{ $data.ID }}">
+								<button type="submit">Expire</button>
+							</form>
+						</td>
+					</tr>
+				{{ end }}
+				</tbody>
+			</table>
+			<form method="POST" action="/actions/create-fault">
+				<input name="service" type="text" placeholder="service (empty for all)">
+				<input name="instance" type="text" placeholder="instance (empty for all)">
+				<select name="kind">
+					<option value="latency">latency</option>
+					<option value="error">error</option>
+					<option value="drop">drop connection</option>
+					<option value="hang">hang</option>
+				</select>
+				<input name="rate" type="text" placeholder="rate (0-1)" value="1">
+				<input name="status" type="text" placeholder="status (error)" value="500">
+				<select name="latency.kind">
+					<option value="fixed">fixed</option>
+					<option value="uniform">uniform</option>
+					<option value="normal">normal</option>
+					<option value="exponential">exponential</option>
+					<option value="lognormal">lognormal</option>
+					<option value="pareto">pareto</option>
+				</select>
+				<input name="latency.mean" type="text" placeholder="mean ms">
+				<input name="latency.stdDev" type="text" placeholder="std dev ms">
+				<input name="latency.min" type="text" placeholder="min ms">
+				<input name="latency.max" type="text" placeholder="max ms">
+				<input name="latency.shape" type="text" placeholder="shape (pareto)">
+				<input name="ttl" type="text" placeholder="ttl seconds (empty for never)">
+				<button type="submit">Inject</button>
+			</form>
+		</article>
+		<article class="content">
+			<h1>Queues</h1>
+			<table>
+				<thead>
+					<tr>
+						<th>Topic</th>
+						<th>Consumer group</th>
+						<th>Published</th>
+						<th>Depth (ready / in flight)</th>
+						<th>Consumer lag</th>
+						<th>Acked</th>
+						<th>Redelivered</th>
+						<th>Dead-lettered</th>
+					</tr>
+				</thead>
+				<tbody>
+				{{ range $idx, $data := .Queues }}
+					<tr>
+						<td>{{ $data.Topic }}</td>
+						<td>{{ if $data.Group }}{{ $data.Group }}{{ else }}(no consumers){{ end }}</td>
+						<td>{{ $data.Published }}</td>
+						<td>{{ $data.Ready }} / {{ $data.InFlight }}</td>
+						<td>{{ printf "%.1f" $data.LagSeconds }}s</td>
+						<td>{{ $data.Acked }}</td>
+						<td>{{ $data.Redelivered }}</td>
+						<td>{{ $data.DeadLettered }}</td>
 					</tr>
 				{{ end }}
 				</tbody>
@@ -40,12 +250,14 @@ var (
 				<thead>
 					<tr>
 						<th>Name</th>
+						<th>State (last heartbeat)</th>
 					</tr>
 				</thead>
 				<tbody>
 				{{ range $idx, $data := .Servers }}
 					<tr>
-						<td><a rel="no-follow" href="{{ $data.Endpoint }}">{{ $data.Service }}</a> ({{ $data.Endpoint }})</td>
+						<td><a rel="no-follow" href="{{ $data.Endpoint }}">{{ $data.Service }}</a> ({{ $data.Endpoint }}{{ if $data.Weight }}, weight {{ $data.Weight }}{{ end }})</td>
+						<td>{{ template "heartbeat" $data.Heartbeat }}</td>
 					</tr>
 				{{ end }}
 				</tbody>
@@ -57,6 +269,7 @@ var (
 				<thead>
 					<tr>
 						<th>Name</th>
+						<th>State (last heartbeat)</th>
 						<th>Trigger</th>
 					</tr>
 				</thead>
@@ -69,6 +282,7 @@ var (
 							(test in progress)
 							{{ end }}
 						</td>
+						<td>{{ template "heartbeat" $data.Heartbeat }}</td>
 						<td>
 							<form method="POST" action="/actions/trigger-stressor/{{ $data.Name }}">
 								<input name="target.endpoint" type="text" value="{{ $defaultTarget }}">
@@ -0,0 +1,145 @@
+package control
+
+import (
+	"context"
+	"time"
+
+	"github.com/andrebq/learn-system-design/internal/mutex"
+)
+
+const (
+	// StateHealthy entries sent a heartbeat within the TTL
+	StateHealthy = "healthy"
+	// StateSuspect entries missed their heartbeats for longer than the TTL,
+	// instances stop sending requests to suspect servers
+	StateSuspect = "suspect"
+	// StateGone entries were deregistered or missed their heartbeats for twice the TTL,
+	// they are removed from the registry and forgotten after another TTL
+	StateGone = "gone"
+
+	// DefaultTTL is how long an entry stays healthy without heartbeats,
+	// servers and stressors send one every 5 seconds
+	DefaultTTL = 15 * time.Second
+)
+
+type (
+	// Heartbeat tracks when a server or stressor was last registered
+	Heartbeat struct {
+		LastHeartbeat time.Time `json:"lastHeartbeat,omitempty"`
+		State         string    `json:"state,omitempty"`
+		GoneSince     time.Time `json:"goneSince,omitempty"`
+	}
+)
+
+// WithTTL changes how long servers and stressors stay healthy without heartbeats
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		if ttl > 0 {
+			o.ttl = ttl
+		}
+	}
+}
+
+// WithReaper updates the state of servers and stressors in background, until ctx is done.
+// Without it, states are only updated when the registry or the dashboard are requested.
+func WithReaper(ctx context.Context) Option {
+	return func(o *options) {
+		o.reaper = ctx
+	}
+}
+
+// Healthy returns true if the entry is sending its heartbeats
+func (h *Heartbeat) Healthy() bool {
+	return h.State == "" || h.State == StateHealthy
+}
+
+func (h *Heartbeat) beat(now time.Time) {
+	h.LastHeartbeat = now
+	h.State = StateHealthy
+	h.GoneSince = time.Time{}
+}
+
+func (h *Heartbeat) deregister(now time.Time) {
+	if h.State == StateGone {
+		return
+	}
+	h.State = StateGone
+	h.GoneSince = now
+}
+
+// expire updates the state of the entry, it returns true once the entry can be forgotten
+func (h *Heartbeat) expire(now time.Time, ttl time.Duration) bool {
+	if h.State == StateGone {
+		return now.Sub(h.GoneSince) >= ttl
+	}
+	switch age := now.Sub(h.LastHeartbeat); {
+	case age >= 2*ttl:
+		h.State = StateGone
+		h.GoneSince = now
+	case age >= ttl:
+		h.State = StateSuspect
+	default:
+		h.State = StateHealthy
+	}
+	return false
+}
+
+// reap updates the state of servers and stressors, and removes the ones which are gone for too long.
+//
+// Callers must hold the exclusive lock of c.
+func (c *control) reap(now time.Time) {
+	servers := c.services.items[:0]
+	for _, s := range c.services.items {
+		if !s.expire(now, c.ttl) {
+			servers = append(servers, s)
+		}
+	}
+	for i := len(servers); i < len(c.services.items); i++ {
+		c.services.items[i] = nil
+	}
+	c.services.items = servers
+
+	stressors := c.stressors.items[:0]
+	for _, s := range c.stressors.items {
+		if !s.expire(now, c.ttl) {
+			stressors = append(stressors, s)
+		}
+	}
+	for i := len(stressors); i < len(c.stressors.items); i++ {
+		c.stressors.items[i] = nil
+	}
+	c.stressors.items = stressors
+}
+
+// runReaper calls reap periodically until ctx is done
+func (c *control) runReaper(ctx context.Context) {
+	tick := time.NewTicker(c.ttl / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			mutex.Run(c.globalLock.Exclusive(), func() {
+				c.reap(now)
+			})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// registered returns the servers and stressors which are not gone
+func (c *control) registered() ([]*Server, []*Stressor) {
+	servers := make([]*Server, 0, len(c.services.items))
+	for _, s := range c.services.items {
+		if s.State != StateGone {
+			servers = append(servers, s)
+		}
+	}
+	stressors := make([]*Stressor, 0, len(c.stressors.items))
+	for _, s := range c.stressors.items {
+		if s.State != StateGone {
+			stressors = append(stressors, s)
+		}
+	}
+	return servers, stressors
+}
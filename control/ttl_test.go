@@ -0,0 +1,84 @@
+package control
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ttl := 100 * time.Millisecond
+	controlPlane := httptest.NewServer(Handler(WithTTL(ttl), WithReaper(ctx)))
+	defer controlPlane.Close()
+	states := func() map[string]string {
+		registry, err := FetchRegistry(ctx, controlPlane.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := map[string]string{}
+		for _, s := range registry.Servers {
+			out[s.Endpoint] = s.State
+		}
+		return out
+	}
+	waitFor := func(expected map[string]string, heartbeat ...string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			for _, endpoint := range heartbeat {
+				if err := RegisterServer(ctx, controlPlane.URL, Server{Service: "backend", Endpoint: endpoint}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			actual := states()
+			if len(actual) == len(expected) {
+				match := true
+				for k, v := range expected {
+					match = match && actual[k] == v
+				}
+				if match {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expecting %v got %v", expected, actual)
+			}
+			time.Sleep(ttl / 10)
+		}
+	}
+
+	waitFor(map[string]string{"http://a": StateHealthy, "http://b": StateHealthy, "http://c": StateHealthy}, "http://a", "http://b", "http://c")
+	// c is deregistered, b stops sending heartbeats
+	if err := DeregisterServer(ctx, controlPlane.URL, Server{Service: "backend", Endpoint: "http://c"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(map[string]string{"http://a": StateHealthy, "http://b": StateSuspect}, "http://a")
+	waitFor(map[string]string{"http://a": StateHealthy}, "http://a")
+
+	// a new heartbeat brings the server back
+	waitFor(map[string]string{"http://a": StateHealthy, "http://b": StateHealthy}, "http://a", "http://b")
+
+	// gone servers are still displayed in the dashboard, until they are forgotten
+	dashboard := httptest.NewServer(Handler())
+	defer dashboard.Close()
+	if err := RegisterServer(ctx, dashboard.URL, Server{Service: "backend", Endpoint: "http://d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeregisterServer(ctx, dashboard.URL, Server{Service: "backend", Endpoint: "http://d"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get(dashboard.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	buf, _ := ioutil.ReadAll(res.Body)
+	if !strings.Contains(string(buf), StateGone) {
+		t.Errorf("dashboard should display gone servers")
+	}
+}
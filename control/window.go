@@ -0,0 +1,109 @@
+package control
+
+import (
+	"github.com/andrebq/learn-system-design/internal/metrics"
+)
+
+type (
+	// WindowStats describes the requests served during the last heartbeat of an instance,
+	// or by all instances of a service when aggregated by the control plane
+	WindowStats struct {
+		// Instances is the number of instances aggregated, only set for services
+		Instances int     `json:"instances,omitempty"`
+		Seconds   float64 `json:"seconds"`
+
+		Requests    int64   `json:"requests"`
+		RequestRate float64 `json:"requestRate"`
+		InFlight    int64   `json:"inFlight"`
+
+		// Classes counts requests by status class (2xx, 3xx, 4xx, 5xx or dropped)
+		Classes map[string]int64 `json:"classes,omitempty"`
+		// ClassRates is the number of requests per second of each status class
+		ClassRates map[string]float64 `json:"classRates,omitempty"`
+		// ErrorRate is the fraction of requests answered with 5xx or dropped
+		ErrorRate float64 `json:"errorRate"`
+
+		Latency LatencyStats `json:"latency"`
+		// Sketch holds the latencies (in seconds), so windows can be merged
+		Sketch *metrics.Sketch `json:"sketch,omitempty"`
+	}
+
+	// LatencyStats are the quantiles of the time taken to answer requests
+	LatencyStats struct {
+		P50Ms float64 `json:"p50Ms"`
+		P90Ms float64 `json:"p90Ms"`
+		P99Ms float64 `json:"p99Ms"`
+		MaxMs float64 `json:"maxMs"`
+	}
+)
+
+// Summarize computes rates and latency quantiles from the counts and sketch of w.
+//
+// The rates of a service are the sum of the rates of its instances,
+// which are added by merge.
+func (w *WindowStats) Summarize() {
+	if w.Instances == 0 && w.Seconds > 0 {
+		w.RequestRate = float64(w.Requests) / w.Seconds
+		for class, count := range w.Classes {
+			if w.ClassRates == nil {
+				w.ClassRates = make(map[string]float64, len(w.Classes))
+			}
+			w.ClassRates[class] = float64(count) / w.Seconds
+		}
+	}
+	if w.Requests > 0 {
+		w.ErrorRate = float64(w.Classes["5xx"]+w.Classes["dropped"]) / float64(w.Requests)
+	}
+	w.Latency = LatencyStats{
+		P50Ms: w.Sketch.Quantile(0.5) * 1000,
+		P90Ms: w.Sketch.Quantile(0.9) * 1000,
+		P99Ms: w.Sketch.Quantile(0.99) * 1000,
+		MaxMs: w.Sketch.Quantile(1) * 1000,
+	}
+}
+
+// merge adds the window of another instance of the same service,
+// Summarize must be called after all windows are merged
+func (w *WindowStats) merge(other *WindowStats) {
+	w.Instances++
+	if other.Seconds > w.Seconds {
+		w.Seconds = other.Seconds
+	}
+	w.Requests += other.Requests
+	w.RequestRate += other.RequestRate
+	w.InFlight += other.InFlight
+	for class, count := range other.Classes {
+		if w.Classes == nil {
+			w.Classes = make(map[string]int64)
+			w.ClassRates = make(map[string]float64)
+		}
+		w.Classes[class] += count
+		w.ClassRates[class] += other.ClassRates[class]
+	}
+	if w.Sketch == nil {
+		w.Sketch = metrics.NewSketch()
+	}
+	w.Sketch.Merge(other.Sketch)
+}
+
+// serviceWindows aggregates the last window of every instance by the services it implements
+func serviceWindows(instances map[string]*Instance) map[string]*WindowStats {
+	out := make(map[string]*WindowStats)
+	for _, i := range instances {
+		if i.Window == nil {
+			continue
+		}
+		for service := range i.Services {
+			w := out[service]
+			if w == nil {
+				w = &WindowStats{}
+				out[service] = w
+			}
+			w.merge(i.Window)
+		}
+	}
+	for _, w := range out {
+		w.Summarize()
+	}
+	return out
+}
@@ -0,0 +1,72 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrebq/learn-system-design/internal/metrics"
+)
+
+func TestServiceWindows(t *testing.T) {
+	ctx := context.Background()
+	controlPlane := httptest.NewServer(Handler())
+	defer controlPlane.Close()
+
+	window := func(classes map[string]int64, latencies ...float64) *WindowStats {
+		w := &WindowStats{Seconds: 2, Requests: int64(len(latencies)), Classes: classes, Sketch: metrics.NewSketch()}
+		for _, l := range latencies {
+			w.Sketch.Add(l)
+		}
+		w.Summarize()
+		return w
+	}
+	instances := []Instance{
+		{Name: "a", Services: map[string]string{"orders": "http://a"}, Window: window(map[string]int64{"2xx": 3, "5xx": 1}, 0.01, 0.02, 0.03, 0.04)},
+		{Name: "b", Services: map[string]string{"orders": "http://b"}, Window: window(map[string]int64{"2xx": 4}, 0.05, 0.06, 0.07, 0.08)},
+		// instances which didn't send a window yet are ignored
+		{Name: "c", Services: map[string]string{"orders": "http://c"}},
+	}
+	for _, i := range instances {
+		if err := RegisterInstance(ctx, controlPlane.URL, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := http.Get(controlPlane.URL + "/registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var registry struct {
+		Instances    map[string]*Instance    `json:"instances"`
+		ServiceStats map[string]*WindowStats `json:"serviceStats"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&registry); err != nil {
+		t.Fatal(err)
+	}
+	service := registry.ServiceStats["orders"]
+	if service == nil || service.Instances != 2 || service.Requests != 8 || service.RequestRate != 4 ||
+		service.ClassRates["2xx"] != 3.5 || service.ErrorRate != 0.125 {
+		t.Fatalf("unexpected service stats %#v", service)
+	}
+	// quantiles are computed from the merged latencies, not from the quantiles of each instance
+	if math.Abs(service.Latency.P50Ms-40) > 0.4 || service.Latency.MaxMs != 80 {
+		t.Errorf("unexpected latency quantiles %#v", service.Latency)
+	}
+	if registry.Instances["a"].Window.Requests != 4 {
+		t.Errorf("instances should keep their own window, got %#v", registry.Instances["a"].Window)
+	}
+
+	dashboard, err := http.Get(controlPlane.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dashboard.Body.Close()
+	if dashboard.StatusCode != http.StatusOK {
+		t.Errorf("dashboard should render the windows, got %v", dashboard.Status)
+	}
+}
@@ -1,6 +1,25 @@
 local handler = require("handler")
+local services = require("services")
 local computations = require("computations")
--- pretends that the system is doing an IO operation for 0.3 seconds
-computations.slow(1)
-handler.writeStatus(200)
-handler.writeBody("from LUA!")
+-- pretends that the system is doing an IO operation which takes 0.3 seconds on average,
+-- with a long tail of slower calls
+local ok = computations.sleep{ kind = "lognormal", mean = 0.3, stdDev = 0.1 }
+if not ok then
+    -- the caller already gave up (see the timeout used by the frontend)
+    handler.writeJSON(504, { from = "backend", error = "deadline exceeded" })
+    return
+end
+
+-- calls made by this request carry the time left to answer the frontend,
+-- so the database stops working on requests nobody is waiting for
+local remaining = handler.deadline()
+if remaining and remaining < 0.05 then
+    handler.writeJSON(504, { from = "backend", error = "not enough time left to call the database" })
+    return
+end
+local res, err = services.call{ service = "database", method = "GET", path = "/" }
+if err then
+    handler.writeJSON(502, { from = "backend", error = tostring(err) })
+    return
+end
+handler.writeJSON(200, { from = "backend", database = res.body })
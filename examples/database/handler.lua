@@ -1,6 +1,14 @@
 local handler = require("handler")
-local computations = require("computations")
--- pretends that the system is doing an IO operation for 0.3 seconds
-computations.slow(0.3)
-handler.writeStatus(200)
-handler.writeBody("from LUA!")
+local storage = require("storage")
+
+-- every request reads and updates the same row, so requests also
+-- compete for the row lock
+local ok, err = storage.withLock("visits", function()
+    local visits = storage.get("visits") or 0
+    storage.put("visits", visits + 1)
+end)
+if not ok then
+    handler.writeJSON(503, { from = "database", error = err })
+    return
+end
+handler.writeJSON(200, { from = "database", visits = storage.get("visits") })
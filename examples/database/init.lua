@@ -0,0 +1,15 @@
+local storage = require("storage")
+-- a small pool of connections turns the database into the bottleneck of the system,
+-- once all connections are busy requests wait in line (or time out)
+storage.configure{
+    poolSize = 4,
+    poolTimeout = 1,
+    latency = {
+        get = { kind = "lognormal", mean = 0.005, stdDev = 0.003 },
+        put = { kind = "lognormal", mean = 0.01, stdDev = 0.005 },
+        scan = { kind = "lognormal", mean = 0.02, stdDev = 0.01 },
+    },
+    -- lookups get slower as the dataset grows
+    sizeFactor = 0.1,
+    perRow = 0.0005,
+}
@@ -1,6 +1,17 @@
 local handler = require("handler")
-local computations = require("computations")
--- pretends that the system is doing an IO operation for 0.3 seconds
-computations.slow(0.3)
+-- echoes the request back to the caller
+local body, err = handler.body()
+if err then
+    handler.writeStatus(413)
+    handler.writeBody(err)
+    return
+end
+handler.addHeader("Content-Type", "text/plain; charset=utf-8")
 handler.writeStatus(200)
-handler.writeBody("from LUA!")
+handler.writeBody(handler.method() .. " " .. handler.path() .. "\n")
+handler.writeBody("remote: " .. handler.remoteAddr() .. "\n")
+for name, value in pairs(handler.headers()) do
+    handler.writeBody(name .. ": " .. value .. "\n")
+end
+handler.writeBody("\n")
+handler.writeBody(body)
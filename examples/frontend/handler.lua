@@ -1,5 +1,11 @@
 local handler = require("handler")
 local services = require("services")
-services.call("backend")
-handler.writeStatus(200)
-handler.writeBody("from LUA!")
+local json = require("json")
+
+local res, err = services.call{ service = "backend", method = "GET", path = "/", timeout = 1 }
+if err then
+    -- fallback: tell the client which dependency failed instead of crashing
+    handler.writeJSON(503, { from = "frontend", error = tostring(err) })
+    return
+end
+handler.writeJSON(200, { from = "frontend", backend = json.decode(res.body), latency = res.latency })
@@ -24,10 +24,13 @@ type (
 		services    []string
 		scriptsBase string
 		stressors   int
+		watch       bool
+
+		traceEndpoint string
 	}
 )
 
-func NewManager(baseBinary, baseHost string, basePort int, scriptsBase string, stressors int, services []string) *Manager {
+func NewManager(baseBinary, baseHost string, basePort int, scriptsBase string, stressors int, services []string, watch bool, traceEndpoint string) *Manager {
 	return &Manager{
 		binary:      baseBinary,
 		baseHost:    baseHost,
@@ -35,6 +38,9 @@ func NewManager(baseBinary, baseHost string, basePort int, scriptsBase string, s
 		scriptsBase: scriptsBase,
 		stressors:   stressors,
 		services:    append([]string(nil), services...),
+		watch:       watch,
+
+		traceEndpoint: traceEndpoint,
 	}
 }
 
@@ -77,10 +83,18 @@ func (m *Manager) startFleet(ctx context.Context) error {
 
 func (m *Manager) startServers(ctx context.Context, controlEndpoint string) error {
 	for _, service := range m.services {
-		err := m.startCmd(m.childrenGroup.Done, ctx, m.binary, "serve", "--bind", fmt.Sprintf("%v:%v", m.baseHost, m.basePort),
+		args := []string{"serve", "--bind", fmt.Sprintf("%v:%v", m.baseHost, m.basePort),
+			"--init-file", filepath.Join(m.scriptsBase, service, "init.lua"),
 			"--handler-file", filepath.Join(m.scriptsBase, service, "handler.lua"),
 			"--public-endpoint", fmt.Sprintf("http://%v:%v", m.baseHost, m.basePort),
-			"--control-endpoint", controlEndpoint)
+			"--control-endpoint", controlEndpoint}
+		if m.watch {
+			args = append(args, "--watch")
+		}
+		if m.traceEndpoint != "" {
+			args = append(args, "--trace-endpoint", m.traceEndpoint)
+		}
+		err := m.startCmd(m.childrenGroup.Done, ctx, m.binary, args...)
 		if err != nil {
 			return err
 		}
@@ -102,9 +116,13 @@ func (m *Manager) startController(ctx context.Context) (string, error) {
 }
 
 func (m *Manager) startStressor(ctx context.Context, controlEndpoint string) error {
-	err := m.startCmd(m.childrenGroup.Done, ctx, m.binary, "stress", "serve", "--bind", fmt.Sprintf("%v:%v", m.baseHost, m.basePort),
+	args := []string{"stress", "serve", "--bind", fmt.Sprintf("%v:%v", m.baseHost, m.basePort),
 		"--public-endpoint", fmt.Sprintf("http://%v:%v", m.baseHost, m.basePort),
-		"--control-endpoint", controlEndpoint)
+		"--control-endpoint", controlEndpoint}
+	if m.traceEndpoint != "" {
+		args = append(args, "--trace-endpoint", m.traceEndpoint)
+	}
+	err := m.startCmd(m.childrenGroup.Done, ctx, m.binary, args...)
 	if err != nil {
 		return err
 	}
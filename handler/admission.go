@@ -0,0 +1,261 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QueueFIFO  = "fifo"
+	QueueLIFO  = "lifo"
+	QueueCoDel = "codel"
+
+	// codelTarget is the acceptable queueing delay when the queue is
+	// considered overloaded
+	codelTarget = 5 * time.Millisecond
+	// codelInterval is how long the queue must stay non-empty before
+	// being considered overloaded
+	codelInterval = 100 * time.Millisecond
+)
+
+var (
+	errShed = errors.New("handler: request was shed")
+)
+
+type (
+	// AdmissionConfig limits how many requests an instance executes at the same time
+	AdmissionConfig struct {
+		// MaxConcurrency is the maximum number of concurrent handler executions,
+		// use 0 for unlimited
+		MaxConcurrency int
+		// QueueSize is how many requests can wait for a free slot,
+		// requests that arrive when the queue is full are rejected
+		QueueSize int
+		// QueueTimeout is the maximum time a request waits in the queue
+		QueueTimeout time.Duration
+		// Policy decides which request leaves the queue first (fifo, lifo or codel)
+		Policy string
+		// ShedStatus is the HTTP status used to reject requests (503 or 429)
+		ShedStatus int
+	}
+
+	admission struct {
+		sync.Mutex
+		config AdmissionConfig
+
+		running int
+		queue   []*waiter
+		// busySince is when the queue stopped being empty, zero while it is empty
+		busySince time.Time
+
+		shed      int64
+		admitted  int64
+		totalWait int64
+	}
+
+	waiter struct {
+		enqueued time.Time
+		result   chan bool
+	}
+
+	admissionStats struct {
+		Running    int64
+		QueueDepth int64
+		Shed       int64
+		AvgWaitMs  float64
+	}
+)
+
+// NormalizeQueuePolicy returns the canonical name of a queue policy
+func NormalizeQueuePolicy(policy string) (string, error) {
+	switch p := strings.ToLower(policy); p {
+	case "":
+		return QueueFIFO, nil
+	case QueueFIFO, QueueLIFO, QueueCoDel:
+		return p, nil
+	}
+	return "", fmt.Errorf("handler: unknown queue policy %q", policy)
+}
+
+func newAdmission(cfg AdmissionConfig) (*admission, error) {
+	var err error
+	if cfg.Policy, err = NormalizeQueuePolicy(cfg.Policy); err != nil {
+		return nil, err
+	}
+	switch cfg.ShedStatus {
+	case 0:
+		cfg.ShedStatus = http.StatusServiceUnavailable
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+	default:
+		return nil, fmt.Errorf("handler: shed status must be %v or %v", http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	}
+	if cfg.QueueSize < 0 {
+		cfg.QueueSize = 0
+	}
+	if cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = time.Second
+	}
+	return &admission{config: cfg}, nil
+}
+
+// acquire waits until the request can be executed, the returned function
+// must be called once the request is done.
+//
+// errShed is returned if the request was rejected.
+func (a *admission) acquire(ctx context.Context) (func(), error) {
+	if a.config.MaxConcurrency <= 0 {
+		return func() {}, nil
+	}
+	a.Lock()
+	if a.running < a.config.MaxConcurrency && len(a.queue) == 0 {
+		a.running++
+		a.Unlock()
+		atomic.AddInt64(&a.admitted, 1)
+		return a.release, nil
+	}
+	if len(a.queue) >= a.config.QueueSize {
+		a.Unlock()
+		atomic.AddInt64(&a.shed, 1)
+		return nil, errShed
+	}
+	w := &waiter{enqueued: time.Now(), result: make(chan bool, 1)}
+	if len(a.queue) == 0 {
+		a.busySince = w.enqueued
+	}
+	a.queue = append(a.queue, w)
+	a.Unlock()
+
+	timer := time.NewTimer(a.config.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case admitted := <-w.result:
+		return a.admit(w, admitted)
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	a.Lock()
+	if a.remove(w) {
+		a.Unlock()
+		atomic.AddInt64(&a.shed, 1)
+		return nil, errShed
+	}
+	a.Unlock()
+	// the waiter was dequeued while the timer fired, so the result is already available
+	return a.admit(w, <-w.result)
+}
+
+func (a *admission) admit(w *waiter, admitted bool) (func(), error) {
+	if !admitted {
+		atomic.AddInt64(&a.shed, 1)
+		return nil, errShed
+	}
+	atomic.AddInt64(&a.admitted, 1)
+	atomic.AddInt64(&a.totalWait, int64(time.Since(w.enqueued)))
+	return a.release, nil
+}
+
+// release frees one execution slot and hands it to the next request in the queue
+func (a *admission) release() {
+	a.Lock()
+	defer a.Unlock()
+	a.running--
+	for len(a.queue) > 0 && a.running < a.config.MaxConcurrency {
+		w := a.dequeue()
+		if w == nil {
+			break
+		}
+		a.running++
+		w.result <- true
+	}
+}
+
+// dequeue removes the next waiter according to the queue policy.
+//
+// With CoDel, when the queue has been busy for longer than codelInterval,
+// requests that waited more than codelTarget are shed, since they are likely
+// to be timed out by the client anyway.
+func (a *admission) dequeue() *waiter {
+	defer a.checkEmpty()
+	switch a.config.Policy {
+	case QueueLIFO:
+		last := len(a.queue) - 1
+		w := a.queue[last]
+		a.queue[last] = nil
+		a.queue = a.queue[:last]
+		return w
+	case QueueCoDel:
+		now := time.Now()
+		overloaded := now.Sub(a.busySince) > codelInterval
+		for len(a.queue) > 0 {
+			w := a.popFront()
+			if overloaded && now.Sub(w.enqueued) > codelTarget {
+				w.result <- false
+				continue
+			}
+			return w
+		}
+		return nil
+	}
+	return a.popFront()
+}
+
+// checkEmpty forgets when the queue became busy once it is empty
+func (a *admission) checkEmpty() {
+	if len(a.queue) == 0 {
+		a.busySince = time.Time{}
+	}
+}
+
+func (a *admission) popFront() *waiter {
+	w := a.queue[0]
+	a.queue[0] = nil
+	a.queue = a.queue[1:]
+	return w
+}
+
+// remove takes w out of the queue, returns false if w was not in the queue
+func (a *admission) remove(w *waiter) bool {
+	for i, v := range a.queue {
+		if v == w {
+			copy(a.queue[i:], a.queue[i+1:])
+			a.queue[len(a.queue)-1] = nil
+			a.queue = a.queue[:len(a.queue)-1]
+			a.checkEmpty()
+			return true
+		}
+	}
+	return false
+}
+
+// reject writes the response sent to requests that were shed
+func (a *admission) reject(w http.ResponseWriter) {
+	retryAfter := int(math.Ceil(a.config.QueueTimeout.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Instance is overloaded, try again later", a.config.ShedStatus)
+}
+
+func (a *admission) stats() admissionStats {
+	a.Lock()
+	running, depth := a.running, len(a.queue)
+	a.Unlock()
+	s := admissionStats{
+		Running:    int64(running),
+		QueueDepth: int64(depth),
+		Shed:       atomic.LoadInt64(&a.shed),
+	}
+	if admitted := atomic.LoadInt64(&a.admitted); admitted > 0 {
+		s.AvgWaitMs = float64(atomic.LoadInt64(&a.totalWait)) / float64(admitted) / float64(time.Millisecond)
+	}
+	return s
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrebq/learn-system-design/control"
+	"github.com/andrebq/learn-system-design/internal/logutil"
+)
+
+// setFaults keeps the faults from the control plane which apply to this instance
+func (h *h) setFaults(faults []*control.Fault) {
+	var active []*control.Fault
+	for _, f := range faults {
+		if f.Applies(h.service, h.name) {
+			active = append(active, f)
+		}
+	}
+	h.faults.Store(active)
+}
+
+// injectFault applies the active faults to req before it reaches the script.
+//
+// It returns true if the request was answered by a fault, in which case the script must not run.
+func (h *h) injectFault(w http.ResponseWriter, req *http.Request) bool {
+	faults, _ := h.faults.Load().([]*control.Fault)
+	if len(faults) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, f := range faults {
+		// faults are only refreshed every few seconds, so expiration is also checked locally
+		if !f.Active(now) || rand.Float64() >= *f.Rate {
+			continue
+		}
+		atomic.AddInt64(&h.instanceData.Metrics.FaultsInjected, 1)
+		log := logutil.Acquire(req.Context())
+		log.Debug().Str("fault", f.ID).Str("kind", f.Kind).Stringer("url", req.URL).Msg("Injecting fault")
+		switch f.Kind {
+		case control.FaultLatency:
+			delay := time.Duration(f.LatencyMs.Sample() * float64(time.Millisecond))
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return true
+			}
+		case control.FaultError:
+			http.Error(w, "Injected fault", f.Status)
+			return true
+		case control.FaultDrop:
+			// the http server closes the connection without sending a response
+			panic(http.ErrAbortHandler)
+		case control.FaultHang:
+			<-req.Context().Done()
+			return true
+		}
+	}
+	return false
+}
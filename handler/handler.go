@@ -2,18 +2,23 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/andrebq/learn-system-design/control"
 	"github.com/andrebq/learn-system-design/internal/bindings/handler"
 	"github.com/andrebq/learn-system-design/internal/logutil"
+	"github.com/andrebq/learn-system-design/internal/metrics"
 	"github.com/andrebq/learn-system-design/internal/mutex"
+	"github.com/andrebq/learn-system-design/internal/tracing"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -22,7 +27,6 @@ type (
 		mutex.Zone
 		initFile        string
 		handlerFile     string
-		handlerCode     string
 		service         string
 		publicEndpoint  string
 		controlEndpoint string
@@ -31,10 +35,110 @@ type (
 		instanceData control.Instance
 
 		servers []*control.Server
+
+		state *handler.SharedState
+
+		prog       atomic.Value
+		poolSize   int
+		watchFiles bool
+
+		scriptError atomic.Value
+
+		routeLock mutex.Zone
+		routes    map[string]int64
+
+		strategy string
+		weight   int
+		client   *handler.Client
+		limiters *handler.RateLimiters
+		// trustedProxies can set the client address used by rate limiters
+		trustedProxies []string
+		storage        *handler.Storage
+		caches         *handler.Caches
+
+		limits Limits
+
+		admissionConfig AdmissionConfig
+		admission       *admission
+
+		faults atomic.Value
+
+		traceEndpoint string
+		tracer        *tracing.Tracer
+
+		metrics     *metrics.Registry
+		httpMetrics *metrics.HTTPMetrics
+		window      *window
+
+		consumerLock mutex.Zone
+		consumers    *consumers
+
+		health           *handler.Health
+		drainPeriod      time.Duration
+		drainOnce        sync.Once
+		draining         chan struct{}
+		registrationDone chan struct{}
+		// heartbeatInterval is how often the instance registers itself
+		heartbeatInterval time.Duration
 	}
+
+	// Option changes how the handler is configured
+	Option func(*h)
+)
+
+const (
+	// DefaultPoolSize is the maximum number of idle Lua states kept by each handler
+	DefaultPoolSize = 64
 )
 
-func NewHandler(ctx context.Context, initFile string, handlerFile string, name string, publicEndpoint string, controlEndpoint string) (http.Handler, error) {
+// WithWatch enables reloading the scripts whenever they change on disk
+func WithWatch(watch bool) Option {
+	return func(h *h) {
+		h.watchFiles = watch
+	}
+}
+
+// WithBalancer changes the default strategy used to pick servers when
+// calling other services
+func WithBalancer(strategy string) Option {
+	return func(h *h) {
+		h.strategy = strategy
+	}
+}
+
+// WithWeight changes the weight of this instance when registering it in the
+// control plane, weighted load-balancers send more calls to heavier servers
+func WithWeight(weight int) Option {
+	return func(h *h) {
+		h.weight = weight
+	}
+}
+
+// WithAdmission limits how many requests are executed concurrently,
+// and how excess requests are queued or rejected
+func WithAdmission(cfg AdmissionConfig) Option {
+	return func(h *h) {
+		h.admissionConfig = cfg
+	}
+}
+
+// WithTrustedProxies lets requests from the given addresses or networks set the address
+// of the client with X-Forwarded-For, which is ignored by rate limiters otherwise
+func WithTrustedProxies(proxies []string) Option {
+	return func(h *h) {
+		h.trustedProxies = proxies
+	}
+}
+
+// WithPoolSize changes how many idle Lua states are kept around to serve
+// requests, use 0 to create a new state for every request.
+func WithPoolSize(size int) Option {
+	return func(h *h) {
+		h.poolSize = size
+	}
+}
+
+func NewHandler(ctx context.Context, initFile string, handlerFile string, name string, publicEndpoint string, controlEndpoint string, opts ...Option) (http.Handler, error) {
 	handlerCode, err := ioutil.ReadFile(handlerFile)
 	if err != nil {
 		return nil, fmt.Errorf("handler: unable to open %v, cause %w", handlerFile, err)
@@ -43,7 +147,6 @@ func NewHandler(ctx context.Context, initFile string, handlerFile string, name s
 	log.Info().Str("initFile", initFile).Str("handlerFile", filepath.Base(handlerFile)).Msg("Preparing new handler")
 	h := &h{
 		handlerFile:     handlerFile,
-		handlerCode:     string(handlerCode),
 		initFile:        initFile,
 		service:         filepath.Base(filepath.Dir(handlerFile)),
 		publicEndpoint:  publicEndpoint,
@@ -53,28 +156,252 @@ func NewHandler(ctx context.Context, initFile string, handlerFile string, name s
 			Name:     name,
 			Services: map[string]string{filepath.Base(filepath.Dir(handlerFile)): publicEndpoint},
 		},
+		state:    handler.NewSharedState(),
+		limiters: handler.NewRateLimiters(),
+		storage:  handler.NewStorage(),
+		caches:   handler.NewCaches(),
+		poolSize: DefaultPoolSize,
+		limits:   Limits{Timeout: DefaultTimeout},
+		routes:   make(map[string]int64),
+
+		health:           handler.NewHealth(),
+		drainPeriod:      DefaultDrainPeriod,
+		draining:         make(chan struct{}),
+		registrationDone: make(chan struct{}),
+
+		heartbeatInterval: 5 * time.Second,
+	}
+	for _, o := range opts {
+		o(h)
+	}
+	h.client, err = handler.NewClient(h.strategy)
+	if err != nil {
+		return nil, err
+	}
+	h.tracer = tracing.NewTracer(ctx, h.service, h.traceEndpoint)
+	h.client.Tracer = h.tracer
+	h.initMetrics()
+	h.window = newWindow(time.Now())
+	h.admission, err = newAdmission(h.admissionConfig)
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := handler.ParseNetworks(h.trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	h.limiters.TrustProxies(trusted)
+	prog, err := newProgram(handlerCode, filepath.Base(handlerFile), h.poolSize, 1, &poolStats{})
+	if err != nil {
+		return nil, fmt.Errorf("handler: unable to compile %v, cause %w", handlerFile, err)
+	}
+	h.prog.Store(prog)
+	h.scriptError.Store("")
+	if err := h.runInit(ctx); err != nil {
+		return nil, err
+	}
+	if h.watchFiles {
+		go h.watch(ctx)
 	}
 	go h.registration(ctx)
 	return h, nil
 }
 
 func (h *h) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	log := logutil.Acquire(req.Context()).With().Stringer("handler", h).Logger()
+	if h.serveProbe(w, req) {
+		return
+	}
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	var route string
+	h.httpMetrics.InFlight.Add(1)
+	req, span := h.startSpan(req)
+	// runs after any fault injected, including dropped connections
+	defer func() {
+		status := sw.code()
+		p := recover()
+		if p != nil {
+			status = statusDropped
+		}
+		h.observeRequest(route, status, time.Since(start))
+		endSpan(status, span)
+		if p != nil {
+			panic(p)
+		}
+	}()
+	logCtx := logutil.Acquire(req.Context()).With().Stringer("handler", h)
+	if span != nil {
+		logCtx = logCtx.Stringer("traceId", span.Context().TraceID)
+	}
+	log := logCtx.Logger()
 	ctx := logutil.WithLogger(req.Context(), log)
 	req = req.WithContext(ctx)
-	_ = req
-	state := h.newState(w, req)
-	state.SetContext(req.Context())
 	atomic.AddInt64(&h.instanceData.Metrics.Requests, 1)
-	err := state.DoString(h.handlerCode)
+
+	// the caller won't wait for longer than its deadline, so there is no reason to
+	// keep working (or to wait in the admission queue) after that
+	if timeout, ok := handler.ParseDeadline(req); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	if h.injectFault(w, req) {
+		return
+	}
+
+	release, err := h.admission.acquire(req.Context())
 	if err != nil {
+		log.Debug().Str("method", req.Method).Stringer("url", req.URL).Msg("Request rejected by admission control")
+		h.admission.reject(w)
+		return
+	}
+	defer release()
+
+	// keep a reference to the program, so reloads don't affect
+	// requests which are already in-flight
+	prog := h.current()
+	state := prog.acquire()
+	if state == nil {
+		state = h.newState()
+	}
+	sb := newSandbox(req.Context(), h.limits)
+	defer sb.release()
+	req = req.WithContext(sb)
+	h.bindRequest(state, w, req, func(r string) {
+		route = r
+		h.countRoute(r)
+	})
+	sb.attach(state)
+	err = prog.call(state)
+	if err != nil {
+		// the state might be left in an inconsistent state,
+		// so it is safer to just throw it away
+		state.Close()
+		if limitErr := sb.limitErr(); limitErr != nil {
+			h.countLimit(limitErr)
+			log.Error().Err(limitErr).Str("method", req.Method).Stringer("url", req.URL).Msg("Request exceeded its limits")
+			http.Error(w, limitErr.Error(), limitErr.Status())
+			return
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Error().Err(err).Str("method", req.Method).Stringer("url", req.URL).Msg("Deadline sent by the caller exceeded")
+			http.Error(w, "handler: deadline sent by the caller exceeded", http.StatusGatewayTimeout)
+			return
+		}
 		log.Error().Err(err).Str("method", req.Method).Stringer("url", req.URL).Msg("Error while processing request")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	prog.release(state)
+}
+
+func (h *h) current() *program {
+	return h.prog.Load().(*program)
+}
+
+func (h *h) setScriptError(err error) {
+	if err == nil {
+		h.scriptError.Store("")
+		return
+	}
+	h.scriptError.Store(err.Error())
+}
+
+// runInit executes the init file once, before the handler starts serving requests.
+//
+// A missing init file is not an error, as most services don't need one.
+func (h *h) runInit(ctx context.Context) error {
+	if h.initFile == "" {
+		return nil
+	}
+	initCode, err := ioutil.ReadFile(h.initFile)
+	if os.IsNotExist(err) {
+		log := logutil.Acquire(ctx)
+		log.Debug().Str("initFile", h.initFile).Msg("Init file not found, skipping initialization")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("handler: unable to open %v, cause %w", h.initFile, err)
+	}
+	// readiness and subscriptions only replace the current ones if the init file succeeds
+	subs := &handler.Subscriptions{Group: h.service}
+	var health atomic.Value
+	health.Store(handler.NewHealth())
+	L := h.newInitState(ctx, subs, func() *handler.Health { return health.Load().(*handler.Health) })
+	if err := L.DoString(string(initCode)); err != nil {
+		L.Close()
+		return fmt.Errorf("handler: unable to execute %v, cause %w", h.initFile, err)
+	}
+	h.health.Replace(health.Load().(*handler.Health))
+	// subscriptions keep running in L, so they change the readiness of the instance from now on
+	health.Store(h.health)
+	h.replaceConsumers(ctx, L, subs)
+	return nil
+}
+
+// newInitState returns the state used to run the init file, subscriptions
+// made by the init file are added to subs and its readiness is set in health
+func (h *h) newInitState(ctx context.Context, subs *handler.Subscriptions, health func() *handler.Health) *lua.LState {
+	L := newLuaState()
+	setModulePath(L, filepath.Dir(h.initFile))
+	L.SetContext(ctx)
+	L.PreloadModule("state", handler.StateLoader(h.state))
+	L.PreloadModule("json", handler.JSONLoader)
+	L.PreloadModule("computations", handler.FakeComputations(ctx))
+	L.PreloadModule("services", handler.DynamicServicesLoader(ctx, h.availableServers, h.client))
+	L.PreloadModule("queue", handler.QueueLoader(ctx, h.controlEndpoint, subs))
+	L.PreloadModule("ratelimit", handler.RateLimitLoader(nil, h.limiters))
+	L.PreloadModule("storage", handler.StorageLoader(ctx, h.storage))
+	L.PreloadModule("cache", handler.CacheLoader(ctx, h.caches))
+	L.PreloadModule("trace", handler.TraceLoader(h.tracer))
+	L.PreloadModule("health", handler.HealthLoader(health, h.serviceAvailable))
+	return L
+}
+
+// newState returns a state with all modules that don't depend on the request
+func (h *h) newState() *lua.LState {
+	L := newLuaState()
+	setModulePath(L, filepath.Dir(h.handlerFile))
+	L.PreloadModule("state", handler.StateLoader(h.state))
+	L.PreloadModule("json", handler.JSONLoader)
+	L.PreloadModule("trace", handler.TraceLoader(h.tracer))
+	L.PreloadModule("health", handler.HealthLoader(h.currentHealth, h.serviceAvailable))
+	return L
+}
+
+// bindRequest replaces the modules of L which depend on the request being served,
+// observer is called with the route matched by the router module
+func (h *h) bindRequest(L *lua.LState, res http.ResponseWriter, req *http.Request, observer handler.RouteObserver) {
+	bindModules(L, map[string]lua.LGFunction{
+		"handler":      handler.Loader(req, res),
+		"router":       handler.RouterLoader(req, res, observer),
+		"services":     handler.ServicesLoader(req.Context(), h.availableServers(), h.client),
+		"computations": handler.FakeComputations(req.Context()),
+		"ratelimit":    handler.RateLimitLoader(req, h.limiters),
+		"storage":      handler.StorageLoader(req.Context(), h.storage),
+		"cache":        handler.CacheLoader(req.Context(), h.caches),
+		"queue":        handler.QueueLoader(req.Context(), h.controlEndpoint, nil),
+	})
+}
+
+// availableServers returns a copy of the servers known by this instance
+func (h *h) availableServers() []*control.Server {
+	var servers []*control.Server
+	mutex.Run(h.Shared(), func() {
+		servers = append(servers, h.servers...)
+	})
+	return servers
+}
+
+// setModulePath makes require look for modules in the given directory
+func setModulePath(L *lua.LState, dir string) {
+	pkg := L.GetField(L.Get(lua.EnvironIndex), "package")
+	L.SetField(pkg, "path", lua.LString(filepath.Join(dir, "?.lua")))
 }
 
-func (h *h) newState(res http.ResponseWriter, req *http.Request) *lua.LState {
+func newLuaState() *lua.LState {
 	L := lua.NewState(lua.Options{
 		SkipOpenLibs:        true,
 		RegistryMaxSize:     1_000_000,
@@ -97,15 +424,80 @@ func (h *h) newState(res http.ResponseWriter, req *http.Request) *lua.LState {
 			panic(err)
 		}
 	}
-	L.PreloadModule("handler", handler.Loader(req, res))
+	return L
+}
 
-	var availableServers []*control.Server
-	mutex.Run(h.Shared(), func() {
-		availableServers = append(availableServers, h.servers...)
+func (h *h) countRoute(route string) {
+	mutex.Run(h.routeLock.Exclusive(), func() {
+		h.routes[route]++
 	})
-	L.PreloadModule("services", handler.ServicesLoader(req.Context(), availableServers))
-	L.PreloadModule("computations", handler.FakeComputations(req.Context()))
-	return L
+}
+
+// snapshot returns a copy of the instance data which is safe to send to the control plane
+func (h *h) snapshot() control.Instance {
+	// counters are updated concurrently, so only the fields which never change are copied
+	var i control.Instance
+	i.Name = h.instanceData.Name
+	i.Services = h.instanceData.Services
+	i.Metrics.Requests = atomic.LoadInt64(&h.instanceData.Metrics.Requests)
+	i.Metrics.FaultsInjected = atomic.LoadInt64(&h.instanceData.Metrics.FaultsInjected)
+	i.Metrics.MessagesConsumed = atomic.LoadInt64(&h.instanceData.Metrics.MessagesConsumed)
+	i.Metrics.MessagesFailed = atomic.LoadInt64(&h.instanceData.Metrics.MessagesFailed)
+	i.Metrics.ScriptTimeouts = atomic.LoadInt64(&h.instanceData.Metrics.ScriptTimeouts)
+	i.Metrics.InstructionLimitsExceeded = atomic.LoadInt64(&h.instanceData.Metrics.InstructionLimitsExceeded)
+	prog := h.current()
+	i.ScriptVersion = prog.version
+	i.ScriptError = h.scriptError.Load().(string)
+	i.Metrics.PoolCapacity = int64(prog.capacity())
+	i.Metrics.PoolIdle = int64(prog.idle())
+	i.Metrics.PoolHits = atomic.LoadInt64(&prog.stats.hits)
+	i.Metrics.PoolMisses = atomic.LoadInt64(&prog.stats.misses)
+	i.Breakers = h.client.Breakers.States()
+	admission := h.admission.stats()
+	i.Metrics.Running = admission.Running
+	i.Metrics.QueueDepth = admission.QueueDepth
+	i.Metrics.QueueWaitAvgMs = admission.AvgWaitMs
+	i.Metrics.Shed = admission.Shed
+	storage := h.storage.Stats()
+	i.Metrics.StorageKeys = storage.Keys
+	i.Metrics.StoragePoolSize = storage.PoolSize
+	i.Metrics.StorageInUse = storage.InUse
+	i.Metrics.StorageWaiting = storage.Waiting
+	i.Metrics.StorageLockWaits = storage.LockWaits
+	for name, stats := range h.caches.Stats() {
+		if i.Caches == nil {
+			i.Caches = make(map[string]control.CacheStats)
+		}
+		cs := control.CacheStats{
+			Hits:      stats.Hits,
+			Misses:    stats.Misses,
+			Evictions: stats.Evictions,
+			Entries:   stats.Entries,
+		}
+		if lookups := stats.Hits + stats.Misses; lookups > 0 {
+			cs.HitRatio = float64(stats.Hits) / float64(lookups)
+		}
+		i.Caches[name] = cs
+	}
+	calls := h.client.Stats()
+	i.Metrics.Calls = calls.Calls
+	i.Metrics.CallAttempts = calls.Attempts
+	i.Metrics.Retries = calls.Retries
+	i.Metrics.RetriesDenied = calls.RetriesDenied
+	if calls.Calls > 0 {
+		i.Metrics.RetryAmplification = float64(calls.Attempts) / float64(calls.Calls)
+	}
+	h.requestStats(&i)
+	mutex.Run(h.routeLock.Shared(), func() {
+		if len(h.routes) == 0 {
+			return
+		}
+		i.Metrics.Routes = make(map[string]int64, len(h.routes))
+		for k, v := range h.routes {
+			i.Metrics.Routes[k] = v
+		}
+	})
+	return i
 }
 
 func (h *h) String() string {
@@ -113,14 +505,31 @@ func (h *h) String() string {
 }
 
 func (h *h) registration(ctx context.Context) {
+	defer close(h.registrationDone)
 	if h.controlEndpoint == "" {
 		return
 	}
 	runtime.Gosched()
 	sampled := logutil.Acquire(ctx) //.Sample(zerolog.Sometimes)
-	tick := time.NewTicker(time.Second * 5)
+	tick := time.NewTicker(h.heartbeatInterval)
+	registered := false
 	for {
-		err := control.Register(ctx, h.controlEndpoint, h.service, h.publicEndpoint)
+		server := control.Server{
+			Service:  h.service,
+			Endpoint: h.publicEndpoint,
+			Weight:   h.weight,
+		}
+		var err error
+		// peers should not send requests to an instance which is not ready
+		if ready, _ := h.health.Ready(h.serviceAvailable); ready {
+			if err = control.RegisterServer(ctx, h.controlEndpoint, server); err == nil {
+				registered = true
+			}
+		} else if registered {
+			if err = control.DeregisterServer(ctx, h.controlEndpoint, server); err == nil {
+				registered = false
+			}
+		}
 		if err != nil {
 			sampled.Error().
 				Str("control", h.controlEndpoint).
@@ -130,7 +539,7 @@ func (h *h) registration(ctx context.Context) {
 				Err(err).
 				Msg("Unable to register")
 		}
-		err = control.RegisterInstance(ctx, h.controlEndpoint, h.instanceData)
+		err = control.RegisterInstance(ctx, h.controlEndpoint, h.heartbeat())
 		if err != nil {
 			sampled.Error().
 				Str("control", h.controlEndpoint).
@@ -141,7 +550,7 @@ func (h *h) registration(ctx context.Context) {
 				Msg("Unable to register instance")
 		}
 
-		servers, err := control.Services(ctx, h.controlEndpoint)
+		registry, err := control.FetchRegistry(ctx, h.controlEndpoint)
 		if err != nil {
 			sampled.Error().
 				Str("control", h.controlEndpoint).
@@ -151,8 +560,11 @@ func (h *h) registration(ctx context.Context) {
 				Err(err).
 				Msg("Unable to register")
 		} else {
+			h.setFaults(registry.Faults)
+			servers := registry.Servers
 			for i, v := range servers {
-				if v.Endpoint == h.publicEndpoint {
+				// suspect servers stopped sending heartbeats, so they might be gone
+				if v.Endpoint == h.publicEndpoint || !v.Healthy() {
 					servers[i] = nil
 				}
 			}
@@ -173,6 +585,8 @@ func (h *h) registration(ctx context.Context) {
 		case <-tick.C:
 		case <-ctx.Done():
 			return
+		case <-h.draining:
+			return
 		}
 	}
 }
@@ -1,14 +1,29 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/andrebq/learn-system-design/control"
+	bindings "github.com/andrebq/learn-system-design/internal/bindings/handler"
+	"github.com/andrebq/learn-system-design/internal/cmdutil"
 	"github.com/andrebq/learn-system-design/internal/logutil"
+	"github.com/andrebq/learn-system-design/internal/metrics"
+	"github.com/andrebq/learn-system-design/internal/mutex"
+	"github.com/andrebq/learn-system-design/internal/randdist"
 	"github.com/rs/zerolog"
 	"github.com/steinfletcher/apitest"
+	lua "github.com/yuin/gopher-lua"
 )
 
 func TestHandler(t *testing.T) {
@@ -21,3 +36,1292 @@ func TestHandler(t *testing.T) {
 	}
 	apitest.Handler(h).Debug().Put("/data.json").Body(`{"salute":"World"}`).Expect(t).Status(http.StatusOK).End()
 }
+
+func TestHandlerInitState(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	initFile := filepath.Join("testdata", "fixture", "stateful-handler", "init.lua")
+	handlerFile := filepath.Join("testdata", "fixture", "stateful-handler", "handler.lua")
+	h, err := NewHandler(ctx, initFile, handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(h).Get("/").Expect(t).Status(http.StatusOK).Body("hello 11 3").End()
+	apitest.Handler(h).Get("/").Expect(t).Status(http.StatusOK).Body("hello 12 3").End()
+}
+
+func BenchmarkHandler(b *testing.B) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	handlerFile := filepath.Join("testdata", "fixture", "test-handler", "handler.lua")
+	for _, bc := range []struct {
+		name     string
+		poolSize int
+	}{
+		{name: "unpooled", poolSize: 0},
+		{name: "pooled", poolSize: DefaultPoolSize},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			h, err := NewHandler(ctx, "", handlerFile, "", "", "", WithPoolSize(bc.poolSize))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rec := httptest.NewRecorder()
+					h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+					if rec.Code != http.StatusOK {
+						b.Fatalf("unexpected status %v", rec.Code)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestHandlerReload(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	dir := t.TempDir()
+	handlerFile := filepath.Join(dir, "handler.lua")
+	writeScript := func(code string) {
+		if err := os.WriteFile(handlerFile, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeScript(`require("handler").writeBody(require("greeting"))`)
+	if err := os.WriteFile(filepath.Join(dir, "greeting.lua"), []byte(`return "v1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).Body("v1").End()
+
+	writeScript(`require("handler").writeBody("v2")`)
+	if err := handler.(*h).reload(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).Body("v2").End()
+
+	writeScript(`require("handler").writeBody(`)
+	if err := handler.(*h).reload(ctx, false); err == nil {
+		t.Fatal("reload should fail with invalid code")
+	}
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).Body("v2").End()
+	if v := handler.(*h).current().version; v != 2 {
+		t.Fatalf("expecting version 2 got %v", v)
+	}
+}
+
+func TestHandlerRequestInspection(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	handlerFile := filepath.Join("testdata", "fixture", "inspect-handler", "handler.lua")
+	h, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(h).Post("/users").
+		Query("name", "world").
+		Header("X-Salute", "hello").
+		Cookie("session", "abc").
+		Body("the body").
+		Expect(t).Status(http.StatusOK).Body("POST /users world hello abc the body").End()
+	apitest.Handler(h).Post("/users").
+		Query("limit", "3").
+		Body("the body").
+		Expect(t).Status(http.StatusRequestEntityTooLarge).End()
+}
+
+func TestHandlerJSON(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	handlerFile := filepath.Join("testdata", "fixture", "json-handler", "handler.lua")
+	h, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(h).Post("/").Body(`{"salute":"World","tags":[],"missing":null}`).
+		Expect(t).
+		Status(http.StatusOK).
+		Header("Content-Type", "application/json; charset=utf-8").
+		Body(`{"empty":[],"greeting":"Hello World","missing":true,"roundtrip":[1,2,{"a":true}],"tags":[]}`).
+		End()
+	apitest.Handler(h).Post("/").Body(`{"salute":`).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestHandlerRouter(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	handlerFile := filepath.Join("testdata", "fixture", "router-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(handler).Get("/users/42").Expect(t).Status(http.StatusOK).Header("X-Middleware", "called").Body("user 42").End()
+	apitest.Handler(handler).Post("/users").Expect(t).Status(http.StatusCreated).Body("created").End()
+	apitest.Handler(handler).Get("/orders").Expect(t).Status(http.StatusNotFound).Body("nothing here").End()
+	apitest.Handler(handler).Delete("/users/42").Expect(t).Status(http.StatusMethodNotAllowed).End()
+
+	routes := handler.(*h).snapshot().Metrics.Routes
+	if routes["GET /users/:id"] != 1 || routes["POST /users"] != 1 || routes["404"] != 1 || routes["405"] != 1 {
+		t.Fatalf("unexpected route counts: %v", routes)
+	}
+}
+
+func TestHandlerServicesCall(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Salute"))
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("from backend"))
+	}))
+	defer backend.Close()
+
+	large := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), bindings.MaxBodySize+1))
+	}))
+	defer large.Close()
+
+	handlerFile := filepath.Join("testdata", "fixture", "services-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*h).servers = []*control.Server{{Service: "backend", Endpoint: backend.URL}, {Service: "large", Endpoint: large.URL}}
+
+	apitest.Handler(handler).Get("/").Query("service", "backend").
+		Expect(t).Status(http.StatusOK).
+		Body(`{"body":"from backend","header":"GET /users/1 hello","status":202}`).End()
+	apitest.Handler(handler).Get("/").Query("service", "database").
+		Expect(t).Status(http.StatusBadGateway).
+		Body(`{"code":"no_server","message":"no_server: unable to find any server that implements service database"}`).End()
+	// responses are not truncated silently
+	apitest.Handler(handler).Get("/").Query("service", "large").
+		Expect(t).Status(http.StatusBadGateway).
+		Body(`{"code":"response_too_large","message":"response_too_large: response body from large is larger than 1048576 bytes"}`).End()
+}
+
+func TestHandlerBalancer(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	var servers []*control.Server
+	for _, name := range []string{"a", "b"} {
+		name := name
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer backend.Close()
+		servers = append(servers, &control.Server{Service: "backend", Endpoint: backend.URL})
+	}
+	servers[0].Weight = 3
+
+	handlerFile := filepath.Join("testdata", "fixture", "balancer-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*h).servers = servers
+
+	call := func(balancer, key string) string {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/?balancer="+balancer+"&key="+key, nil).WithContext(ctx)
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %v: %v", rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+	count := func(balancer, key string, n int) map[string]int {
+		hits := map[string]int{}
+		for i := 0; i < n; i++ {
+			hits[call(balancer, key)]++
+		}
+		return hits
+	}
+
+	if hits := count("round_robin", "", 10); hits["a"] != 5 || hits["b"] != 5 {
+		t.Errorf("round robin should split calls evenly, got %v", hits)
+	}
+	if hits := count("weighted_round_robin", "", 8); hits["a"] != 6 || hits["b"] != 2 {
+		t.Errorf("weighted round robin should respect weights, got %v", hits)
+	}
+	if hits := count("consistent_hash", "user-1", 10); len(hits) != 1 {
+		t.Errorf("consistent hash should always pick the same server, got %v", hits)
+	}
+	if hits := count("p2c", "", 10); hits["a"]+hits["b"] != 10 {
+		t.Errorf("p2c should pick a server for every call, got %v", hits)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/?balancer=invalid", nil).WithContext(ctx))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("invalid balancer should fail the request, got %v", rec.Code)
+	}
+
+	// calls stuck on one server must send new calls to the idle one
+	var arrived int32
+	release := make(chan struct{})
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&arrived, 1) <= 2 {
+			<-release
+		}
+		w.Write([]byte("blocked"))
+	}))
+	defer blocked.Close()
+	defer close(release)
+	idle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("idle"))
+	}))
+	defer idle.Close()
+	setServers := func(servers ...*control.Server) {
+		mutex.Run(handler.(*h).Exclusive(), func() {
+			handler.(*h).servers = servers
+		})
+	}
+	setServers(&control.Server{Service: "backend", Endpoint: blocked.URL})
+	for i := 0; i < 2; i++ {
+		go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?balancer=round_robin", nil).WithContext(ctx))
+	}
+	for atomic.LoadInt32(&arrived) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	setServers(&control.Server{Service: "backend", Endpoint: blocked.URL}, &control.Server{Service: "backend", Endpoint: idle.URL})
+	for _, balancer := range []string{"least_outstanding", "p2c"} {
+		if hits := count(balancer, "", 10); hits["idle"] != 10 {
+			t.Errorf("%v should avoid the server with calls in flight, got %v", balancer, hits)
+		}
+	}
+}
+
+func TestHandlerRetries(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	handlerFile := filepath.Join("testdata", "fixture", "retry-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*h).servers = []*control.Server{
+		{Service: "backend", Endpoint: failing.URL},
+		{Service: "backend", Endpoint: healthy.URL},
+	}
+	for i := 0; i < 10; i++ {
+		apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).End()
+	}
+	metrics := handler.(*h).snapshot().Metrics
+	if metrics.Calls != 10 || metrics.Retries != 5 || metrics.CallAttempts != 15 {
+		t.Fatalf("retries should avoid the failing endpoint, got %v calls, %v attempts and %v retries", metrics.Calls, metrics.CallAttempts, metrics.Retries)
+	}
+
+	budgetFile := filepath.Join("testdata", "fixture", "retry-handler", "budget.lua")
+	handler, err = NewHandler(ctx, budgetFile, handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*h).servers = []*control.Server{{Service: "backend", Endpoint: failing.URL}}
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusServiceUnavailable).Body("2").End()
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusServiceUnavailable).Body("1").End()
+	metrics = handler.(*h).snapshot().Metrics
+	if metrics.Retries != 1 || metrics.RetriesDenied != 2 {
+		t.Fatalf("retry budget should limit retries, got %v retries and %v denied", metrics.Retries, metrics.RetriesDenied)
+	}
+}
+
+func TestHandlerCircuitBreaker(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	initFile := filepath.Join("testdata", "fixture", "services-handler", "breaker.lua")
+	handlerFile := filepath.Join("testdata", "fixture", "services-handler", "handler.lua")
+	handler, err := NewHandler(ctx, initFile, handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*h).servers = []*control.Server{{Service: "backend", Endpoint: backend.URL}}
+
+	for i := 0; i < 2; i++ {
+		apitest.Handler(handler).Get("/").Query("service", "backend").
+			Expect(t).Status(http.StatusOK).End()
+	}
+	apitest.Handler(handler).Get("/").Query("service", "backend").
+		Expect(t).Status(http.StatusBadGateway).
+		Body(`{"code":"circuit_open","message":"circuit_open: circuit breaker for service backend is open"}`).End()
+	if calls != 2 {
+		t.Fatalf("open breaker should not call the backend, got %v calls", calls)
+	}
+	if state := handler.(*h).snapshot().Breakers["backend"]; state != "open" {
+		t.Fatalf("breaker should be open, got %v", state)
+	}
+}
+
+func TestHandlerCircuitBreakerCancel(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			// callers give up before the backend answers
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	initFile := filepath.Join("testdata", "fixture", "services-handler", "breaker.lua")
+	handlerFile := filepath.Join("testdata", "fixture", "services-handler", "handler.lua")
+	handler, err := NewHandler(ctx, initFile, handlerFile, "", "", "", WithLimits(Limits{Timeout: 100 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*h).servers = []*control.Server{{Service: "backend", Endpoint: backend.URL}}
+
+	for i := 0; i < 2; i++ {
+		apitest.Handler(handler).Get("/").Query("service", "backend").
+			Expect(t).Status(http.StatusGatewayTimeout).End()
+	}
+	apitest.Handler(handler).Get("/").Query("service", "backend").
+		Expect(t).Status(http.StatusOK).End()
+	if state := handler.(*h).snapshot().Breakers["backend"]; state != "closed" {
+		t.Fatalf("calls cancelled by the caller should not open the breaker, got %v", state)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	a, err := newAdmission(AdmissionConfig{MaxConcurrency: 1, QueueSize: 1, QueueTimeout: time.Minute, ShedStatus: http.StatusTooManyRequests})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := a.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan error)
+	go func() {
+		release, err := a.acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	for a.stats().QueueDepth != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := a.acquire(context.Background()); err != errShed {
+		t.Fatalf("request should be shed when the queue is full, got %v", err)
+	}
+	release()
+	if err := <-queued; err != nil {
+		t.Fatalf("queued request should be admitted, got %v", err)
+	}
+	if stats := a.stats(); stats.Shed != 1 || stats.Running != 0 || stats.QueueDepth != 0 {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+
+	rec := httptest.NewRecorder()
+	a.reject(rec)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("unexpected rejection %v with retry-after %v", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestAdmissionCoDelBurst(t *testing.T) {
+	a, err := newAdmission(AdmissionConfig{MaxConcurrency: 1, QueueSize: 3, QueueTimeout: time.Minute, Policy: QueueCoDel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an idle queue is not overloaded, no matter for how long it was idle
+	time.Sleep(2 * codelInterval)
+	release, err := a.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			release, err := a.acquire(context.Background())
+			if err == nil {
+				release()
+			}
+			queued <- err
+		}()
+	}
+	for a.stats().QueueDepth != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(2 * codelTarget)
+	release()
+	for i := 0; i < 3; i++ {
+		if err := <-queued; err != nil {
+			t.Fatalf("burst after an idle period should not be shed, got %v", err)
+		}
+	}
+	if stats := a.stats(); stats.Shed != 0 {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	initFile := filepath.Join("testdata", "fixture", "ratelimit-handler", "init.lua")
+	handlerFile := filepath.Join("testdata", "fixture", "ratelimit-handler", "handler.lua")
+	h, err := NewHandler(ctx, initFile, handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := func(addr string) apitest.Intercept {
+		return func(r *http.Request) { r.RemoteAddr = addr }
+	}
+	// the window starts at the first request, so it resets after a full period
+	apitest.Handler(h).Intercept(from("10.0.0.1:5000")).Get("/").Header("X-Api-Key", "a").Expect(t).
+		Status(http.StatusOK).Header("RateLimit-Limit", "2").Header("RateLimit-Remaining", "1").Header("RateLimit-Reset", "60").Body("1 2").End()
+	apitest.Handler(h).Intercept(from("10.0.0.1:5000")).Get("/").Header("X-Api-Key", "a").Expect(t).
+		Status(http.StatusOK).Header("RateLimit-Remaining", "0").Body("0 1").End()
+	apitest.Handler(h).Intercept(from("10.0.0.1:5000")).Get("/").Header("X-Api-Key", "a").Expect(t).
+		Status(http.StatusTooManyRequests).HeaderPresent("Retry-After").End()
+	// other keys have their own quota, but share the same client address,
+	// which cannot be changed with X-Forwarded-For unless the proxy is trusted
+	apitest.Handler(h).Intercept(from("10.0.0.1:5001")).Get("/").Header("X-Api-Key", "b").Header("X-Forwarded-For", "192.0.2.7").Expect(t).
+		Status(http.StatusOK).Body("1 0").End()
+
+	proxied, err := NewHandler(ctx, initFile, handlerFile, "", "", "", WithTrustedProxies([]string{"10.0.0.0/8"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(proxied).Intercept(from("10.0.0.1:5000")).Get("/").Header("X-Api-Key", "a").Header("X-Forwarded-For", "192.0.2.7").Expect(t).
+		Status(http.StatusOK).Body("1 2").End()
+	apitest.Handler(proxied).Intercept(from("10.0.0.1:5000")).Get("/").Header("X-Api-Key", "b").Header("X-Forwarded-For", "192.0.2.8").Expect(t).
+		Status(http.StatusOK).Body("1 2").End()
+	// clients can prepend any address, only the one added by the trusted proxy is used
+	apitest.Handler(proxied).Intercept(from("10.0.0.1:5000")).Get("/").Header("X-Api-Key", "c").Header("X-Forwarded-For", "192.0.2.8, 192.0.2.7").Expect(t).
+		Status(http.StatusOK).Body("1 1").End()
+
+	// costs which the limiter could never allow are rejected instead of failing forever
+	for _, cost := range []string{"0", "-1", "3"} {
+		apitest.Handler(h).Intercept(from("10.0.0.2:5000")).Get("/").Query("cost", cost).Expect(t).
+			Status(http.StatusBadRequest).Body("invalid cost").End()
+	}
+	apitest.Handler(h).Intercept(from("10.0.0.2:5000")).Get("/").Query("cost", "2").Expect(t).
+		Status(http.StatusOK).Body("true").End()
+
+	if _, err := NewHandler(ctx, initFile, handlerFile, "", "", "", WithTrustedProxies([]string{"proxy"})); err == nil {
+		t.Fatal("invalid trusted proxies should be rejected")
+	}
+}
+
+func TestHandlerFaults(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	controlPlane := httptest.NewServer(control.Handler())
+	defer controlPlane.Close()
+
+	handlerFile := filepath.Join("testdata", "fixture", "test-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "instance-a", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	injectFaults := func(faults ...string) {
+		for _, f := range faults {
+			res, err := http.Post(controlPlane.URL+"/faults", "application/json", strings.NewReader(f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusCreated {
+				t.Fatalf("unable to create fault %v, status %v", f, res.Status)
+			}
+		}
+		registry, err := control.FetchRegistry(ctx, controlPlane.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.(*h).setFaults(registry.Faults)
+	}
+
+	injectFaults(`{"kind":"error","status":503,"instance":"instance-b"}`)
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).End()
+
+	injectFaults(`{"kind":"latency","service":"test-handler","latencyMs":{"kind":"fixed","mean":50}}`)
+	start := time.Now()
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).End()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("latency fault should delay the request, took %v", elapsed)
+	}
+
+	// a rate of zero disables the fault, it does not mean every request
+	injectFaults(`{"kind":"error","status":503,"instance":"instance-a","rate":0}`)
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).End()
+
+	injectFaults(`{"kind":"error","status":503,"instance":"instance-a","rate":1}`)
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusServiceUnavailable).End()
+	if injected := handler.(*h).snapshot().Metrics.FaultsInjected; injected != 4 {
+		t.Errorf("expecting 4 faults injected got %v", injected)
+	}
+
+	apitest.Handler(control.Handler()).Post("/faults").Body(`{"kind":"explode"}`).Expect(t).Status(http.StatusBadRequest).End()
+	apitest.Handler(control.Handler()).Post("/actions/create-fault").FormData("kind", "drop").FormData("rate", "half").
+		Expect(t).Status(http.StatusBadRequest).End()
+	apitest.Handler(control.Handler()).Post("/actions/create-fault").FormData("kind", "drop").FormData("rate", "").
+		Expect(t).Status(http.StatusSeeOther).End()
+}
+
+func TestHandlerComputations(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	handlerFile := filepath.Join("testdata", "fixture", "computations-handler", "handler.lua")
+	h, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	apitest.Handler(h).Get("/").Expect(t).Status(http.StatusOK).Body("true").End()
+	// fractional seconds must not be truncated by computations.slow
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("computations should take at least 30ms, took %v", elapsed)
+	}
+}
+
+func TestHandlerStorage(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	initFile := filepath.Join("testdata", "fixture", "storage-handler", "init.lua")
+	handlerFile := filepath.Join("testdata", "fixture", "storage-handler", "handler.lua")
+	handler, err := NewHandler(ctx, initFile, handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(handler).Get("/").Query("op", "crud").Expect(t).Status(http.StatusOK).
+		Body(`{"deleted":true,"order":11,"stale":false,"swapped":true,"user":"a","users":2}`).End()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/?op=incr", nil).WithContext(ctx))
+			if rec.Code != http.StatusOK {
+				t.Errorf("unexpected status %v: %v", rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if stats := handler.(*h).storage.Stats(); stats.LockWaits == 0 {
+		t.Errorf("concurrent increments should wait for the row lock")
+	}
+	apitest.Handler(handler).Get("/").Query("op", "incr").Expect(t).Status(http.StatusOK).Body("11").End()
+
+	// with a single slow connection, concurrent requests time out waiting for the pool
+	cfg := bindings.DefaultStorageConfig()
+	cfg.PoolSize = 1
+	cfg.PoolTimeout = 10 * time.Millisecond
+	cfg.Latency[bindings.StorageGet] = randdist.Distribution{Kind: randdist.Fixed, Mean: 0.1}
+	handler.(*h).storage.Configure(cfg)
+	var timeouts int64
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+			if rec.Code == http.StatusServiceUnavailable {
+				atomic.AddInt64(&timeouts, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if timeouts != 2 {
+		t.Errorf("expecting 2 requests to time out waiting for a connection, got %v", timeouts)
+	}
+}
+
+func TestHandlerCache(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	var lock sync.Mutex
+	calls := map[string]int{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls[r.URL.Path]++
+		lock.Unlock()
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+	}))
+	defer backend.Close()
+	backendCalls := func(path string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return calls[path]
+	}
+
+	handlerFile := filepath.Join("testdata", "fixture", "cache-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*h).servers = []*control.Server{{Service: "backend", Endpoint: backend.URL}}
+	get := func(cache, key, body string) {
+		apitest.Handler(handler).Get("/").Query("cache", cache).Query("key", key).
+			Expect(t).Status(http.StatusOK).Body(body).End()
+	}
+
+	get("users", "a", "a")
+	get("users", "a", "a")
+	get("users", "missing", "nil")
+	get("users", "missing", "nil")
+	if backendCalls("/a") != 1 || backendCalls("/missing") != 1 {
+		t.Errorf("hits and negative entries should not call the backend, got %v", calls)
+	}
+	// a is more recent than missing, so missing is evicted
+	get("users", "a", "a")
+	get("users", "b", "b")
+	get("users", "missing", "nil")
+	if backendCalls("/a") != 1 || backendCalls("/missing") != 2 {
+		t.Errorf("least recently used entry should be evicted, got %v", calls)
+	}
+	stats := handler.(*h).snapshot().Caches["users"]
+	if stats.Hits != 3 || stats.Misses != 4 || stats.Evictions != 2 || stats.Entries != 2 {
+		t.Errorf("unexpected cache stats %#v", stats)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/?cache=coalesced&key=slow", nil).WithContext(ctx))
+			if rec.Body.String() != "slow" {
+				t.Errorf("unexpected response %v", rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if backendCalls("/slow") != 1 {
+		t.Errorf("coalesced loads should call the backend once, got %v", backendCalls("/slow"))
+	}
+
+	// hot is used more often than recent, so recent is evicted
+	get("popular", "hot", "hot")
+	get("popular", "hot", "hot")
+	get("popular", "hot", "hot")
+	get("popular", "recent", "recent")
+	get("popular", "new", "new")
+	get("popular", "hot", "hot")
+	get("popular", "recent", "recent")
+	if backendCalls("/hot") != 1 || backendCalls("/recent") != 2 {
+		t.Errorf("least frequently used entry should be evicted, got %v", calls)
+	}
+
+	// early expires before late, even if it was used more recently
+	withTTL := func(key, ttl string) {
+		apitest.Handler(handler).Get("/").Query("cache", "expiring").Query("key", key).Query("ttl", ttl).
+			Expect(t).Status(http.StatusOK).Body(key).End()
+	}
+	withTTL("late", "60")
+	withTTL("early", "30")
+	withTTL("third", "60")
+	withTTL("late", "60")
+	withTTL("early", "30")
+	if backendCalls("/late") != 1 || backendCalls("/early") != 2 {
+		t.Errorf("entry which expires first should be evicted, got %v", calls)
+	}
+
+	missing := backendCalls("/missing")
+	get("short", "fresh", "fresh")
+	get("short", "missing", "nil")
+	get("short", "fresh", "fresh")
+	get("short", "missing", "nil")
+	if backendCalls("/fresh") != 1 || backendCalls("/missing") != missing+1 {
+		t.Errorf("entries should be cached until they expire, got %v", calls)
+	}
+	time.Sleep(100 * time.Millisecond)
+	get("short", "fresh", "fresh")
+	get("short", "missing", "nil")
+	if backendCalls("/fresh") != 2 || backendCalls("/missing") != missing+2 {
+		t.Errorf("entries should be loaded again once ttl and negativeTtl expire, got %v", calls)
+	}
+}
+
+func TestHandlerQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(logutil.WithLogger(context.Background(), zerolog.Nop()))
+	defer cancel()
+	controlPlane := httptest.NewServer(control.Handler())
+	defer controlPlane.Close()
+
+	initFile := filepath.Join("testdata", "fixture", "queue-handler", "init.lua")
+	handlerFile := filepath.Join("testdata", "fixture", "queue-handler", "handler.lua")
+	handler, err := NewHandler(ctx, initFile, handlerFile, "", "", controlPlane.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(handler).Get("/").Query("op", "publish").Query("id", "1").Expect(t).Status(http.StatusOK).End()
+	apitest.Handler(handler).Get("/").Query("op", "publish").Query("id", "2").Query("fail", "true").Expect(t).Status(http.StatusOK).End()
+
+	dir := t.TempDir()
+	invalidInit := filepath.Join(dir, "init.lua")
+	if err := os.WriteFile(invalidInit, []byte(`require("queue").subscribe("orders", function() end, { visibilityTimeout = 0 })`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHandler(ctx, invalidInit, handlerFile, "", "", controlPlane.URL); err == nil {
+		t.Fatal("subscriptions without a positive visibility timeout should be rejected")
+	}
+
+	// the failed message is delivered twice before going to the dead-letter topic
+	expected := "1 2@orders.dlq"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		if rec.Body.String() == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expecting %q got %q", expected, rec.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := handler.(*h).snapshot().Metrics; m.MessagesConsumed != 2 || m.MessagesFailed != 2 {
+		t.Errorf("expecting 2 messages consumed and 2 failed, got %v and %v", m.MessagesConsumed, m.MessagesFailed)
+	}
+}
+
+func TestHandlerFanOut(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	delay := 200 * time.Millisecond
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	handlerFile := filepath.Join("testdata", "fixture", "fanout-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*h).servers = []*control.Server{
+		{Service: "slow", Endpoint: slow.URL},
+		{Service: "fast", Endpoint: fast.URL},
+	}
+
+	start := time.Now()
+	apitest.Handler(handler).Get("/").Query("mode", "await").Expect(t).Status(http.StatusOK).Body("a,").End()
+	if elapsed := time.Since(start); elapsed >= 2*delay {
+		t.Errorf("calls should run in parallel, took %v", elapsed)
+	}
+	apitest.Handler(handler).Get("/").Query("mode", "any").Expect(t).Status(http.StatusOK).Body("2:fast:true").End()
+	apitest.Handler(handler).Get("/").Query("mode", "all").Expect(t).Status(http.StatusOK).Body("1,no_server,fast").End()
+
+	// awaiting stops once the request is cancelled, even if the calls are still running
+	reqCtx, cancel := context.WithTimeout(ctx, delay/4)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	start = time.Now()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/?mode=await", nil).WithContext(reqCtx))
+	if rec.Code == http.StatusOK {
+		t.Errorf("cancelled request should fail, got %v: %v", rec.Code, rec.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("await should respect the request context, took %v", elapsed)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	sb := newSandbox(context.Background(), Limits{Instructions: 1000})
+	defer sb.release()
+	L := lua.NewState()
+	defer L.Close()
+	sb.attach(L)
+
+	// Go functions waiting on the context (eg.: calls to other services) don't use the budget
+	for i := 0; i < 10_000; i++ {
+		bindings.Context(L).Done()
+	}
+	if err := L.DoString(`local x = 0 for i = 1, 10 do x = x + i end`); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.limitErr(); err != nil {
+		t.Fatalf("script should fit in its budget, got %v", err)
+	}
+	if err := L.DoString(`while true do end`); err == nil {
+		t.Fatal("script should be stopped")
+	}
+	if _, ok := sb.limitErr().(*InstructionLimitError); !ok {
+		t.Fatalf("expecting an instruction limit error, got %v", sb.limitErr())
+	}
+}
+
+func TestHandlerLimits(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	handlerFile := filepath.Join("testdata", "fixture", "limits-handler", "handler.lua")
+	for _, tc := range []struct {
+		name   string
+		limits Limits
+		mode   string
+		status int
+		metric func(m *h) int64
+	}{
+		{"timeout", Limits{Timeout: 50 * time.Millisecond}, "loop", http.StatusGatewayTimeout, func(m *h) int64 { return m.snapshot().Metrics.ScriptTimeouts }},
+		{"instructions", Limits{Instructions: 100_000}, "loop", http.StatusInternalServerError, func(m *h) int64 { return m.snapshot().Metrics.InstructionLimitsExceeded }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, err := NewHandler(ctx, "", handlerFile, "", "", "", WithLimits(tc.limits))
+			if err != nil {
+				t.Fatal(err)
+			}
+			apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).Body("done").End()
+			apitest.Handler(handler).Get("/").Query("mode", tc.mode).Expect(t).Status(tc.status).End()
+			if n := tc.metric(handler.(*h)); n != 1 {
+				t.Errorf("expecting the limit to be counted once, got %v", n)
+			}
+		})
+	}
+}
+
+func TestHandlerDeadline(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	handlerFile := filepath.Join("testdata", "fixture", "deadline-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendDone := make(chan time.Duration, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler.ServeHTTP(w, r)
+		backendDone <- time.Since(start)
+	}))
+	defer backend.Close()
+	handler.(*h).servers = []*control.Server{{Service: "backend", Endpoint: backend.URL}}
+
+	// the backend receives the remaining time of the frontend call and stops working
+	// once the frontend gives up
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/?mode=front", nil))
+	var front struct {
+		Side   string `json:"side"`
+		Code   string `json:"code"`
+		Status int    `json:"status"`
+		Body   string `json:"body"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &front); err != nil || rec.Code != http.StatusBadGateway {
+		t.Fatalf("unexpected response %v %v", rec.Code, rec.Body.String())
+	}
+	switch front.Side {
+	case "client":
+		if front.Code != "timeout" {
+			t.Errorf("the call should fail with a timeout, got %#v", front)
+		}
+	case "backend":
+		if front.Status != http.StatusGatewayTimeout || front.Body != "handler: deadline sent by the caller exceeded\n" {
+			t.Errorf("the backend should stop at the deadline sent by the client, got %#v", front)
+		}
+	default:
+		t.Errorf("unexpected response %#v", front)
+	}
+	if elapsed := <-backendDone; elapsed > 500*time.Millisecond {
+		t.Errorf("backend should stop once the deadline of the frontend is exceeded, took %v", elapsed)
+	}
+
+	// an incoming deadline also cancels work which is already in progress
+	start := time.Now()
+	apitest.Handler(handler).Get("/").Header(bindings.DeadlineHeader, "600").
+		Expect(t).Status(http.StatusGatewayTimeout).End()
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("request should stop at the deadline sent by the caller, took %v", elapsed)
+	}
+	apitest.Handler(handler).Get("/").Header(bindings.DeadlineHeader, "-5").
+		Expect(t).Status(http.StatusGatewayTimeout).End()
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).Body("done").End()
+}
+
+type collectedSpan struct {
+	Service      string
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+}
+
+// collector is a stand-in for an OTLP/HTTP receiver
+type collector struct {
+	sync.Mutex
+	spans []collectedSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string `json:"key"`
+					Value struct {
+						StringValue string `json:"stringValue"`
+					} `json:"value"`
+				} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []collectedSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				s.Service = rs.Resource.Attributes[0].Value.StringValue
+				c.spans = append(c.spans, s)
+			}
+		}
+	}
+}
+
+func (c *collector) collected() []collectedSpan {
+	c.Lock()
+	defer c.Unlock()
+	return append([]collectedSpan(nil), c.spans...)
+}
+
+// find returns the first span which matches fn
+func find(spans []collectedSpan, fn func(collectedSpan) bool) collectedSpan {
+	for _, s := range spans {
+		if fn(s) {
+			return s
+		}
+	}
+	return collectedSpan{}
+}
+
+func TestHandlerTracing(t *testing.T) {
+	ctx, cancel := context.WithCancel(logutil.WithLogger(context.Background(), zerolog.Nop()))
+	defer cancel()
+	spans := &collector{}
+	otlp := httptest.NewServer(spans)
+	defer otlp.Close()
+
+	handlerFile := filepath.Join("testdata", "fixture", "trace-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "", WithTracing(otlp.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*h).Close(ctx)
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	handler.(*h).servers = []*control.Server{{Service: "backend", Endpoint: backend.URL}}
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	apitest.Handler(handler).Get("/").Header("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01").
+		Expect(t).Status(http.StatusOK).Body(traceID + " " + traceID).End()
+
+	var collected []collectedSpan
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		collected = spans.collected()
+		if len(collected) == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expecting 4 spans got %v", collected)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, s := range collected {
+		if s.TraceID != traceID || s.Service != "trace-handler" {
+			t.Errorf("span %v should be part of the trace sent by the caller, got %#v", s.Name, s)
+		}
+	}
+	server := find(collected, func(s collectedSpan) bool { return s.ParentSpanID == "00f067aa0ba902b7" })
+	work := find(collected, func(s collectedSpan) bool { return s.Name == "work" })
+	client := find(collected, func(s collectedSpan) bool { return s.Name == "GET backend" })
+	backendSpan := find(collected, func(s collectedSpan) bool { return client.SpanID != "" && s.ParentSpanID == client.SpanID })
+	if server.Name != "GET /" || server.Kind != 2 {
+		t.Errorf("server span should continue the trace of the caller, got %#v", server)
+	}
+	if work.ParentSpanID != server.SpanID || client.ParentSpanID != work.SpanID || client.Kind != 3 {
+		t.Errorf("calls made inside trace.span should be children of it, got %#v and %#v", work, client)
+	}
+	if backendSpan.Kind != 2 {
+		t.Errorf("server span of the backend should be a child of the client span, got %v", collected)
+	}
+}
+
+func TestHandlerTracingClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(logutil.WithLogger(context.Background(), zerolog.Nop()))
+	spans := &collector{}
+	otlp := httptest.NewServer(spans)
+	defer otlp.Close()
+
+	handlerFile := filepath.Join("testdata", "fixture", "test-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "", WithTracing(otlp.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// requests served while draining happen after the root context is cancelled
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).End()
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelClose()
+	if err := handler.(*h).Close(closeCtx); err != nil {
+		t.Fatal(err)
+	}
+	if collected := spans.collected(); len(collected) != 1 || collected[0].Name != "GET /" {
+		t.Fatalf("spans of requests served while draining should be exported by Close, got %v", collected)
+	}
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+
+	reg := metrics.NewRegistry()
+	handlerFile := filepath.Join("testdata", "fixture", "services-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "", WithMetrics(reg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*h).servers = []*control.Server{{Service: "backend", Endpoint: backend.URL}}
+
+	apitest.Handler(handler).Get("/").Query("service", "backend").Expect(t).Status(http.StatusOK).End()
+	apitest.Handler(handler).Get("/").Query("service", "database").Expect(t).Status(http.StatusBadGateway).End()
+
+	rec := httptest.NewRecorder()
+	metrics.AdminHandler(reg).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Header().Get("Content-Type") != metrics.ContentType {
+		t.Errorf("unexpected content type %v", rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		`lsd_http_requests_total{route="none",status="200"} 1`,
+		`lsd_http_requests_total{route="none",status="502"} 1`,
+		`lsd_http_request_duration_seconds_count{route="none",status="200"} 1`,
+		`lsd_http_requests_in_flight 0`,
+		`lsd_service_call_duration_seconds_count{service="backend",status="202"} 1`,
+		`lsd_service_call_duration_seconds_count{service="database",status="no_server"} 1`,
+		`lsd_requests_received_total 2`,
+		"# EOF",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics should contain %q, got:\n%v", line, body)
+		}
+	}
+
+	i := handler.(*h).snapshot()
+	if i.Statuses["200"] != 1 || i.Statuses["502"] != 1 || i.CallLatencyMs["backend"] <= 0 {
+		t.Errorf("metrics should be sent to the control plane, got %v and %v", i.Statuses, i.CallLatencyMs)
+	}
+}
+
+func TestHandlerWindow(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+
+	handlerFile := filepath.Join("testdata", "fixture", "services-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.(*h).servers = []*control.Server{{Service: "backend", Endpoint: backend.URL}}
+
+	for i := 0; i < 3; i++ {
+		apitest.Handler(handler).Get("/").Query("service", "backend").Expect(t).Status(http.StatusOK).End()
+	}
+	apitest.Handler(handler).Get("/").Query("service", "database").Expect(t).Status(http.StatusBadGateway).End()
+
+	w := handler.(*h).heartbeat().Window
+	if w.Requests != 4 || w.Classes["2xx"] != 3 || w.Classes["5xx"] != 1 || w.ErrorRate != 0.25 || w.RequestRate <= 0 {
+		t.Errorf("unexpected window %#v", w)
+	}
+	if w.Latency.P50Ms <= 0 || w.Latency.P50Ms > w.Latency.P99Ms || w.Latency.P99Ms > w.Latency.MaxMs {
+		t.Errorf("unexpected latency quantiles %#v", w.Latency)
+	}
+	if next := handler.(*h).heartbeat().Window; next.Requests != 0 {
+		t.Errorf("a new window should start after each heartbeat, got %#v", next)
+	}
+
+}
+
+func TestHandlerHealth(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	initFile := filepath.Join("testdata", "fixture", "health-handler", "init.lua")
+	handlerFile := filepath.Join("testdata", "fixture", "health-handler", "handler.lua")
+	handler, err := NewHandler(ctx, initFile, handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(handler).Get("/healthz").Expect(t).Status(http.StatusOK).Body("ok\n").End()
+	apitest.Handler(handler).Get("/readyz").Expect(t).Status(http.StatusServiceUnavailable).Body("warming up\n").End()
+	apitest.Handler(handler).Get("/").Query("warm", "1").Expect(t).Status(http.StatusOK).Body("not ready: no server available for database").End()
+	apitest.Handler(handler).Get("/readyz").Expect(t).Status(http.StatusServiceUnavailable).Body("no server available for database\n").End()
+	handler.(*h).servers = []*control.Server{{Service: "database", Endpoint: "http://database.localhost"}}
+	apitest.Handler(handler).Get("/readyz").Expect(t).Status(http.StatusOK).Body("ready\n").End()
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).Body("ready").End()
+}
+
+func TestHandlerHealthReload(t *testing.T) {
+	ctx := logutil.WithLogger(context.Background(), zerolog.Nop())
+	dir := t.TempDir()
+	initFile := filepath.Join(dir, "init.lua")
+	writeInit := func(code string) {
+		if err := os.WriteFile(initFile, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeInit(`require("health").setReady(false, "warming up")`)
+	handlerFile := filepath.Join(dir, "handler.lua")
+	if err := os.WriteFile(handlerFile, []byte(`require("handler").writeBody("ok")`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewHandler(ctx, initFile, handlerFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(handler).Get("/readyz").Expect(t).Status(http.StatusServiceUnavailable).Body("warming up\n").End()
+
+	writeInit(`require("health").setReady(true) error("boom")`)
+	if err := handler.(*h).reload(ctx, true); err == nil {
+		t.Fatal("reload should fail when the init file fails")
+	}
+	apitest.Handler(handler).Get("/readyz").Expect(t).Status(http.StatusServiceUnavailable).Body("warming up\n").End()
+
+	writeInit(`require("health").setReady(true)`)
+	if err := handler.(*h).reload(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	apitest.Handler(handler).Get("/readyz").Expect(t).Status(http.StatusOK).Body("ready\n").End()
+}
+
+func TestHandlerRegistrationReadiness(t *testing.T) {
+	ctx, cancel := context.WithCancel(logutil.WithLogger(context.Background(), zerolog.Nop()))
+	defer cancel()
+	controlPlane := httptest.NewServer(control.Handler())
+	defer controlPlane.Close()
+	database := control.Server{Service: "database", Endpoint: "http://database.localhost"}
+	if err := control.RegisterServer(ctx, controlPlane.URL, database); err != nil {
+		t.Fatal(err)
+	}
+	registered := func() bool {
+		registry, err := control.FetchRegistry(ctx, controlPlane.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range registry.Servers {
+			if s.Endpoint == "http://health.localhost" {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor := func(expected bool, msg string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for registered() != expected {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	initFile := filepath.Join("testdata", "fixture", "health-handler", "init.lua")
+	handlerFile := filepath.Join("testdata", "fixture", "health-handler", "handler.lua")
+	handler, err := NewHandler(ctx, initFile, handlerFile, "health", "http://health.localhost", controlPlane.URL,
+		func(h *h) { h.heartbeatInterval = 10 * time.Millisecond })
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if registered() {
+		t.Fatal("handler should not register itself before it is ready")
+	}
+	apitest.Handler(handler).Get("/").Query("warm", "1").Expect(t).Status(http.StatusOK).End()
+	waitFor(true, "handler should register itself once it is ready")
+
+	if err := control.DeregisterServer(ctx, controlPlane.URL, database); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(false, "handler should leave the registry once its dependencies are gone")
+}
+
+func TestHandlerDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(logutil.WithLogger(context.Background(), zerolog.Nop()))
+	defer cancel()
+	controlPlane := httptest.NewServer(control.Handler())
+	defer controlPlane.Close()
+
+	handlerFile := filepath.Join("testdata", "fixture", "test-handler", "handler.lua")
+	handler, err := NewHandler(ctx, "", handlerFile, "drained", "http://drained.localhost", controlPlane.URL, WithDrainPeriod(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := func() (servers int, instance bool) {
+		res, err := http.Get(controlPlane.URL + "/registry")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var registry struct {
+			Servers   []*control.Server            `json:"servers"`
+			Instances map[string]*control.Instance `json:"instances"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&registry); err != nil {
+			t.Fatal(err)
+		}
+		return len(registry.Servers), registry.Instances["drained"] != nil
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if servers, instance := registered(); servers == 1 && instance {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("handler should register itself in the control plane")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	handler.(cmdutil.Drainer).Drain(ctx)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("drain should wait for the drain period, took %v", elapsed)
+	}
+	if servers, instance := registered(); servers != 0 || instance {
+		t.Errorf("a drained handler should leave the control plane, got %v servers (instance: %v)", servers, instance)
+	}
+	apitest.Handler(handler).Get("/readyz").Expect(t).Status(http.StatusServiceUnavailable).Body("draining\n").End()
+	// requests which arrive while draining are still served
+	apitest.Handler(handler).Get("/").Expect(t).Status(http.StatusOK).End()
+}
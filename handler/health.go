@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/andrebq/learn-system-design/control"
+	"github.com/andrebq/learn-system-design/internal/bindings/handler"
+	"github.com/andrebq/learn-system-design/internal/logutil"
+)
+
+const (
+	// DefaultDrainPeriod is how long a draining instance keeps serving requests,
+	// it is longer than the interval used by peers to refresh the list of servers
+	DefaultDrainPeriod = 6 * time.Second
+
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
+// WithDrainPeriod changes how long the handler keeps serving requests after
+// it leaves the control plane, so peers can stop sending requests to it
+func WithDrainPeriod(period time.Duration) Option {
+	return func(h *h) {
+		h.drainPeriod = period
+	}
+}
+
+// serveProbe answers health and readiness checks, it returns false
+// for any other request
+func (h *h) serveProbe(w http.ResponseWriter, req *http.Request) bool {
+	switch req.URL.Path {
+	case healthPath:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "ok\n")
+	case readyPath:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		ready, reason := h.health.Ready(h.serviceAvailable)
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, reason+"\n")
+			return true
+		}
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "ready\n")
+	default:
+		return false
+	}
+	return true
+}
+
+// serviceAvailable returns true if at least one server of service is known
+func (h *h) serviceAvailable(service string) bool {
+	for _, s := range h.availableServers() {
+		if s.Service == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Drain stops new requests from reaching the handler: readiness starts to fail,
+// the instance leaves the control plane and Drain waits for the drain period,
+// so peers stop sending requests before the server shuts down.
+func (h *h) Drain(ctx context.Context) {
+	log := logutil.Acquire(ctx)
+	h.health.Drain()
+	h.drainOnce.Do(func() { close(h.draining) })
+	// the registration loop would add the instance back
+	select {
+	case <-h.registrationDone:
+	case <-ctx.Done():
+		return
+	}
+	if h.controlEndpoint != "" {
+		if err := control.DeregisterServer(ctx, h.controlEndpoint, control.Server{Service: h.service, Endpoint: h.publicEndpoint}); err != nil {
+			log.Error().Err(err).Str("control", h.controlEndpoint).Str("service", h.service).Msg("Unable to deregister")
+		}
+		if err := control.DeregisterInstance(ctx, h.controlEndpoint, h.name); err != nil {
+			log.Error().Err(err).Str("control", h.controlEndpoint).Str("name", h.name).Msg("Unable to deregister instance")
+		}
+	}
+	log.Info().Dur("drainPeriod", h.drainPeriod).Msg("Draining requests")
+	select {
+	case <-time.After(h.drainPeriod):
+	case <-ctx.Done():
+	}
+}
+
+// currentHealth returns the readiness of the instance
+func (h *h) currentHealth() *handler.Health {
+	return h.health
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/andrebq/learn-system-design/control"
+	"github.com/andrebq/learn-system-design/internal/bindings/handler"
+	"github.com/andrebq/learn-system-design/internal/metrics"
+)
+
+const (
+	// statusDropped is used as the status of requests which were dropped without an answer
+	statusDropped = 0
+
+	// routeNone is used as the route of requests which were not served by the router module
+	routeNone = "none"
+)
+
+type (
+	// statusWriter records the status code sent to the client
+	statusWriter struct {
+		http.ResponseWriter
+		status int
+	}
+)
+
+// WithMetrics registers the metrics of the handler in r, so they can be exposed
+// by the process, by default a private registry is used
+func WithMetrics(r *metrics.Registry) Option {
+	return func(h *h) {
+		h.metrics = r
+	}
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(buf []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(buf)
+}
+
+// code returns the status sent to the client, handlers which don't write anything answer with 200
+func (s *statusWriter) code() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+func (h *h) initMetrics() {
+	if h.metrics == nil {
+		h.metrics = metrics.NewRegistry()
+	}
+	h.httpMetrics = metrics.NewHTTPMetrics(h.metrics)
+	h.client.CallLatency = h.metrics.Histogram("lsd_service_call_duration_seconds",
+		"Time taken by calls to other services (including retries), by target service and status", metrics.DefaultBuckets, "service", "status")
+	h.metrics.Collect(h.collectMetrics)
+}
+
+// observeRequest records the metrics of a request which finished
+func (h *h) observeRequest(route string, status int, elapsed time.Duration) {
+	if route == "" {
+		route = routeNone
+	}
+	h.httpMetrics.InFlight.Add(-1)
+	h.httpMetrics.Observe(route, status, elapsed)
+	h.window.observe(status, elapsed)
+}
+
+// requestStats summarizes the request metrics for the control plane
+func (h *h) requestStats(i *control.Instance) {
+	i.Metrics.InFlight = int64(h.httpMetrics.InFlight.Value())
+	var count uint64
+	var sum float64
+	h.httpMetrics.Duration.Each(func(labels []string, c uint64, s float64) {
+		count += c
+		sum += s
+		if i.Statuses == nil {
+			i.Statuses = make(map[string]int64)
+		}
+		i.Statuses[labels[1]] += int64(c)
+	})
+	if count > 0 {
+		i.Metrics.LatencyAvgMs = sum / float64(count) * 1000
+	}
+	counts := map[string]uint64{}
+	sums := map[string]float64{}
+	h.client.CallLatency.Each(func(labels []string, c uint64, s float64) {
+		counts[labels[0]] += c
+		sums[labels[0]] += s
+	})
+	for service, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if i.CallLatencyMs == nil {
+			i.CallLatencyMs = make(map[string]float64)
+		}
+		i.CallLatencyMs[service] = sums[service] / float64(c) * 1000
+	}
+}
+
+// collectMetrics exposes the numbers sent to the control plane
+func (h *h) collectMetrics(e *metrics.Emitter) {
+	i := h.snapshot()
+	m := i.Metrics
+	e.Counter("lsd_requests_received", "Requests received, including the ones rejected before running the handler", float64(m.Requests))
+	e.Gauge("lsd_script_version", "Version of the handler script", float64(i.ScriptVersion))
+	e.Gauge("lsd_lua_states", "Lua states kept by the pool", float64(m.PoolIdle), "state", "idle")
+	e.Gauge("lsd_lua_states", "Lua states kept by the pool", float64(m.PoolCapacity), "state", "capacity")
+	e.Counter("lsd_lua_pool_lookups", "Lookups of idle Lua states, misses create a new state", float64(m.PoolHits), "result", "hit")
+	e.Counter("lsd_lua_pool_lookups", "Lookups of idle Lua states, misses create a new state", float64(m.PoolMisses), "result", "miss")
+	e.Gauge("lsd_admission_running", "Requests executing the handler", float64(m.Running))
+	e.Gauge("lsd_admission_queue_depth", "Requests waiting for admission", float64(m.QueueDepth))
+	e.Counter("lsd_admission_shed", "Requests rejected by admission control", float64(m.Shed))
+	e.Counter("lsd_service_calls", "Calls made to other services", float64(m.Calls))
+	e.Counter("lsd_service_call_attempts", "Requests sent to other services, including retries", float64(m.CallAttempts))
+	e.Counter("lsd_service_call_retries_denied", "Retries not sent because the retry budget was exhausted", float64(m.RetriesDenied))
+	for target, state := range i.Breakers {
+		e.Gauge("lsd_circuit_breaker_open", "1 if the circuit breaker of the target is open", boolToFloat(state == handler.BreakerOpen), "target", target)
+	}
+	e.Counter("lsd_faults_injected", "Requests affected by faults injected by the control plane", float64(m.FaultsInjected))
+	e.Counter("lsd_limits_exceeded", "Requests stopped by the sandbox", float64(m.ScriptTimeouts), "limit", "timeout")
+	e.Counter("lsd_limits_exceeded", "Requests stopped by the sandbox", float64(m.InstructionLimitsExceeded), "limit", "instructions")
+	e.Counter("lsd_messages", "Messages delivered to subscribers", float64(m.MessagesConsumed), "result", "consumed")
+	e.Counter("lsd_messages", "Messages delivered to subscribers", float64(m.MessagesFailed), "result", "failed")
+	e.Gauge("lsd_storage_keys", "Keys in the simulated database", float64(m.StorageKeys))
+	e.Gauge("lsd_storage_connections", "Connections of the simulated database", float64(m.StorageInUse), "state", "in_use")
+	e.Gauge("lsd_storage_connections", "Connections of the simulated database", float64(m.StoragePoolSize), "state", "capacity")
+	e.Gauge("lsd_storage_waiting", "Operations waiting for a connection", float64(m.StorageWaiting))
+	e.Counter("lsd_storage_lock_waits", "Operations which waited for a row lock", float64(m.StorageLockWaits))
+	for name, c := range i.Caches {
+		e.Counter("lsd_cache_lookups", "Cache lookups by result", float64(c.Hits), "cache", name, "result", "hit")
+		e.Counter("lsd_cache_lookups", "Cache lookups by result", float64(c.Misses), "cache", name, "result", "miss")
+		e.Counter("lsd_cache_evictions", "Entries evicted to make room for new ones", float64(c.Evictions), "cache", name)
+		e.Gauge("lsd_cache_entries", "Entries in the cache", float64(c.Entries), "cache", name)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
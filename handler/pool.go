@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+type (
+	// program is a compiled handler script along with a pool of Lua states
+	// that can be reused to run it.
+	//
+	// Once a newer version of the script is loaded, the program is retired
+	// and states returned to it are closed.
+	program struct {
+		proto   *lua.FunctionProto
+		states  chan *lua.LState
+		version int64
+		retired int32
+
+		stats *poolStats
+	}
+
+	poolStats struct {
+		hits   int64
+		misses int64
+	}
+)
+
+func compile(code []byte, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(bytes.NewBuffer(code), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+func newProgram(code []byte, name string, poolSize int, version int64, stats *poolStats) (*program, error) {
+	proto, err := compile(code, name)
+	if err != nil {
+		return nil, err
+	}
+	if poolSize < 0 {
+		poolSize = 0
+	}
+	return &program{
+		proto:   proto,
+		states:  make(chan *lua.LState, poolSize),
+		version: version,
+		stats:   stats,
+	}, nil
+}
+
+// acquire returns an idle state from the pool, or nil if the pool is empty.
+func (p *program) acquire() *lua.LState {
+	select {
+	case L := <-p.states:
+		atomic.AddInt64(&p.stats.hits, 1)
+		return L
+	default:
+		atomic.AddInt64(&p.stats.misses, 1)
+		return nil
+	}
+}
+
+// release returns L to the pool, closing it if the pool is already full
+// or if the program was retired.
+func (p *program) release(L *lua.LState) {
+	L.SetTop(0)
+	L.RemoveContext()
+	if atomic.LoadInt32(&p.retired) != 0 {
+		L.Close()
+		return
+	}
+	select {
+	case p.states <- L:
+	default:
+		L.Close()
+	}
+}
+
+// retire closes all idle states and prevents new ones from being added to the pool.
+func (p *program) retire() {
+	atomic.StoreInt32(&p.retired, 1)
+	for {
+		select {
+		case L := <-p.states:
+			L.Close()
+		default:
+			return
+		}
+	}
+}
+
+// call runs the compiled script on L using a fresh global environment,
+// so globals set by one request are not visible to the next one.
+func (p *program) call(L *lua.LState) error {
+	env := L.NewTable()
+	meta := L.NewTable()
+	L.SetField(meta, "__index", L.G.Global)
+	L.SetMetatable(env, meta)
+	fn := L.NewFunctionFromProto(p.proto)
+	fn.Env = env
+	return L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    0,
+		Protect: true,
+	})
+}
+
+func (p *program) idle() int {
+	return len(p.states)
+}
+
+func (p *program) capacity() int {
+	return cap(p.states)
+}
+
+// bindModules replaces the preloaded modules of L with the given loaders,
+// and removes any cached copy left by a previous call to require.
+func bindModules(L *lua.LState, modules map[string]lua.LGFunction) {
+	loaded := L.GetField(L.Get(lua.RegistryIndex), "_LOADED")
+	for name, loader := range modules {
+		if tbl, ok := loaded.(*lua.LTable); ok {
+			tbl.RawSetString(name, lua.LNil)
+		}
+		L.PreloadModule(name, loader)
+	}
+}
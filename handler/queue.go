@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrebq/learn-system-design/control"
+	"github.com/andrebq/learn-system-design/internal/bindings/handler"
+	"github.com/andrebq/learn-system-design/internal/logutil"
+	"github.com/andrebq/learn-system-design/internal/mutex"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// consumerWait is how long consumers wait for new messages on each receive
+	consumerWait = 5 * time.Second
+	// consumerBackoff is how long consumers wait after failing to reach the broker
+	consumerBackoff = time.Second
+)
+
+type (
+	// consumers deliver messages to the subscriptions made by the init file
+	consumers struct {
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+)
+
+// replaceConsumers stops the consumers started by the previous init file and starts
+// one consumer for each subscription in subs.
+//
+// Subscription functions belong to L, which is kept open until the consumers stop.
+// Since a Lua state can't be used concurrently, messages are processed one at a time.
+func (h *h) replaceConsumers(ctx context.Context, L *lua.LState, subs *handler.Subscriptions) {
+	var previous *consumers
+	mutex.Run(h.consumerLock.Exclusive(), func() {
+		previous, h.consumers = h.consumers, nil
+	})
+	if previous != nil {
+		previous.cancel()
+		<-previous.done
+	}
+	if len(subs.List) == 0 {
+		L.Close()
+		return
+	}
+	if h.controlEndpoint == "" {
+		log := logutil.Acquire(ctx)
+		log.Warn().Int("subscriptions", len(subs.List)).Msg("No control plane configured, subscriptions will not receive messages")
+		L.Close()
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c := &consumers{cancel: cancel, done: make(chan struct{})}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, sub := range subs.List {
+		wg.Add(1)
+		go func(sub *handler.Subscription) {
+			defer wg.Done()
+			h.consume(ctx, L, &lock, sub)
+		}(sub)
+	}
+	go func() {
+		wg.Wait()
+		L.Close()
+		close(c.done)
+	}()
+	mutex.Run(h.consumerLock.Exclusive(), func() {
+		h.consumers = c
+	})
+}
+
+func (h *h) consume(ctx context.Context, L *lua.LState, lock *sync.Mutex, sub *handler.Subscription) {
+	log := logutil.Acquire(ctx).With().Str("topic", sub.Topic).Str("group", sub.Group).Logger()
+	for ctx.Err() == nil {
+		msgs, err := control.Receive(ctx, h.controlEndpoint, sub.Topic, sub.Group, control.ReceiveRequest{
+			Max:                      1,
+			VisibilityTimeoutSeconds: sub.VisibilityTimeout.Seconds(),
+			WaitSeconds:              consumerWait.Seconds(),
+			MaxAttempts:              sub.MaxAttempts,
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Err(err).Msg("Unable to receive messages")
+				select {
+				case <-time.After(consumerBackoff):
+				case <-ctx.Done():
+				}
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			settle := control.Ack
+			if err := h.deliver(ctx, L, lock, sub, msg); err != nil {
+				log.Error().Err(err).Str("message", msg.ID).Int("attempts", msg.Attempts).Msg("Unable to process message")
+				atomic.AddInt64(&h.instanceData.Metrics.MessagesFailed, 1)
+				settle = control.Nack
+			} else {
+				atomic.AddInt64(&h.instanceData.Metrics.MessagesConsumed, 1)
+			}
+			if err := settle(ctx, h.controlEndpoint, sub.Topic, sub.Group, msg.ID); err != nil && ctx.Err() == nil {
+				// the message is delivered again once its visibility timeout expires
+				log.Error().Err(err).Str("message", msg.ID).Msg("Unable to settle message")
+			}
+		}
+	}
+}
+
+// deliver runs the subscription function, which must finish before the message becomes visible again
+func (h *h) deliver(ctx context.Context, L *lua.LState, lock *sync.Mutex, sub *handler.Subscription, msg *control.QueueMessage) error {
+	lock.Lock()
+	defer lock.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, sub.VisibilityTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	return handler.Deliver(L, sub, msg)
+}
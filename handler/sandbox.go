@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrebq/learn-system-design/internal/bindings/handler"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// DefaultTimeout is how long a request can execute the handler script
+	DefaultTimeout = 30 * time.Second
+)
+
+type (
+	// Limits restricts the resources a single request can use, zero values disable a limit
+	Limits struct {
+		// Timeout is the maximum wall-clock time spent executing the handler
+		Timeout time.Duration
+		// Instructions is the maximum number of Lua instructions executed by the handler
+		Instructions int64
+	}
+
+	// TimeoutError is returned when a request runs for longer than Limits.Timeout
+	TimeoutError struct {
+		Limit time.Duration
+	}
+
+	// InstructionLimitError is returned when a request executes more than Limits.Instructions
+	InstructionLimitError struct {
+		Limit int64
+	}
+
+	// sandbox is the context of a Lua state serving a request.
+	//
+	// gopher-lua checks the context of the state before executing each instruction,
+	// which is used to count instructions and to stop scripts which never call Go functions.
+	sandbox struct {
+		context.Context
+		parent context.Context
+		cancel context.CancelFunc
+		limits Limits
+
+		// executed is only updated by the VM of the state
+		executed int64
+
+		errLock sync.Mutex
+		err     limitError
+	}
+
+	// limitError is implemented by the errors returned when a limit is exceeded
+	limitError interface {
+		error
+		// Status returns the status code sent to the client
+		Status() int
+	}
+)
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("handler: script timed out after %v", e.Limit)
+}
+
+// Status returns the status code sent to the client
+func (e *TimeoutError) Status() int { return http.StatusGatewayTimeout }
+
+func (e *InstructionLimitError) Error() string {
+	return fmt.Sprintf("handler: script exceeded the budget of %v instructions", e.Limit)
+}
+
+// Status returns the status code sent to the client
+func (e *InstructionLimitError) Status() int { return http.StatusInternalServerError }
+
+// WithLimits restricts the resources each request can use
+func WithLimits(limits Limits) Option {
+	return func(h *h) {
+		h.limits = limits
+	}
+}
+
+// newSandbox returns a context derived from parent which is cancelled once
+// any of the limits is exceeded
+func newSandbox(parent context.Context, limits Limits) *sandbox {
+	s := &sandbox{parent: parent, limits: limits}
+	if limits.Timeout > 0 {
+		s.Context, s.cancel = context.WithTimeout(parent, limits.Timeout)
+	} else {
+		s.Context, s.cancel = context.WithCancel(parent)
+	}
+	return s
+}
+
+// attach sets the sandbox as the context of L, only the instructions executed by L
+// are counted, Go functions waiting on the context are not
+func (s *sandbox) attach(L *lua.LState) {
+	handler.SetCountingContext(L, s.Context, s.countInstruction)
+}
+
+func (s *sandbox) countInstruction() {
+	s.executed++
+	if s.limits.Instructions > 0 && s.executed == s.limits.Instructions+1 {
+		s.stop(&InstructionLimitError{Limit: s.limits.Instructions})
+	}
+}
+
+// stop cancels the context, only the first limit exceeded is reported
+func (s *sandbox) stop(err limitError) {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cancel()
+}
+
+// limitErr returns the error of the limit which stopped the script, or nil
+// if the script was not stopped by the sandbox.
+//
+// Err is not overridden, so code waiting on the context still sees the usual errors.
+func (s *sandbox) limitErr() limitError {
+	s.errLock.Lock()
+	err := s.err
+	s.errLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if s.parent.Err() == nil && s.Context.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Limit: s.limits.Timeout}
+	}
+	return nil
+}
+
+// release frees the resources of the sandbox
+func (s *sandbox) release() {
+	s.cancel()
+}
+
+// countLimit increments the metric of the limit which stopped a request
+func (h *h) countLimit(err limitError) {
+	switch err.(type) {
+	case *TimeoutError:
+		atomic.AddInt64(&h.instanceData.Metrics.ScriptTimeouts, 1)
+	case *InstructionLimitError:
+		atomic.AddInt64(&h.instanceData.Metrics.InstructionLimitsExceeded, 1)
+	}
+}
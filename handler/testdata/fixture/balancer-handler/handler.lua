@@ -0,0 +1,15 @@
+local handler = require("handler")
+local services = require("services")
+
+local res, err = services.call{
+    service = "backend",
+    balancer = handler.query("balancer"),
+    key = handler.query("key"),
+}
+if err then
+    handler.writeStatus(502)
+    handler.writeBody(tostring(err))
+    return
+end
+handler.writeStatus(200)
+handler.writeBody(res.body)
@@ -0,0 +1,28 @@
+local handler = require("handler")
+local cache = require("cache")
+local services = require("services")
+
+local configs = {
+    users = { name = "users", size = 2, policy = "lru", ttl = 60, negativeTtl = 60 },
+    coalesced = { name = "coalesced", size = 10, coalesce = true },
+    popular = { name = "popular", size = 2, policy = "lfu" },
+    expiring = { name = "expiring", size = 2, policy = "ttl" },
+    short = { name = "short", size = 10, ttl = 0.05, negativeTtl = 0.05 },
+}
+local users = cache.new(configs[handler.query("cache")])
+local value, err = users:getOrLoad(handler.query("key"), tonumber(handler.query("ttl")), function(key)
+    local res, err = services.call{ service = "backend", method = "GET", path = "/" .. key }
+    if err then
+        return nil, tostring(err)
+    end
+    if res.status == 404 then
+        return nil
+    end
+    return res.body
+end)
+if err then
+    handler.writeStatus(502)
+    handler.writeBody(err)
+    return
+end
+handler.writeBody(tostring(value))
@@ -0,0 +1,10 @@
+local handler = require("handler")
+local computations = require("computations")
+
+-- fractional seconds must not be truncated
+computations.slow(0.02)
+local ok, slept = computations.sleep{ kind = "uniform", min = 0.01, max = 0.02 }
+local _, pareto = computations.sleep{ kind = "pareto", min = 0.001, shape = 3, max = 0.005 }
+local _, burned = computations.cpu(5)
+computations.alloc(1024 * 1024, 0.1)
+handler.writeBody(tostring(ok and slept >= 0.01 and slept <= 0.02 and pareto >= 0.001 and pareto <= 0.005 and burned > 0))
@@ -0,0 +1,24 @@
+local handler = require("handler")
+local services = require("services")
+local computations = require("computations")
+
+if handler.query("mode") == "front" then
+    local res, err = services.call{ service = "backend", method = "GET", path = "/?mode=back", timeout = 0.2 }
+    -- the client and the backend share the same deadline, so either one can give up first
+    if err then
+        handler.writeJSON(502, { side = "client", code = err.code })
+        return
+    end
+    handler.writeJSON(502, { side = "backend", status = res.status, body = res.body })
+    return
+end
+
+local remaining = handler.deadline()
+if remaining < 0.1 then
+    -- not enough time left, give up before doing any work
+    handler.writeStatus(504)
+    handler.writeBody("not enough time")
+    return
+end
+computations.slow(1)
+handler.writeBody("done")
@@ -0,0 +1,27 @@
+local handler = require("handler")
+local services = require("services")
+
+local mode = handler.query("mode")
+if mode == "await" then
+    local a = services.callAsync{ service = "slow", method = "GET", path = "/a" }
+    local b = services.callAsync("slow", "b")
+    local results, errors = services.await(a, b)
+    if errors[1] or errors[2] then
+        handler.writeStatus(502)
+        return
+    end
+    handler.writeBody(results[1].body .. "," .. results[2].body)
+elseif mode == "any" then
+    local slow = services.callAsync{ service = "slow", method = "GET", path = "/slow" }
+    local fast = services.callAsync{ service = "fast", method = "GET", path = "/fast" }
+    local idx, res = services.awaitAny(slow, fast)
+    local _, err = slow:await()
+    handler.writeBody(idx .. ":" .. res.body .. ":" .. tostring(err == nil))
+elseif mode == "all" then
+    local results, errors = services.callAll{
+        { service = "slow", method = "GET", path = "/1" },
+        { service = "missing" },
+        { service = "fast", method = "GET", path = "/3" },
+    }
+    handler.writeBody(results[1].body .. "," .. errors[2].code .. "," .. results[3].body)
+end
@@ -0,0 +1,12 @@
+local handler = require("handler")
+local health = require("health")
+
+if handler.query("warm") then
+    health.setReady(true)
+end
+local ready, reason = health.isReady()
+if ready then
+    handler.writeBody("ready")
+    return
+end
+handler.writeBody("not ready: " .. reason)
@@ -0,0 +1,4 @@
+local health = require("health")
+
+health.dependsOn("database")
+health.setReady(false, "warming up")
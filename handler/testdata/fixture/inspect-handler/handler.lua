@@ -0,0 +1,16 @@
+local handler = require("handler")
+local body, err = handler.body(tonumber(handler.query("limit")))
+if err then
+    handler.writeStatus(413)
+    handler.writeBody(err)
+    return
+end
+handler.writeStatus(200)
+handler.writeBody(table.concat({
+    handler.method(),
+    handler.path(),
+    handler.query("name"),
+    handler.header("X-Salute"),
+    handler.cookie("session"),
+    body,
+}, " "))
@@ -0,0 +1,14 @@
+local handler = require("handler")
+local json = require("json")
+local input, err = handler.readJSON()
+if err then
+    handler.writeJSON(400, { error = err })
+    return
+end
+handler.writeJSON(200, {
+    greeting = "Hello " .. input.salute,
+    tags = input.tags,
+    empty = json.array(),
+    missing = input.missing == json.null,
+    roundtrip = json.decode(json.encode({ 1, 2, { a = true } })),
+})
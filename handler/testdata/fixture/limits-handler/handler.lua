@@ -0,0 +1,7 @@
+local handler = require("handler")
+
+local mode = handler.query("mode")
+if mode == "loop" then
+    while true do end
+end
+handler.writeBody("done")
@@ -0,0 +1,15 @@
+local handler = require("handler")
+local queue = require("queue")
+local state = require("state")
+
+if handler.query("op") == "publish" then
+    local id, err = queue.publish("orders", { id = handler.query("id"), fail = handler.query("fail") == "true" })
+    if err then
+        handler.writeStatus(502)
+        handler.writeBody(err)
+        return
+    end
+    handler.writeBody(id)
+    return
+end
+handler.writeBody(table.concat(state.list("processed"):items(), ",") .. " " .. table.concat(state.list("dead"):items(), ","))
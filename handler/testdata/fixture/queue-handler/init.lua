@@ -0,0 +1,13 @@
+local queue = require("queue")
+local state = require("state")
+
+queue.subscribe("orders", function(order, meta)
+    if order.fail then
+        return false
+    end
+    state.list("processed"):push(order.id)
+end, { visibilityTimeout = 1, maxAttempts = 2 })
+
+queue.subscribe(queue.deadLetter("orders"), function(order, meta)
+    state.list("dead"):push(order.id .. "@" .. meta.topic)
+end)
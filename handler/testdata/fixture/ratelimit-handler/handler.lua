@@ -0,0 +1,28 @@
+local handler = require("handler")
+local ratelimit = require("ratelimit")
+
+if handler.query("cost") then
+    local log = ratelimit.limiter{ name = "log", algorithm = "sliding_log", limit = 2, per = 60, key = "ip" }
+    local ok, res = pcall(log.take, log, nil, tonumber(handler.query("cost")))
+    if not ok then
+        handler.writeStatus(400)
+        handler.writeBody("invalid cost")
+        return
+    end
+    handler.writeBody(tostring(res.allowed))
+    return
+end
+
+local res = ratelimit.take("per-key")
+for name, value in pairs(ratelimit.headers(res)) do
+    handler.addHeader(name, value)
+end
+if not res.allowed then
+    handler.writeStatus(429)
+    handler.writeBody("slow down")
+    return
+end
+
+local bucket = ratelimit.limiter{ name = "bucket", algorithm = "token_bucket", limit = 1, per = 60, burst = 3, key = "ip" }
+local burst = bucket:take()
+handler.writeBody(tostring(res.remaining) .. " " .. tostring(burst.remaining))
@@ -0,0 +1,2 @@
+local ratelimit = require("ratelimit")
+ratelimit.limiter{ name = "per-key", algorithm = "fixed_window", limit = 2, per = 60, key = "header:X-Api-Key" }
@@ -0,0 +1,3 @@
+local services = require("services")
+-- only allow a single retry
+services.retryBudget{ ratio = 0, minPerSecond = 0 }
@@ -0,0 +1,15 @@
+local handler = require("handler")
+local services = require("services")
+
+local res, err = services.call{
+    service = "backend",
+    balancer = "round_robin",
+    retry = { attempts = 3, backoff = "none", on = { 503 } },
+}
+if err then
+    handler.writeStatus(502)
+    handler.writeBody(tostring(err))
+    return
+end
+handler.writeStatus(res.status)
+handler.writeBody(tostring(res.attempts))
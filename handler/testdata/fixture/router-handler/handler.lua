@@ -0,0 +1,24 @@
+local handler = require("handler")
+local router = require("router")
+
+router.use(function(next, params)
+    handler.addHeader("X-Middleware", "called")
+    next()
+end)
+
+router.get("/users/:id", function(params)
+    handler.writeStatus(200)
+    handler.writeBody("user " .. params.id)
+end)
+
+router.post("/users", function()
+    handler.writeStatus(201)
+    handler.writeBody("created")
+end)
+
+router.notFound(function()
+    handler.writeStatus(404)
+    handler.writeBody("nothing here")
+end)
+
+router.serve()
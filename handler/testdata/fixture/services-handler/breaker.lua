@@ -0,0 +1,2 @@
+local services = require("services")
+services.breaker("backend", { minRequests = 2, failureRate = 0.5, coolDown = 60 })
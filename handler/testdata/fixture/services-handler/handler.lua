@@ -0,0 +1,15 @@
+local handler = require("handler")
+local services = require("services")
+
+local res, err = services.call{
+    service = handler.query("service"),
+    method = "GET",
+    path = "/users/1",
+    headers = { ["X-Salute"] = "hello" },
+    timeout = 1,
+}
+if err then
+    handler.writeJSON(502, { code = err.code, message = tostring(err) })
+    return
+end
+handler.writeJSON(200, { status = res.status, body = res.body, header = res.headers["X-Backend"] })
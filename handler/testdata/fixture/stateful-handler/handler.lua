@@ -0,0 +1,6 @@
+local handler = require("handler")
+local state = require("state")
+local visits = state.counter("visits"):incr()
+local apple = state.map("inventory"):get("apple")
+handler.writeStatus(200)
+handler.writeBody(state.get("greeting") .. " " .. tostring(visits) .. " " .. tostring(apple.stock))
@@ -0,0 +1,5 @@
+local state = require("state")
+state.set("greeting", "hello")
+state.counter("visits"):set(10)
+local inventory = state.map("inventory")
+inventory:put("apple", { price = 1.5, stock = 3 })
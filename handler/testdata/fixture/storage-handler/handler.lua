@@ -0,0 +1,41 @@
+local handler = require("handler")
+local storage = require("storage")
+
+local op = handler.query("op")
+if op == "crud" then
+    storage.put("user:1", { name = "a" })
+    storage.put("user:2", { name = "b" })
+    storage.put("order:1", 10)
+    local user = storage.get("user:1")
+    local swapped = storage.cas("order:1", 10, 11)
+    local stale = storage.cas("order:1", 10, 12)
+    local users = storage.scan("user:", "user;")
+    local deleted = storage.delete("user:2")
+    handler.writeJSON(200, {
+        user = user.name,
+        swapped = swapped,
+        stale = stale,
+        users = #users,
+        deleted = deleted,
+        order = storage.get("order:1"),
+    })
+elseif op == "incr" then
+    local ok, err = storage.withLock("counter", function()
+        local value = storage.get("counter") or 0
+        storage.put("counter", value + 1)
+    end)
+    if not ok then
+        handler.writeStatus(503)
+        handler.writeBody(err)
+        return
+    end
+    handler.writeBody(tostring(storage.get("counter")))
+else
+    local _, err = storage.get("missing")
+    if err then
+        handler.writeStatus(503)
+        handler.writeBody(err)
+        return
+    end
+    handler.writeBody("ok")
+end
@@ -0,0 +1,2 @@
+local storage = require("storage")
+storage.configure{ poolSize = 2, poolTimeout = 5, latency = 0.005 }
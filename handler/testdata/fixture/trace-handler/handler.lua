@@ -0,0 +1,14 @@
+local handler = require("handler")
+local services = require("services")
+local trace = require("trace")
+
+if handler.query("mode") == "back" then
+    trace.setAttribute("backend", true)
+    handler.writeBody(trace.traceId())
+    return
+end
+
+local res = trace.span("work", function()
+    return services.call{ service = "backend", method = "GET", path = "/?mode=back" }
+end, { step = 1 })
+handler.writeBody(trace.traceId() .. " " .. res.body)
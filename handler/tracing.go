@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/andrebq/learn-system-design/internal/tracing"
+)
+
+// WithTracing exports spans to the OTLP/HTTP endpoint (eg.: http://localhost:4318),
+// an empty endpoint disables tracing
+func WithTracing(endpoint string) Option {
+	return func(h *h) {
+		h.traceEndpoint = endpoint
+	}
+}
+
+// Close exports the spans which are still waiting in the queue, it is called
+// after the server shuts down so spans created while draining are not lost
+func (h *h) Close(ctx context.Context) error {
+	return h.tracer.Close(ctx)
+}
+
+// startSpan starts the server span of req, continuing the trace of the caller
+func (h *h) startSpan(req *http.Request) (*http.Request, *tracing.Span) {
+	ctx, span := h.tracer.Start(tracing.Extract(req.Context(), req.Header), req.Method+" "+req.URL.Path, tracing.SpanKindServer)
+	if span == nil {
+		return req, nil
+	}
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.target", req.URL.RequestURI())
+	span.SetAttribute("lsd.instance", h.name)
+	return req.WithContext(ctx), span
+}
+
+// endSpan records the status sent to the client and ends span
+func endSpan(status int, span *tracing.Span) {
+	if span == nil {
+		return
+	}
+	if status == statusDropped {
+		span.SetError("connection dropped")
+	} else {
+		span.SetAttribute("http.status_code", status)
+		if status >= 500 {
+			span.SetError(http.StatusText(status))
+		}
+	}
+	span.End()
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/andrebq/learn-system-design/internal/logutil"
+)
+
+const (
+	watchInterval = time.Second
+)
+
+type (
+	// fingerprint identifies the version of each file being watched
+	fingerprint map[string]string
+)
+
+// watch polls the script directories and reloads the handler whenever
+// any of the Lua files changes
+func (h *h) watch(ctx context.Context) {
+	log := logutil.Acquire(ctx).With().Str("handlerFile", h.handlerFile).Logger()
+	last := h.fingerprint()
+	tick := time.NewTicker(watchInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		current := h.fingerprint()
+		if current.equal(last) {
+			continue
+		}
+		initFile := filepath.Clean(h.initFile)
+		initChanged := current[initFile] != last[initFile]
+		last = current
+		if err := h.reload(ctx, initChanged); err != nil {
+			log.Error().Err(err).Msg("Unable to reload scripts, keeping the previous version")
+			h.setScriptError(err)
+			continue
+		}
+		h.setScriptError(nil)
+		log.Info().Int64("version", h.current().version).Msg("Scripts reloaded")
+	}
+}
+
+// reload validates all scripts and swaps the running program by the new one.
+//
+// If the init file changed, it is executed again (against the existing shared state)
+// before the new program is made available.
+func (h *h) reload(ctx context.Context, initChanged bool) error {
+	for _, f := range h.scriptFiles() {
+		code, err := ioutil.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("handler: unable to open %v, cause %w", f, err)
+		}
+		if _, err := compile(code, filepath.Base(f)); err != nil {
+			return fmt.Errorf("handler: unable to compile %v, cause %w", f, err)
+		}
+	}
+	handlerCode, err := ioutil.ReadFile(h.handlerFile)
+	if err != nil {
+		return fmt.Errorf("handler: unable to open %v, cause %w", h.handlerFile, err)
+	}
+	old := h.current()
+	prog, err := newProgram(handlerCode, filepath.Base(h.handlerFile), h.poolSize, old.version+1, old.stats)
+	if err != nil {
+		return fmt.Errorf("handler: unable to compile %v, cause %w", h.handlerFile, err)
+	}
+	if initChanged {
+		if err := h.runInit(ctx); err != nil {
+			return err
+		}
+	}
+	h.prog.Store(prog)
+	old.retire()
+	return nil
+}
+
+// scriptFiles returns all Lua files that might be used by the handler,
+// this includes modules that live next to the handler or init files
+func (h *h) scriptFiles() []string {
+	dirs := map[string]struct{}{filepath.Dir(h.handlerFile): {}}
+	if h.initFile != "" {
+		dirs[filepath.Dir(h.initFile)] = struct{}{}
+	}
+	var files []string
+	for d := range dirs {
+		matches, _ := filepath.Glob(filepath.Join(d, "*.lua"))
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (h *h) fingerprint() fingerprint {
+	fp := fingerprint{}
+	for _, f := range h.scriptFiles() {
+		st, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		fp[f] = fmt.Sprintf("%v:%v", st.ModTime().UnixNano(), st.Size())
+	}
+	return fp
+}
+
+func (fp fingerprint) equal(other fingerprint) bool {
+	if len(fp) != len(other) {
+		return false
+	}
+	for k, v := range fp {
+		if other[k] != v {
+			return false
+		}
+	}
+	return true
+}
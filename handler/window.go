@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/andrebq/learn-system-design/control"
+	"github.com/andrebq/learn-system-design/internal/metrics"
+)
+
+type (
+	// window accumulates the requests served between two heartbeats
+	window struct {
+		sync.Mutex
+		start    time.Time
+		requests int64
+		classes  map[string]int64
+		latency  *metrics.Sketch
+	}
+)
+
+func newWindow(now time.Time) *window {
+	return &window{start: now, classes: make(map[string]int64), latency: metrics.NewSketch()}
+}
+
+func (w *window) observe(status int, elapsed time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	w.requests++
+	w.classes[statusClass(status)]++
+	w.latency.Add(elapsed.Seconds())
+}
+
+// rotate returns the stats of the current window and starts a new one
+func (w *window) rotate(now time.Time) *control.WindowStats {
+	w.Lock()
+	defer w.Unlock()
+	stats := &control.WindowStats{
+		Seconds:  now.Sub(w.start).Seconds(),
+		Requests: w.requests,
+		Sketch:   w.latency,
+	}
+	if len(w.classes) > 0 {
+		stats.Classes = w.classes
+	}
+	w.start = now
+	w.requests = 0
+	w.classes = make(map[string]int64)
+	w.latency = metrics.NewSketch()
+	stats.Summarize()
+	return stats
+}
+
+// statusClass groups status codes by their first digit (eg.: 503 becomes 5xx)
+func statusClass(status int) string {
+	if status == statusDropped {
+		return "dropped"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// heartbeat returns the information sent to the control plane, including the requests
+// served since the previous heartbeat
+func (h *h) heartbeat() control.Instance {
+	i := h.snapshot()
+	i.Window = h.window.rotate(time.Now())
+	i.Window.InFlight = i.Metrics.InFlight
+	return i
+}
@@ -0,0 +1,349 @@
+package handler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/andrebq/learn-system-design/control"
+	"github.com/andrebq/learn-system-design/internal/mutex"
+)
+
+const (
+	StrategyRandom             = "random"
+	StrategyRoundRobin         = "round_robin"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyLeastOutstanding   = "least_outstanding"
+	StrategyPowerOfTwo         = "p2c"
+	StrategyConsistentHash     = "consistent_hash"
+
+	// virtualNodes is how many points each endpoint gets in the hash ring
+	virtualNodes = 100
+)
+
+var (
+	strategyAliases = map[string]string{
+		"rr":             StrategyRoundRobin,
+		"round-robin":    StrategyRoundRobin,
+		"wrr":            StrategyWeightedRoundRobin,
+		"weighted":       StrategyWeightedRoundRobin,
+		"lor":            StrategyLeastOutstanding,
+		"least-requests": StrategyLeastOutstanding,
+		"hash":           StrategyConsistentHash,
+		"ring":           StrategyConsistentHash,
+	}
+)
+
+type (
+	// Balancer decides which server should receive a call to a service.
+	//
+	// A single balancer is shared by all requests of an instance,
+	// which allows strategies to track how many calls are in-flight
+	// for each endpoint.
+	Balancer struct {
+		mutex.Zone
+		defaultStrategy string
+		strategies      map[string]string
+		inflight        map[string]*int64
+		cursors         map[string]*uint64
+		weights         map[string]map[string]int
+		rings           map[string]*hashRing
+	}
+
+	hashRing struct {
+		signature string
+		points    []ringPoint
+	}
+
+	ringPoint struct {
+		hash     uint64
+		endpoint string
+	}
+)
+
+// NormalizeStrategy returns the canonical name of a strategy
+func NormalizeStrategy(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := strategyAliases[name]; ok {
+		name = alias
+	}
+	switch name {
+	case "":
+		return StrategyRandom, nil
+	case StrategyRandom, StrategyRoundRobin, StrategyWeightedRoundRobin,
+		StrategyLeastOutstanding, StrategyPowerOfTwo, StrategyConsistentHash:
+		return name, nil
+	}
+	return "", fmt.Errorf("balancer: unknown strategy %q", name)
+}
+
+// NewBalancer returns a balancer which uses defaultStrategy for services
+// that don't have a specific strategy
+func NewBalancer(defaultStrategy string) (*Balancer, error) {
+	strategy, err := NormalizeStrategy(defaultStrategy)
+	if err != nil {
+		return nil, err
+	}
+	return &Balancer{
+		defaultStrategy: strategy,
+		strategies:      make(map[string]string),
+		inflight:        make(map[string]*int64),
+		cursors:         make(map[string]*uint64),
+		weights:         make(map[string]map[string]int),
+		rings:           make(map[string]*hashRing),
+	}, nil
+}
+
+// SetStrategy changes the strategy used for the given service
+func (b *Balancer) SetStrategy(service, strategy string) error {
+	strategy, err := NormalizeStrategy(strategy)
+	if err != nil {
+		return err
+	}
+	mutex.Run(b.Exclusive(), func() {
+		b.strategies[service] = strategy
+	})
+	return nil
+}
+
+// Strategy returns the strategy configured for service
+func (b *Balancer) Strategy(service string) string {
+	var strategy string
+	mutex.Run(b.Shared(), func() {
+		strategy = b.strategies[service]
+	})
+	if strategy == "" {
+		return b.defaultStrategy
+	}
+	return strategy
+}
+
+// Inflight returns how many calls are currently in progress for the given endpoint
+func (b *Balancer) Inflight(endpoint string) int64 {
+	return atomic.LoadInt64(b.counter(endpoint))
+}
+
+// track marks a call to endpoint as in-flight, the returned function must be
+// called once the call is done
+func (b *Balancer) track(endpoint string) func() {
+	c := b.counter(endpoint)
+	atomic.AddInt64(c, 1)
+	return func() {
+		atomic.AddInt64(c, -1)
+	}
+}
+
+func (b *Balancer) counter(endpoint string) *int64 {
+	var c *int64
+	mutex.Run(b.Shared(), func() {
+		c = b.inflight[endpoint]
+	})
+	if c != nil {
+		return c
+	}
+	mutex.Run(b.Exclusive(), func() {
+		c = b.inflight[endpoint]
+		if c == nil {
+			c = new(int64)
+			b.inflight[endpoint] = c
+		}
+	})
+	return c
+}
+
+// pick chooses one of the candidates (which must implement service) using the given strategy,
+// if strategy is empty the one configured for the service is used.
+//
+// key is only used by the consistent hash strategy.
+func (b *Balancer) pick(candidates []*control.Server, service, strategy, key string) (*control.Server, error) {
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	if strategy == "" {
+		strategy = b.Strategy(service)
+	} else {
+		var err error
+		if strategy, err = NormalizeStrategy(strategy); err != nil {
+			return nil, err
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	switch strategy {
+	case StrategyRoundRobin:
+		return b.roundRobin(candidates, service), nil
+	case StrategyWeightedRoundRobin:
+		return b.weightedRoundRobin(candidates, service), nil
+	case StrategyLeastOutstanding:
+		return b.leastOutstanding(candidates), nil
+	case StrategyPowerOfTwo:
+		return b.powerOfTwo(candidates), nil
+	case StrategyConsistentHash:
+		if key == "" {
+			return randomOption(candidates), nil
+		}
+		return b.consistentHash(candidates, service, key), nil
+	}
+	return randomOption(candidates), nil
+}
+
+func (b *Balancer) roundRobin(candidates []*control.Server, service string) *control.Server {
+	var cursor *uint64
+	mutex.Run(b.Exclusive(), func() {
+		cursor = b.cursors[service]
+		if cursor == nil {
+			cursor = new(uint64)
+			b.cursors[service] = cursor
+		}
+	})
+	sorted := sortedByEndpoint(candidates)
+	next := atomic.AddUint64(cursor, 1) - 1
+	return sorted[next%uint64(len(sorted))]
+}
+
+// weightedRoundRobin implements the smooth weighted round-robin used by nginx,
+// servers with higher weights receive proportionally more calls,
+// without sending them in bursts.
+func (b *Balancer) weightedRoundRobin(candidates []*control.Server, service string) *control.Server {
+	var selected *control.Server
+	sorted := sortedByEndpoint(candidates)
+	mutex.Run(b.Exclusive(), func() {
+		current := b.weights[service]
+		if current == nil {
+			current = make(map[string]int)
+			b.weights[service] = current
+		}
+		total := 0
+		for _, c := range sorted {
+			w := weightOf(c)
+			total += w
+			current[c.Endpoint] += w
+			if selected == nil || current[c.Endpoint] > current[selected.Endpoint] {
+				selected = c
+			}
+		}
+		current[selected.Endpoint] -= total
+	})
+	return selected
+}
+
+func (b *Balancer) leastOutstanding(candidates []*control.Server) *control.Server {
+	// start at a random position to avoid always picking the first server when there is a tie
+	offset := rand.Intn(len(candidates))
+	var selected *control.Server
+	var min int64
+	for i := range candidates {
+		c := candidates[(i+offset)%len(candidates)]
+		load := b.Inflight(c.Endpoint)
+		if selected == nil || load < min {
+			selected, min = c, load
+		}
+	}
+	return selected
+}
+
+// powerOfTwo picks two random servers and uses the one with fewer in-flight calls
+func (b *Balancer) powerOfTwo(candidates []*control.Server) *control.Server {
+	first := rand.Intn(len(candidates))
+	second := rand.Intn(len(candidates) - 1)
+	if second >= first {
+		second++
+	}
+	a, c := candidates[first], candidates[second]
+	if b.Inflight(c.Endpoint) < b.Inflight(a.Endpoint) {
+		return c
+	}
+	return a
+}
+
+func (b *Balancer) consistentHash(candidates []*control.Server, service, key string) *control.Server {
+	sorted := sortedByEndpoint(candidates)
+	var signature strings.Builder
+	for _, c := range sorted {
+		signature.WriteString(c.Endpoint)
+		signature.WriteString(";")
+	}
+	var ring *hashRing
+	mutex.Run(b.Exclusive(), func() {
+		ring = b.rings[service]
+		if ring == nil || ring.signature != signature.String() {
+			ring = newHashRing(signature.String(), sorted)
+			b.rings[service] = ring
+		}
+	})
+	endpoint := ring.lookup(hashKey(key))
+	for _, c := range sorted {
+		if c.Endpoint == endpoint {
+			return c
+		}
+	}
+	return sorted[0]
+}
+
+func newHashRing(signature string, servers []*control.Server) *hashRing {
+	ring := &hashRing{signature: signature}
+	for _, s := range servers {
+		for i := 0; i < virtualNodes; i++ {
+			ring.points = append(ring.points, ringPoint{
+				hash:     hashKey(s.Endpoint + "#" + strconv.Itoa(i)),
+				endpoint: s.Endpoint,
+			})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i].hash < ring.points[j].hash })
+	return ring
+}
+
+// lookup returns the first endpoint clockwise from h
+func (r *hashRing) lookup(h uint64) string {
+	idx := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if idx == len(r.points) {
+		idx = 0
+	}
+	return r.points[idx].endpoint
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func weightOf(s *control.Server) int {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+func sortedByEndpoint(servers []*control.Server) []*control.Server {
+	sorted := append([]*control.Server(nil), servers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Endpoint < sorted[j].Endpoint })
+	return sorted
+}
+
+// serversByName returns all options which implement the given service
+func serversByName(options []*control.Server, name string) []*control.Server {
+	var valid []*control.Server
+	for _, v := range options {
+		if v.Service == name {
+			valid = append(valid, v)
+		}
+	}
+	return valid
+}
+
+func randomOption(options []*control.Server) *control.Server {
+	switch len(options) {
+	case 0:
+		return nil
+	case 1:
+		return options[0]
+	}
+	return options[rand.Intn(len(options))]
+}
@@ -0,0 +1,322 @@
+package handler
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrebq/learn-system-design/control"
+	"github.com/andrebq/learn-system-design/internal/mutex"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+
+	// breakerDefaults is the name used to configure breakers for all services
+	breakerDefaults = "*"
+)
+
+type (
+	// BreakerConfig controls when a circuit breaker opens and how it recovers
+	BreakerConfig struct {
+		// FailureRate (0-1) of calls that must fail to open the breaker
+		FailureRate float64
+		// SlowCall is the latency above which a call is considered slow
+		SlowCall time.Duration
+		// SlowCallRate (0-1) of calls that must be slow to open the breaker,
+		// use 0 to ignore latency
+		SlowCallRate float64
+		// MinRequests in the current window before the rates are checked
+		MinRequests int
+		// Window is how long calls are counted before counters are reset
+		Window time.Duration
+		// CoolDown is how long the breaker stays open before allowing probes
+		CoolDown time.Duration
+		// Probes is how many successful calls are required to close a half-open breaker
+		Probes int
+		// PerEndpoint creates one breaker for each endpoint of the service
+		// instead of a single breaker for the whole service
+		PerEndpoint bool
+	}
+
+	// Breakers holds the circuit breakers of every downstream service
+	Breakers struct {
+		mutex.Zone
+		configs  map[string]BreakerConfig
+		breakers map[string]*breaker
+	}
+
+	breaker struct {
+		sync.Mutex
+		config BreakerConfig
+
+		state    string
+		openedAt time.Time
+
+		windowStart time.Time
+		total       int
+		failures    int
+		slow        int
+
+		probesInFlight int
+		probeSuccesses int
+	}
+)
+
+// DefaultBreakerConfig returns the configuration used when only some fields are provided
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureRate:  0.5,
+		SlowCall:     time.Second,
+		SlowCallRate: 0,
+		MinRequests:  10,
+		Window:       10 * time.Second,
+		CoolDown:     5 * time.Second,
+		Probes:       3,
+	}
+}
+
+func NewBreakers() *Breakers {
+	return &Breakers{
+		configs:  make(map[string]BreakerConfig),
+		breakers: make(map[string]*breaker),
+	}
+}
+
+// Configure enables circuit breaking for the given service, use "*" to configure all services
+func (b *Breakers) Configure(service string, cfg BreakerConfig) {
+	mutex.Run(b.Exclusive(), func() {
+		b.configs[service] = cfg
+		// breakers are re-created with the new configuration on the next call
+		for k := range b.breakers {
+			if service == breakerDefaults || k == service || strings.HasPrefix(k, service+"@") {
+				delete(b.breakers, k)
+			}
+		}
+	})
+}
+
+// States returns the state of each breaker, keyed by service (or service@endpoint)
+func (b *Breakers) States() map[string]string {
+	var keys []string
+	var breakers []*breaker
+	mutex.Run(b.Shared(), func() {
+		for k, v := range b.breakers {
+			keys = append(keys, k)
+			breakers = append(breakers, v)
+		}
+	})
+	if len(keys) == 0 {
+		return nil
+	}
+	states := make(map[string]string, len(keys))
+	for i, k := range keys {
+		states[k] = breakers[i].currentState(time.Now())
+	}
+	return states
+}
+
+// config returns the breaker configuration for service, if any
+func (b *Breakers) config(service string) (BreakerConfig, bool) {
+	var cfg BreakerConfig
+	var found bool
+	mutex.Run(b.Shared(), func() {
+		cfg, found = b.configs[service]
+		if !found {
+			cfg, found = b.configs[breakerDefaults]
+		}
+	})
+	return cfg, found
+}
+
+// available returns the candidates whose breakers might allow a call,
+// services without breakers have all candidates available.
+func (b *Breakers) available(service string, candidates []*control.Server) []*control.Server {
+	cfg, found := b.config(service)
+	if !found {
+		return candidates
+	}
+	now := time.Now()
+	if !cfg.PerEndpoint {
+		if !b.get(service, cfg).peek(now) {
+			return nil
+		}
+		return candidates
+	}
+	var allowed []*control.Server
+	for _, c := range candidates {
+		if b.get(breakerKey(service, c.Endpoint), cfg).peek(now) {
+			allowed = append(allowed, c)
+		}
+	}
+	return allowed
+}
+
+// acquire checks if a call to endpoint is allowed, the returned breaker (if not nil)
+// must be updated with the outcome of the call.
+func (b *Breakers) acquire(service, endpoint string) (*breaker, bool) {
+	cfg, found := b.config(service)
+	if !found {
+		return nil, true
+	}
+	key := service
+	if cfg.PerEndpoint {
+		key = breakerKey(service, endpoint)
+	}
+	br := b.get(key, cfg)
+	return br, br.allow(time.Now())
+}
+
+func (b *Breakers) get(key string, cfg BreakerConfig) *breaker {
+	var br *breaker
+	mutex.Run(b.Exclusive(), func() {
+		br = b.breakers[key]
+		if br == nil {
+			br = &breaker{config: cfg, state: BreakerClosed, windowStart: time.Now()}
+			b.breakers[key] = br
+		}
+	})
+	return br
+}
+
+func breakerKey(service, endpoint string) string {
+	return service + "@" + endpoint
+}
+
+func (b *breaker) currentState(now time.Time) string {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.config.CoolDown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// peek returns true if allow would accept a call, without reserving a probe
+func (b *breaker) peek(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return now.Sub(b.openedAt) >= b.config.CoolDown
+	case BreakerHalfOpen:
+		return b.probesInFlight < b.config.Probes
+	}
+	return true
+}
+
+// allow returns true if a call can be made, in half-open state only a limited
+// number of probes is allowed at the same time.
+func (b *breaker) allow(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.config.CoolDown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probesInFlight = 0
+		b.probeSuccesses = 0
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probesInFlight >= b.config.Probes {
+			return false
+		}
+		b.probesInFlight++
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a call
+func (b *breaker) record(now time.Time, failed bool, latency time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	slow := b.config.SlowCallRate > 0 && latency >= b.config.SlowCall
+	switch b.state {
+	case BreakerHalfOpen:
+		if b.probesInFlight > 0 {
+			b.probesInFlight--
+		}
+		if failed || slow {
+			b.open(now)
+			return
+		}
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.config.Probes {
+			b.state = BreakerClosed
+			b.resetWindow(now)
+		}
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.config.Window {
+			b.resetWindow(now)
+		}
+		b.total++
+		if failed {
+			b.failures++
+		}
+		if slow {
+			b.slow++
+		}
+		if b.total < b.config.MinRequests {
+			return
+		}
+		if float64(b.failures)/float64(b.total) >= b.config.FailureRate ||
+			(b.config.SlowCallRate > 0 && float64(b.slow)/float64(b.total) >= b.config.SlowCallRate) {
+			b.open(now)
+		}
+	}
+}
+
+// release frees the probe taken by a call whose outcome says nothing about the server
+// (eg.: the caller gave up), so it is not recorded
+func (b *breaker) release() {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == BreakerHalfOpen && b.probesInFlight > 0 {
+		b.probesInFlight--
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.probesInFlight = 0
+	b.probeSuccesses = 0
+	b.resetWindow(now)
+}
+
+func (b *breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.total, b.failures, b.slow = 0, 0, 0
+}
+
+// checkBreakerConfig reads a breaker configuration from the table at idx,
+// missing fields use the values from DefaultBreakerConfig
+func checkBreakerConfig(L *lua.LState, idx int) BreakerConfig {
+	cfg := DefaultBreakerConfig()
+	tbl := L.OptTable(idx, L.NewTable())
+	number := func(name string, set func(float64)) {
+		if n, ok := tbl.RawGetString(name).(lua.LNumber); ok {
+			set(float64(n))
+		}
+	}
+	number("failureRate", func(v float64) { cfg.FailureRate = v })
+	number("slowCall", func(v float64) { cfg.SlowCall = secondsToDuration(v) })
+	number("slowCallRate", func(v float64) { cfg.SlowCallRate = v })
+	number("minRequests", func(v float64) { cfg.MinRequests = int(v) })
+	number("window", func(v float64) { cfg.Window = secondsToDuration(v) })
+	number("coolDown", func(v float64) { cfg.CoolDown = secondsToDuration(v) })
+	number("probes", func(v float64) { cfg.Probes = int(v) })
+	cfg.PerEndpoint = lua.LVAsString(tbl.RawGetString("per")) == "endpoint"
+	if cfg.Probes < 1 {
+		cfg.Probes = 1
+	}
+	if cfg.MinRequests < 1 {
+		cfg.MinRequests = 1
+	}
+	return cfg
+}
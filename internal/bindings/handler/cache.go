@@ -0,0 +1,438 @@
+package handler
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrebq/learn-system-design/internal/mutex"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	EvictLRU = "lru"
+	EvictLFU = "lfu"
+	EvictTTL = "ttl"
+
+	cacheTypeName = "cache.cache"
+
+	// DefaultCacheSize is the number of entries of caches created without a size
+	DefaultCacheSize = 1000
+)
+
+type (
+	// Caches holds the named caches of an instance
+	Caches struct {
+		mutex.Zone
+		caches map[string]*cache
+	}
+
+	// CacheConfig controls the size and eviction policy of a cache
+	CacheConfig struct {
+		// Size is the maximum number of entries
+		Size int
+		// Policy decides which entry is evicted when the cache is full (lru, lfu or ttl)
+		Policy string
+		// TTL is how long entries are kept, use 0 to keep them until they are evicted
+		TTL time.Duration
+		// NegativeTTL is how long a missing value is remembered, use 0 to disable negative caching
+		NegativeTTL time.Duration
+		// Coalesce makes concurrent loads of the same key wait for the first one,
+		// instead of all of them hitting the origin (a cache stampede)
+		Coalesce bool
+	}
+
+	// CacheStats counts how a cache is being used
+	CacheStats struct {
+		Hits      int64
+		Misses    int64
+		Evictions int64
+		Entries   int64
+	}
+
+	cache struct {
+		sync.Mutex
+		config  CacheConfig
+		entries map[string]*cacheEntry
+		order   cacheHeap
+		seq     uint64
+		loading map[string]chan struct{}
+		stats   CacheStats
+	}
+
+	cacheEntry struct {
+		key       string
+		value     interface{}
+		negative  bool
+		expiresAt time.Time
+		freq      int64
+		lastUsed  uint64
+		index     int
+	}
+
+	// cacheHeap keeps the next entry to be evicted at the top
+	cacheHeap struct {
+		policy  string
+		entries []*cacheEntry
+	}
+)
+
+func NewCaches() *Caches {
+	return &Caches{caches: make(map[string]*cache)}
+}
+
+// Cache returns the named cache, creating it if needed. If the cache already
+// exists with a different configuration, it is replaced by an empty one.
+func (c *Caches) Cache(name string, cfg CacheConfig) (*cache, error) {
+	if err := cfg.normalize(); err != nil {
+		return nil, err
+	}
+	var ch *cache
+	mutex.Run(c.Exclusive(), func() {
+		ch = c.caches[name]
+		if ch == nil || ch.config != cfg {
+			ch = newCache(cfg)
+			c.caches[name] = ch
+		}
+	})
+	return ch, nil
+}
+
+// Stats returns the statistics of each cache, keyed by name
+func (c *Caches) Stats() map[string]CacheStats {
+	var names []string
+	var caches []*cache
+	mutex.Run(c.Shared(), func() {
+		for k, v := range c.caches {
+			names = append(names, k)
+			caches = append(caches, v)
+		}
+	})
+	if len(names) == 0 {
+		return nil
+	}
+	stats := make(map[string]CacheStats, len(names))
+	for i, name := range names {
+		stats[name] = caches[i].statistics()
+	}
+	return stats
+}
+
+func (c *CacheConfig) normalize() error {
+	c.Policy = strings.ToLower(c.Policy)
+	switch c.Policy {
+	case "":
+		c.Policy = EvictLRU
+	case EvictLRU, EvictLFU, EvictTTL:
+	default:
+		return fmt.Errorf("cache: unknown eviction policy %q", c.Policy)
+	}
+	if c.Size <= 0 {
+		c.Size = DefaultCacheSize
+	}
+	if c.TTL < 0 || c.NegativeTTL < 0 {
+		return fmt.Errorf("cache: ttl cannot be negative")
+	}
+	return nil
+}
+
+func newCache(cfg CacheConfig) *cache {
+	return &cache{
+		config:  cfg,
+		entries: make(map[string]*cacheEntry),
+		order:   cacheHeap{policy: cfg.Policy},
+		loading: make(map[string]chan struct{}),
+	}
+}
+
+// get returns the value of key, found is true for negative entries, which have a nil value
+func (c *cache) get(key string, now time.Time) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e := c.lookup(key, now)
+	if e == nil {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.seq++
+	e.freq++
+	e.lastUsed = c.seq
+	heap.Fix(&c.order, e.index)
+	return e.value, true
+}
+
+// lookup returns the entry for key, removing it if it expired
+func (c *cache) lookup(key string, now time.Time) *cacheEntry {
+	e := c.entries[key]
+	if e == nil {
+		return nil
+	}
+	if !e.expiresAt.IsZero() && !now.Before(e.expiresAt) {
+		c.remove(e)
+		return nil
+	}
+	return e
+}
+
+// set stores value for key, a nil value is stored as a negative entry.
+//
+// ttl overrides the TTL (or NegativeTTL) of the cache when positive.
+func (c *cache) set(key string, value interface{}, ttl time.Duration, now time.Time) {
+	negative := value == nil
+	if ttl <= 0 {
+		ttl = c.config.TTL
+		if negative {
+			ttl = c.config.NegativeTTL
+		}
+	}
+	if negative && ttl <= 0 {
+		// negative caching is disabled
+		c.delete(key)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.seq++
+	e := c.entries[key]
+	if e == nil {
+		for len(c.entries) >= c.config.Size {
+			c.remove(c.order.entries[0])
+			c.stats.Evictions++
+		}
+		e = &cacheEntry{key: key}
+		c.entries[key] = e
+		heap.Push(&c.order, e)
+	}
+	e.value, e.negative = value, negative
+	e.expiresAt = time.Time{}
+	if ttl > 0 {
+		e.expiresAt = now.Add(ttl)
+	}
+	e.freq++
+	e.lastUsed = c.seq
+	heap.Fix(&c.order, e.index)
+}
+
+func (c *cache) delete(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	e := c.entries[key]
+	if e == nil {
+		return false
+	}
+	c.remove(e)
+	return true
+}
+
+func (c *cache) remove(e *cacheEntry) {
+	heap.Remove(&c.order, e.index)
+	delete(c.entries, e.key)
+}
+
+// startLoad returns nil if the caller should load key, otherwise it returns
+// a channel which is closed once the load in progress is done.
+//
+// Loads are only coalesced if the cache is configured to do so.
+func (c *cache) startLoad(key string) <-chan struct{} {
+	if !c.config.Coalesce {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	if ch, ok := c.loading[key]; ok {
+		return ch
+	}
+	c.loading[key] = make(chan struct{})
+	return nil
+}
+
+func (c *cache) endLoad(key string) {
+	if !c.config.Coalesce {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if ch, ok := c.loading[key]; ok {
+		close(ch)
+		delete(c.loading, key)
+	}
+}
+
+func (c *cache) statistics() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	s := c.stats
+	s.Entries = int64(len(c.entries))
+	return s
+}
+
+func (h cacheHeap) Len() int { return len(h.entries) }
+
+func (h cacheHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	switch h.policy {
+	case EvictLFU:
+		if a.freq != b.freq {
+			return a.freq < b.freq
+		}
+	case EvictTTL:
+		if ea, eb := expiration(a), expiration(b); ea != eb {
+			return ea < eb
+		}
+	}
+	return a.lastUsed < b.lastUsed
+}
+
+func (h cacheHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *cacheHeap) Push(x interface{}) {
+	e := x.(*cacheEntry)
+	e.index = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *cacheHeap) Pop() interface{} {
+	last := len(h.entries) - 1
+	e := h.entries[last]
+	h.entries[last] = nil
+	h.entries = h.entries[:last]
+	e.index = -1
+	return e
+}
+
+// expiration returns when e expires, entries without TTL expire last
+func expiration(e *cacheEntry) int64 {
+	if e.expiresAt.IsZero() {
+		return math.MaxInt64
+	}
+	return e.expiresAt.UnixNano()
+}
+
+// CacheLoader exposes caches as the "cache" module, ctx is used to stop
+// waiting for loads made by other requests
+func CacheLoader(ctx context.Context, caches *Caches) func(L *lua.LState) int {
+	return func(L *lua.LState) int {
+		check := func(L *lua.LState) *cache {
+			c, ok := L.CheckUserData(1).Value.(*cache)
+			if !ok {
+				L.ArgError(1, "cache expected")
+			}
+			return c
+		}
+		registerType(L, cacheTypeName, map[string]lua.LGFunction{
+			"get": func(L *lua.LState) int {
+				value, found := check(L).get(L.CheckString(2), time.Now())
+				L.Push(toLuaValue(L, value))
+				L.Push(lua.LBool(found))
+				return 2
+			},
+			"set": func(L *lua.LState) int {
+				c := check(L)
+				key := L.CheckString(2)
+				value := checkShareable(L, 3)
+				c.set(key, value, secondsToDuration(float64(L.OptNumber(4, 0))), time.Now())
+				return 0
+			},
+			"delete": func(L *lua.LState) int {
+				L.Push(lua.LBool(check(L).delete(L.CheckString(2))))
+				return 1
+			},
+			"getOrLoad": func(L *lua.LState) int {
+				c := check(L)
+				key := L.CheckString(2)
+				ttl := secondsToDuration(float64(L.OptNumber(3, 0)))
+				fn := L.CheckFunction(4)
+				for {
+					if value, found := c.get(key, time.Now()); found {
+						L.Push(toLuaValue(L, value))
+						L.Push(lua.LNil)
+						return 2
+					}
+					wait := c.startLoad(key)
+					if wait == nil {
+						break
+					}
+					select {
+					case <-wait:
+					case <-ctx.Done():
+						L.Push(lua.LNil)
+						L.Push(lua.LString(ctx.Err().Error()))
+						return 2
+					}
+				}
+				defer c.endLoad(key)
+				L.Push(fn)
+				L.Push(lua.LString(key))
+				if err := L.PCall(1, 2, nil); err != nil {
+					L.RaiseError("%v", err.Error())
+					return 0
+				}
+				value, loadErr := L.Get(-2), L.Get(-1)
+				L.Pop(2)
+				if loadErr != lua.LNil {
+					// errors are not cached, so the next call tries again
+					L.Push(lua.LNil)
+					L.Push(loadErr)
+					return 2
+				}
+				shareable, err := toGoValue(value)
+				if err != nil {
+					L.RaiseError("cache: unable to store value, cause %v", err)
+					return 0
+				}
+				c.set(key, shareable, ttl, time.Now())
+				L.Push(value)
+				L.Push(lua.LNil)
+				return 2
+			},
+			"stats": func(L *lua.LState) int {
+				s := check(L).statistics()
+				L.Push(cacheStatsToTable(L, s))
+				return 1
+			},
+		})
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"new": func(L *lua.LState) int {
+				tbl := L.CheckTable(1)
+				name := lua.LVAsString(tbl.RawGetString("name"))
+				if name == "" {
+					L.ArgError(1, "name is required")
+					return 0
+				}
+				c, err := caches.Cache(name, CacheConfig{
+					Size:        int(lua.LVAsNumber(tbl.RawGetString("size"))),
+					Policy:      lua.LVAsString(tbl.RawGetString("policy")),
+					TTL:         secondsToDuration(float64(lua.LVAsNumber(tbl.RawGetString("ttl")))),
+					NegativeTTL: secondsToDuration(float64(lua.LVAsNumber(tbl.RawGetString("negativeTtl")))),
+					Coalesce:    lua.LVAsBool(tbl.RawGetString("coalesce")),
+				})
+				if err != nil {
+					L.ArgError(1, err.Error())
+					return 0
+				}
+				L.Push(newTypedUserData(L, c, cacheTypeName))
+				return 1
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+func cacheStatsToTable(L *lua.LState, s CacheStats) *lua.LTable {
+	tbl := L.CreateTable(0, 4)
+	tbl.RawSetString("hits", lua.LNumber(s.Hits))
+	tbl.RawSetString("misses", lua.LNumber(s.Misses))
+	tbl.RawSetString("evictions", lua.LNumber(s.Evictions))
+	tbl.RawSetString("entries", lua.LNumber(s.Entries))
+	return tbl
+}
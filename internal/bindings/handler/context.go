@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"context"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type (
+	// countingContext is set as the context of states which count the instructions
+	// they execute, the VM calls Done before every instruction.
+	//
+	// Go functions must not wait on it, otherwise waiting would be counted as
+	// instructions, they use Context(L) instead.
+	countingContext struct {
+		context.Context
+		count func()
+	}
+)
+
+// Done is only called by the VM
+func (c *countingContext) Done() <-chan struct{} {
+	c.count()
+	return c.Context.Done()
+}
+
+// SetCountingContext sets ctx as the context of L, count is called before
+// every instruction executed by L
+func SetCountingContext(L *lua.LState, ctx context.Context, count func()) {
+	L.SetContext(&countingContext{Context: ctx, count: count})
+}
+
+// Context returns the context used by Go functions called from L,
+// it returns nil if L doesn't have a context
+func Context(L *lua.LState) context.Context {
+	if c, ok := L.Context().(*countingContext); ok {
+		return c.Context
+	}
+	return L.Context()
+}
+
+// setContext replaces the context of L, instructions are still counted if they were before
+func setContext(L *lua.LState, ctx context.Context) {
+	if c, ok := L.Context().(*countingContext); ok {
+		L.SetContext(&countingContext{Context: ctx, count: c.count})
+		return
+	}
+	L.SetContext(ctx)
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// maxConvertDepth limits how deep nested tables can be when moving
+	// values between a Lua state and Go
+	maxConvertDepth = 32
+)
+
+// toGoValue copies a Lua value into a plain Go value (nil, bool, float64, string,
+// []interface{} or map[string]interface{}) which can be safely shared between
+// different Lua states.
+//
+// Functions, userdata, threads and channels cannot be converted.
+func toGoValue(lv lua.LValue) (interface{}, error) {
+	return toGoValueDepth(lv, 0)
+}
+
+func toGoValueDepth(lv lua.LValue, depth int) (interface{}, error) {
+	if depth > maxConvertDepth {
+		return nil, fmt.Errorf("value is nested too deep (max %v levels)", maxConvertDepth)
+	}
+	switch lv := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(lv), nil
+	case lua.LNumber:
+		return float64(lv), nil
+	case lua.LString:
+		return string(lv), nil
+	case *lua.LTable:
+		if isArray(lv) {
+			arr := make([]interface{}, 0, lv.Len())
+			for i := 1; i <= lv.Len(); i++ {
+				gv, err := toGoValueDepth(lv.RawGetInt(i), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, gv)
+			}
+			return arr, nil
+		}
+		obj := make(map[string]interface{})
+		var err error
+		lv.ForEach(func(k, v lua.LValue) {
+			if err != nil {
+				return
+			}
+			var gv interface{}
+			gv, err = toGoValueDepth(v, depth+1)
+			obj[k.String()] = gv
+		})
+		return obj, err
+	}
+	return nil, fmt.Errorf("values of type %v cannot be shared", lv.Type())
+}
+
+// isArray returns true if the table only contains consecutive integer keys starting at 1.
+// Empty tables are considered arrays.
+func isArray(tbl *lua.LTable) bool {
+	count := 0
+	array := true
+	tbl.ForEach(func(k, _ lua.LValue) {
+		count++
+		if n, ok := k.(lua.LNumber); !ok || float64(n) != float64(int(n)) || n < 1 {
+			array = false
+		}
+	})
+	return array && count == tbl.Len()
+}
+
+// toLuaValue converts a Go value produced by toGoValue (or encoding/json) back into
+// a Lua value owned by L.
+func toLuaValue(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		tbl := L.CreateTable(len(v), 0)
+		// Append skips nil values, which would move the items after them
+		for i, item := range v {
+			tbl.RawSetInt(i+1, toLuaValue(L, item))
+		}
+		return tbl
+	case map[string]interface{}:
+		tbl := L.CreateTable(0, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			tbl.RawSetString(k, toLuaValue(L, v[k]))
+		}
+		return tbl
+	}
+	return lua.LString(fmt.Sprintf("%v", v))
+}
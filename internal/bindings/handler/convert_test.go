@@ -0,0 +1,21 @@
+package handler
+
+import (
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestToLuaValueKeepsIndexes(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	tbl, ok := toLuaValue(L, []interface{}{1.0, nil, 3.0}).(*lua.LTable)
+	if !ok {
+		t.Fatal("arrays should be converted to tables")
+	}
+	for i, expected := range []lua.LValue{lua.LNumber(1), lua.LNil, lua.LNumber(3)} {
+		if v := tbl.RawGetInt(i + 1); v != expected {
+			t.Errorf("item %v should be %v got %v", i+1, expected, v)
+		}
+	}
+}
@@ -2,25 +2,66 @@ package handler
 
 import (
 	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/andrebq/learn-system-design/internal/randdist"
 	lua "github.com/yuin/gopher-lua"
 )
 
+const (
+	// MaxAllocSize is the largest allocation a single call to computations.alloc can make
+	MaxAllocSize = 1 << 30
+
+	// pageSize is used to touch allocated memory, so it is actually committed by the OS
+	pageSize = 4096
+	// cpuCheckInterval is how often computations.cpu checks if the request was cancelled
+	cpuCheckInterval = time.Millisecond
+)
+
+var (
+	calibration struct {
+		sync.Once
+		iterationsPerMs int
+	}
+
+	// cpuSink prevents the compiler from removing the busy loop
+	cpuSink uint64
+)
+
 func FakeComputations(ctx context.Context) func(*lua.LState) int {
 	return func(L *lua.LState) int {
 		// register functions to the table
 		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 			"slow": func(L *lua.LState) int {
-				seconds := time.Duration(L.CheckNumber(1)) * time.Second
-				select {
-				case <-ctx.Done():
-					L.Push(lua.LFalse)
-				case <-time.After(seconds):
-					L.Push(lua.LTrue)
-				}
+				L.Push(lua.LBool(sleep(ctx, secondsToDuration(float64(L.CheckNumber(1))))))
 				return 1
 			},
+			"sleep": func(L *lua.LState) int {
+				d := checkDistribution(L, 1)
+				seconds := d.Sample()
+				L.Push(lua.LBool(sleep(ctx, secondsToDuration(seconds))))
+				L.Push(lua.LNumber(seconds))
+				return 2
+			},
+			"cpu": func(L *lua.LState) int {
+				start := time.Now()
+				ok := burnCPU(ctx, float64(L.CheckNumber(1)))
+				L.Push(lua.LBool(ok))
+				L.Push(lua.LNumber(time.Since(start).Seconds()))
+				return 2
+			},
+			"alloc": func(L *lua.LState) int {
+				size := L.CheckInt(1)
+				if size < 0 || size > MaxAllocSize {
+					L.ArgError(1, "size must be between 0 and 1GiB")
+					return 0
+				}
+				hold(alloc(size), secondsToDuration(float64(L.OptNumber(2, 0))))
+				return 0
+			},
 		})
 
 		// returns the module
@@ -28,3 +69,111 @@ func FakeComputations(ctx context.Context) func(*lua.LState) int {
 		return 1
 	}
 }
+
+// checkDistribution reads a distribution (in seconds) from the stack,
+// a number is interpreted as a constant distribution.
+func checkDistribution(L *lua.LState, idx int) randdist.Distribution {
+	var d randdist.Distribution
+	switch v := L.CheckAny(idx).(type) {
+	case lua.LNumber:
+		d = randdist.Distribution{Kind: randdist.Fixed, Mean: float64(v)}
+	case *lua.LTable:
+		number := func(name string) float64 {
+			return float64(lua.LVAsNumber(v.RawGetString(name)))
+		}
+		d = randdist.Distribution{
+			Kind:   lua.LVAsString(v.RawGetString("kind")),
+			Min:    number("min"),
+			Max:    number("max"),
+			Mean:   number("mean"),
+			StdDev: number("stdDev"),
+			Shape:  number("shape"),
+		}
+	default:
+		L.ArgError(idx, "distribution must be a number or table")
+	}
+	if err := d.Validate(); err != nil {
+		L.ArgError(idx, err.Error())
+	}
+	return d
+}
+
+// sleep waits for d, returns false if ctx is done before that
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// burnCPU executes the amount of work an idle core completes in ms milliseconds.
+//
+// Since the amount of work is fixed, instead of the time spent, requests take longer
+// when goroutines compete for the available processors (GOMAXPROCS).
+func burnCPU(ctx context.Context, ms float64) bool {
+	calibration.Do(calibrate)
+	remaining := int(ms * float64(calibration.iterationsPerMs))
+	chunk := int(cpuCheckInterval/time.Millisecond) * calibration.iterationsPerMs
+	for remaining > 0 {
+		if ctx.Err() != nil {
+			return false
+		}
+		n := chunk
+		if remaining < n {
+			n = remaining
+		}
+		spin(n)
+		remaining -= n
+	}
+	return true
+}
+
+// calibrate measures how many iterations of spin fit in one millisecond
+func calibrate() {
+	const sample = 20 * time.Millisecond
+	iterations := 0
+	start := time.Now()
+	for time.Since(start) < sample {
+		spin(10_000)
+		iterations += 10_000
+	}
+	calibration.iterationsPerMs = int(float64(iterations) / (float64(time.Since(start)) / float64(time.Millisecond)))
+	if calibration.iterationsPerMs < 1 {
+		calibration.iterationsPerMs = 1
+	}
+}
+
+func spin(n int) {
+	var x uint64
+	for i := 0; i < n; i++ {
+		x ^= x<<13 + uint64(i)
+		x ^= x >> 7
+	}
+	atomic.AddUint64(&cpuSink, x)
+}
+
+// alloc returns a buffer of the given size, with all its pages touched
+func alloc(size int) []byte {
+	buf := make([]byte, size)
+	for i := 0; i < len(buf); i += pageSize {
+		buf[i] = 1
+	}
+	return buf
+}
+
+// hold keeps buf reachable for d, without blocking the caller
+func hold(buf []byte, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	time.AfterFunc(d, func() {
+		runtime.KeepAlive(buf)
+	})
+}
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/andrebq/learn-system-design/control"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	futureTypeName = "services.future"
+)
+
+type (
+	// future is a call running on its own goroutine,
+	// res and err can only be read after done is closed
+	future struct {
+		done chan struct{}
+		res  *callResult
+		err  *callError
+	}
+)
+
+// callAsync starts the call described by spec and returns without waiting for it
+func (c *Client) callAsync(ctx context.Context, options []*control.Server, spec callSpec) *future {
+	f := &future{done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		f.res, f.err = c.call(ctx, options, spec)
+	}()
+	return f
+}
+
+// wait blocks until f is done, or returns an error if ctx is done first
+func (f *future) wait(ctx context.Context) (*callResult, *callError) {
+	select {
+	case <-f.done:
+		return f.res, f.err
+	case <-ctx.Done():
+		return nil, contextError(ctx, "", ctx.Err())
+	}
+}
+
+// isDone returns true if the result of f is available
+func (f *future) isDone() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// awaitAny waits for the first future to finish and returns its index,
+// or -1 if ctx is done before any future finishes
+func awaitAny(ctx context.Context, futures []*future) (int, *callResult, *callError) {
+	cases := make([]reflect.SelectCase, 0, len(futures)+1)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+	for _, f := range futures {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(f.done)})
+	}
+	chosen, _, _ := reflect.Select(cases)
+	if chosen == 0 {
+		return -1, nil, contextError(ctx, "", ctx.Err())
+	}
+	f := futures[chosen-1]
+	return chosen - 1, f.res, f.err
+}
+
+// futureMethods returns the methods of the futures returned by services.callAsync
+func futureMethods(ctx context.Context) map[string]lua.LGFunction {
+	return map[string]lua.LGFunction{
+		"await": func(L *lua.LState) int {
+			res, err := checkFuture(L, 1).wait(callContext(ctx, L))
+			return pushCallResult(L, res, err)
+		},
+		"done": func(L *lua.LState) int {
+			L.Push(lua.LBool(checkFuture(L, 1).isDone()))
+			return 1
+		},
+	}
+}
+
+func checkFuture(L *lua.LState, idx int) *future {
+	f, ok := L.CheckUserData(idx).Value.(*future)
+	if !ok {
+		L.ArgError(idx, "future expected")
+	}
+	return f
+}
+
+// checkFutures reads all futures from idx to the top of the stack
+func checkFutures(L *lua.LState, idx int) []*future {
+	var futures []*future
+	for i := idx; i <= L.GetTop(); i++ {
+		futures = append(futures, checkFuture(L, i))
+	}
+	if len(futures) == 0 {
+		L.ArgError(idx, "at least one future is required")
+	}
+	return futures
+}
+
+// awaitAll waits for every future and pushes two tables, one with the responses
+// and another with the errors, both indexed by the position of the future
+func awaitAll(ctx context.Context, L *lua.LState, futures []*future) int {
+	results := L.CreateTable(len(futures), 0)
+	errors := L.CreateTable(len(futures), 0)
+	for i, f := range futures {
+		res, err := f.wait(ctx)
+		if err != nil {
+			errors.RawSetInt(i+1, callErrorToTable(L, err))
+			continue
+		}
+		results.RawSetInt(i+1, callResultToTable(L, res))
+	}
+	L.Push(results)
+	L.Push(errors)
+	return 2
+}
+
+// pushCallResult pushes the response of a call, or nil and the error
+func pushCallResult(L *lua.LState, res *callResult, err *callError) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(callErrorToTable(L, err))
+		return 2
+	}
+	L.Push(callResultToTable(L, res))
+	return 1
+}
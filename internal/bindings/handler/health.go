@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"sort"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type (
+	// Health holds the readiness of an instance, which is changed by scripts
+	// and by the instance itself while it drains
+	Health struct {
+		sync.Mutex
+		notReady     string
+		draining     bool
+		dependencies map[string]struct{}
+	}
+)
+
+func NewHealth() *Health {
+	return &Health{dependencies: make(map[string]struct{})}
+}
+
+// Replace takes the readiness and dependencies set by the init file which filled next,
+// it is called once the init file runs without errors. Draining is kept.
+func (h *Health) Replace(next *Health) {
+	next.Lock()
+	notReady := next.notReady
+	dependencies := make(map[string]struct{}, len(next.dependencies))
+	for s := range next.dependencies {
+		dependencies[s] = struct{}{}
+	}
+	next.Unlock()
+
+	h.Lock()
+	defer h.Unlock()
+	h.notReady = notReady
+	h.dependencies = dependencies
+}
+
+// SetReady changes the readiness set by scripts, reason explains why the instance is not ready
+func (h *Health) SetReady(ready bool, reason string) {
+	h.Lock()
+	defer h.Unlock()
+	if ready {
+		h.notReady = ""
+		return
+	}
+	if reason == "" {
+		reason = "not ready"
+	}
+	h.notReady = reason
+}
+
+// DependsOn makes the instance ready only if at least one server of each service is available
+func (h *Health) DependsOn(services ...string) {
+	h.Lock()
+	defer h.Unlock()
+	for _, s := range services {
+		h.dependencies[s] = struct{}{}
+	}
+}
+
+// Drain makes the instance not ready until it stops, there is no way back
+func (h *Health) Drain() {
+	h.Lock()
+	defer h.Unlock()
+	h.draining = true
+}
+
+// Draining returns true after Drain is called
+func (h *Health) Draining() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.draining
+}
+
+// Ready checks if the instance should receive requests, available is used to
+// check the dependencies. When it isn't ready, reason explains why.
+func (h *Health) Ready(available func(service string) bool) (ready bool, reason string) {
+	h.Lock()
+	draining, notReady := h.draining, h.notReady
+	dependencies := make([]string, 0, len(h.dependencies))
+	for s := range h.dependencies {
+		dependencies = append(dependencies, s)
+	}
+	h.Unlock()
+	switch {
+	case draining:
+		return false, "draining"
+	case notReady != "":
+		return false, notReady
+	}
+	sort.Strings(dependencies)
+	for _, s := range dependencies {
+		if !available(s) {
+			return false, "no server available for " + s
+		}
+	}
+	return true, ""
+}
+
+// HealthLoader exposes the readiness of the instance as the "health" module,
+// health returns the object changed by the module
+func HealthLoader(health func() *Health, available func(service string) bool) func(L *lua.LState) int {
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"setReady": func(L *lua.LState) int {
+				health().SetReady(L.ToBool(1), L.OptString(2, ""))
+				return 0
+			},
+			"dependsOn": func(L *lua.LState) int {
+				var services []string
+				for i := 1; i <= L.GetTop(); i++ {
+					services = append(services, L.CheckString(i))
+				}
+				health().DependsOn(services...)
+				return 0
+			},
+			"isReady": func(L *lua.LState) int {
+				ready, reason := health().Ready(available)
+				L.Push(lua.LBool(ready))
+				if ready {
+					return 1
+				}
+				L.Push(lua.LString(reason))
+				return 2
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
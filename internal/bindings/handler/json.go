@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	jsonArrayTypeName  = "json.array"
+	jsonObjectTypeName = "json.object"
+	jsonNullKey        = "json.null"
+)
+
+type (
+	// jsonNullValue is used as the value of the json.null sentinel
+	jsonNullValue struct{}
+)
+
+// JSONLoader exposes the "json" module
+func JSONLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"encode": func(L *lua.LState) int {
+			buf, err := encodeJSON(L, L.CheckAny(1))
+			if err != nil {
+				L.RaiseError("json: unable to encode value, cause %v", err)
+				return 0
+			}
+			L.Push(lua.LString(string(buf)))
+			return 1
+		},
+		"decode": func(L *lua.LState) int {
+			val, err := decodeJSON(L, []byte(L.CheckString(1)))
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(val)
+			return 1
+		},
+		"array": func(L *lua.LState) int {
+			tbl := L.OptTable(1, L.NewTable())
+			L.SetMetatable(tbl, L.NewTypeMetatable(jsonArrayTypeName))
+			L.Push(tbl)
+			return 1
+		},
+		"object": func(L *lua.LState) int {
+			tbl := L.OptTable(1, L.NewTable())
+			L.SetMetatable(tbl, L.NewTypeMetatable(jsonObjectTypeName))
+			L.Push(tbl)
+			return 1
+		},
+	})
+	L.SetField(mod, "null", jsonNull(L))
+	L.Push(mod)
+	return 1
+}
+
+// jsonNull returns the sentinel used to represent null values,
+// the same value is returned for every call on the same state.
+func jsonNull(L *lua.LState) lua.LValue {
+	reg := L.Get(lua.RegistryIndex).(*lua.LTable)
+	if null := reg.RawGetString(jsonNullKey); null != lua.LNil {
+		return null
+	}
+	ud := L.NewUserData()
+	ud.Value = jsonNullValue{}
+	reg.RawSetString(jsonNullKey, ud)
+	return ud
+}
+
+// encodeJSON converts lv to JSON.
+//
+// Tables are encoded as arrays when they only have sequential integer keys,
+// otherwise as objects. Empty tables are encoded as objects unless they were
+// created with json.array.
+func encodeJSON(L *lua.LState, lv lua.LValue) ([]byte, error) {
+	val, err := luaToJSON(L, lv, 0)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(val); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+func luaToJSON(L *lua.LState, lv lua.LValue, depth int) (interface{}, error) {
+	if depth > maxConvertDepth {
+		return nil, fmt.Errorf("value is nested too deep (max %v levels)", maxConvertDepth)
+	}
+	switch lv := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(lv), nil
+	case lua.LNumber:
+		if math.IsNaN(float64(lv)) || math.IsInf(float64(lv), 0) {
+			return nil, fmt.Errorf("%v cannot be represented in JSON", lv)
+		}
+		return float64(lv), nil
+	case lua.LString:
+		return string(lv), nil
+	case *lua.LUserData:
+		if _, ok := lv.Value.(jsonNullValue); ok {
+			return nil, nil
+		}
+	case *lua.LTable:
+		mt := L.GetMetatable(lv)
+		asArray := isArray(lv)
+		switch {
+		case mt != lua.LNil && mt == L.GetTypeMetatable(jsonArrayTypeName):
+			asArray = true
+		case mt != lua.LNil && mt == L.GetTypeMetatable(jsonObjectTypeName), lv.Len() == 0:
+			asArray = false
+		}
+		if asArray {
+			arr := make([]interface{}, 0, lv.Len())
+			for i := 1; i <= lv.Len(); i++ {
+				item, err := luaToJSON(L, lv.RawGetInt(i), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, item)
+			}
+			return arr, nil
+		}
+		obj := make(map[string]interface{})
+		var err error
+		lv.ForEach(func(k, v lua.LValue) {
+			if err != nil {
+				return
+			}
+			switch k.(type) {
+			case lua.LString, lua.LNumber:
+			default:
+				err = fmt.Errorf("keys of type %v cannot be used in JSON objects", k.Type())
+				return
+			}
+			obj[k.String()], err = luaToJSON(L, v, depth+1)
+		})
+		return obj, err
+	}
+	return nil, fmt.Errorf("values of type %v cannot be represented in JSON", lv.Type())
+}
+
+// decodeJSON parses data into a Lua value. Arrays and objects are marked
+// so they can be encoded back without changing their type, and null values
+// are represented by json.null.
+func decodeJSON(L *lua.LState, data []byte) (lua.LValue, error) {
+	var val interface{}
+	if err := json.Unmarshal(data, &val); err != nil {
+		return nil, fmt.Errorf("json: invalid input, cause %v", err)
+	}
+	return jsonToLua(L, val, 0)
+}
+
+func jsonToLua(L *lua.LState, val interface{}, depth int) (lua.LValue, error) {
+	if depth > maxConvertDepth {
+		return nil, fmt.Errorf("json: input is nested too deep (max %v levels)", maxConvertDepth)
+	}
+	switch val := val.(type) {
+	case nil:
+		return jsonNull(L), nil
+	case []interface{}:
+		tbl := L.CreateTable(len(val), 0)
+		for _, item := range val {
+			lv, err := jsonToLua(L, item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			tbl.Append(lv)
+		}
+		L.SetMetatable(tbl, L.NewTypeMetatable(jsonArrayTypeName))
+		return tbl, nil
+	case map[string]interface{}:
+		tbl := L.CreateTable(0, len(val))
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			lv, err := jsonToLua(L, val[k], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			tbl.RawSetString(k, lv)
+		}
+		L.SetMetatable(tbl, L.NewTypeMetatable(jsonObjectTypeName))
+		return tbl, nil
+	}
+	return toLuaValue(L, val), nil
+}
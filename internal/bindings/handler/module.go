@@ -3,14 +3,42 @@ package handler
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/andrebq/learn-system-design/internal/logutil"
 	lua "github.com/yuin/gopher-lua"
 )
 
+const (
+	// MaxBodySize is the largest request body that can be read by a handler
+	MaxBodySize = 1 << 20
+)
+
 func Loader(req *http.Request, res http.ResponseWriter) func(L *lua.LState) int {
+	var body []byte
+	var bodyErr error
+	var bodyRead bool
+	readBody := func(limit int64) ([]byte, error) {
+		if !bodyRead {
+			bodyRead = true
+			if req.Body != nil {
+				// read one extra byte to detect bodies which are too large
+				body, bodyErr = ioutil.ReadAll(io.LimitReader(req.Body, MaxBodySize+1))
+			}
+		}
+		if bodyErr != nil {
+			return nil, bodyErr
+		}
+		if int64(len(body)) > limit {
+			return nil, fmt.Errorf("request body is larger than %v bytes", limit)
+		}
+		return body, nil
+	}
 	return func(L *lua.LState) int {
 		// register functions to the table
 		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
@@ -20,6 +48,92 @@ func Loader(req *http.Request, res http.ResponseWriter) func(L *lua.LState) int
 				L.Push(ud)
 				return 1
 			},
+			"method": func(L *lua.LState) int {
+				L.Push(lua.LString(req.Method))
+				return 1
+			},
+			"path": func(L *lua.LState) int {
+				L.Push(lua.LString(req.URL.Path))
+				return 1
+			},
+			"host": func(L *lua.LState) int {
+				L.Push(lua.LString(req.Host))
+				return 1
+			},
+			"remoteAddr": func(L *lua.LState) int {
+				L.Push(lua.LString(req.RemoteAddr))
+				return 1
+			},
+			"query": func(L *lua.LState) int {
+				query := req.URL.Query()
+				if L.GetTop() == 0 {
+					L.Push(valuesToTable(L, query))
+					return 1
+				}
+				name := L.CheckString(1)
+				if _, ok := query[name]; !ok {
+					L.Push(lua.LNil)
+					return 1
+				}
+				L.Push(lua.LString(query.Get(name)))
+				return 1
+			},
+			"header": func(L *lua.LState) int {
+				values := req.Header.Values(L.CheckString(1))
+				if len(values) == 0 {
+					L.Push(lua.LNil)
+					return 1
+				}
+				L.Push(lua.LString(strings.Join(values, ", ")))
+				return 1
+			},
+			"headers": func(L *lua.LState) int {
+				L.Push(valuesToTable(L, req.Header))
+				return 1
+			},
+			"cookie": func(L *lua.LState) int {
+				c, err := req.Cookie(L.CheckString(1))
+				if err != nil {
+					L.Push(lua.LNil)
+					return 1
+				}
+				L.Push(lua.LString(c.Value))
+				return 1
+			},
+			"cookies": func(L *lua.LState) int {
+				tbl := L.NewTable()
+				for _, c := range req.Cookies() {
+					tbl.RawSetString(c.Name, lua.LString(c.Value))
+				}
+				L.Push(tbl)
+				return 1
+			},
+			"deadline": func(L *lua.LState) int {
+				// returns how many seconds are left to answer the request,
+				// and the deadline as seconds since the epoch
+				deadline, ok := req.Context().Deadline()
+				if !ok {
+					L.Push(lua.LNil)
+					return 1
+				}
+				L.Push(lua.LNumber(time.Until(deadline).Seconds()))
+				L.Push(lua.LNumber(float64(deadline.UnixNano()) / float64(time.Second)))
+				return 2
+			},
+			"body": func(L *lua.LState) int {
+				limit := L.OptInt64(1, MaxBodySize)
+				if limit > MaxBodySize || limit <= 0 {
+					limit = MaxBodySize
+				}
+				buf, err := readBody(limit)
+				if err != nil {
+					L.Push(lua.LNil)
+					L.Push(lua.LString(err.Error()))
+					return 2
+				}
+				L.Push(lua.LString(string(buf)))
+				return 1
+			},
 			"addHeader": func(L *lua.LState) int {
 				key := L.CheckString(1)
 				value := L.CheckString(2)
@@ -31,6 +145,33 @@ func Loader(req *http.Request, res http.ResponseWriter) func(L *lua.LState) int
 				res.WriteHeader(status)
 				return 0
 			},
+			"writeJSON": func(L *lua.LState) int {
+				status := L.CheckInt(1)
+				buf, err := encodeJSON(L, L.CheckAny(2))
+				if err != nil {
+					L.RaiseError("handler: unable to encode response as JSON, cause %v", err)
+					return 0
+				}
+				res.Header().Set("Content-Type", "application/json; charset=utf-8")
+				res.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+				res.WriteHeader(status)
+				res.Write(buf)
+				return 0
+			},
+			"readJSON": func(L *lua.LState) int {
+				buf, err := readBody(MaxBodySize)
+				if err == nil {
+					var val lua.LValue
+					val, err = decodeJSON(L, buf)
+					if err == nil {
+						L.Push(val)
+						return 1
+					}
+				}
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			},
 			"writeBody": func(L *lua.LState) int {
 				body := L.CheckString(1)
 				io.WriteString(res, body)
@@ -60,3 +201,18 @@ func Loader(req *http.Request, res http.ResponseWriter) func(L *lua.LState) int
 		return 1
 	}
 }
+
+// valuesToTable converts headers or query values to a table,
+// multiple values for the same key are joined by ", "
+func valuesToTable(L *lua.LState, values map[string][]string) *lua.LTable {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tbl := L.CreateTable(0, len(keys))
+	for _, k := range keys {
+		tbl.RawSetString(k, lua.LString(strings.Join(values[k], ", ")))
+	}
+	return tbl
+}
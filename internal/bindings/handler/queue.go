@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/andrebq/learn-system-design/control"
+	lua "github.com/yuin/gopher-lua"
+)
+
+var (
+	errNoBroker = errors.New("queue: no control plane configured")
+)
+
+type (
+	// Subscription delivers the messages published to Topic to Fn,
+	// messages are acknowledged once Fn returns without errors
+	Subscription struct {
+		Topic             string
+		Group             string
+		Fn                *lua.LFunction
+		VisibilityTimeout time.Duration
+		MaxAttempts       int
+	}
+
+	// Subscriptions collects the subscriptions made while running the init file
+	Subscriptions struct {
+		// Group is used by subscriptions that don't choose a consumer group
+		Group string
+		List  []*Subscription
+	}
+)
+
+// QueueLoader exposes the broker of the control plane as the "queue" module.
+//
+// subs is only provided to the init file, since subscriptions outlive requests.
+func QueueLoader(ctx context.Context, controlEndpoint string, subs *Subscriptions) func(L *lua.LState) int {
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"publish": func(L *lua.LState) int {
+				topic := L.CheckString(1)
+				body, err := encodeJSON(L, L.CheckAny(2))
+				if err != nil {
+					L.ArgError(2, err.Error())
+					return 0
+				}
+				if controlEndpoint == "" {
+					L.Push(lua.LNil)
+					L.Push(lua.LString(errNoBroker.Error()))
+					return 2
+				}
+				msg, err := control.Publish(callContext(ctx, L), controlEndpoint, topic, body)
+				if err != nil {
+					L.Push(lua.LNil)
+					L.Push(lua.LString(err.Error()))
+					return 2
+				}
+				L.Push(lua.LString(msg.ID))
+				return 1
+			},
+			"subscribe": func(L *lua.LState) int {
+				if subs == nil {
+					L.RaiseError("queue: subscribe can only be called from the init file")
+					return 0
+				}
+				sub := &Subscription{
+					Topic:             L.CheckString(1),
+					Fn:                L.CheckFunction(2),
+					Group:             subs.Group,
+					VisibilityTimeout: control.DefaultVisibilityTimeout,
+					MaxAttempts:       control.DefaultMaxAttempts,
+				}
+				opts := L.OptTable(3, L.NewTable())
+				if group := lua.LVAsString(opts.RawGetString("group")); group != "" {
+					sub.Group = group
+				}
+				if n, ok := opts.RawGetString("visibilityTimeout").(lua.LNumber); ok {
+					// the broker would use its default, so the consumer must not pick another value
+					if n <= 0 {
+						L.ArgError(3, "visibilityTimeout must be positive")
+						return 0
+					}
+					sub.VisibilityTimeout = secondsToDuration(float64(n))
+				}
+				if n, ok := opts.RawGetString("maxAttempts").(lua.LNumber); ok {
+					sub.MaxAttempts = int(n)
+				}
+				subs.List = append(subs.List, sub)
+				return 0
+			},
+			"deadLetter": func(L *lua.LState) int {
+				L.Push(lua.LString(L.CheckString(1) + control.DeadLetterSuffix))
+				return 1
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+// Deliver calls the function of sub with the decoded body of msg and its metadata.
+//
+// It returns an error if the function raised an error or returned false,
+// in which case the message should be delivered again.
+func Deliver(L *lua.LState, sub *Subscription, msg *control.QueueMessage) error {
+	body, err := decodeJSON(L, msg.Body)
+	if err != nil {
+		return err
+	}
+	meta := L.CreateTable(0, 4)
+	meta.RawSetString("id", lua.LString(msg.ID))
+	meta.RawSetString("topic", lua.LString(msg.Topic))
+	meta.RawSetString("group", lua.LString(sub.Group))
+	meta.RawSetString("attempts", lua.LNumber(msg.Attempts))
+	if err := L.CallByParam(lua.P{
+		Fn:      sub.Fn,
+		NRet:    1,
+		Protect: true,
+	}, body, meta); err != nil {
+		return err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	if ret == lua.LFalse {
+		return fmt.Errorf("queue: message %v was rejected by the subscriber", msg.ID)
+	}
+	return nil
+}
@@ -0,0 +1,450 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrebq/learn-system-design/internal/mutex"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	AlgorithmTokenBucket = "token_bucket"
+	AlgorithmLeakyBucket = "leaky_bucket"
+	AlgorithmFixedWindow = "fixed_window"
+	AlgorithmSlidingLog  = "sliding_log"
+
+	limiterTypeName = "ratelimit.limiter"
+
+	// maxLimiterKeys is how many keys a limiter tracks before removing idle ones
+	maxLimiterKeys = 10_000
+)
+
+type (
+	// RateLimiters holds the named limiters of an instance,
+	// so their state is shared across requests
+	RateLimiters struct {
+		mutex.Zone
+		limiters map[string]*limiter
+		// trusted proxies can set the client address with X-Forwarded-For
+		trusted []*net.IPNet
+	}
+
+	// LimiterConfig describes how many requests are allowed
+	LimiterConfig struct {
+		Algorithm string
+		// Limit is how many requests are allowed in each period
+		Limit int
+		// Period over which Limit is computed
+		Period time.Duration
+		// Burst is the capacity of token and leaky buckets (defaults to Limit)
+		Burst int
+		// KeyBy is used when a script doesn't provide a key, it can be "ip"
+		// (the client address) or "header:<name>"
+		KeyBy string
+	}
+
+	// LimitResult is the outcome of taking from a limiter
+	LimitResult struct {
+		Allowed   bool
+		Limit     int
+		Remaining int
+		// Reset is how long until the limiter is back to its full capacity
+		Reset time.Duration
+		// RetryAfter is how long until the next request might be allowed
+		RetryAfter time.Duration
+	}
+
+	limiter struct {
+		sync.Mutex
+		config LimiterConfig
+		keys   map[string]*limiterKey
+	}
+
+	limiterKey struct {
+		// level is the number of tokens (token bucket), the amount of water
+		// (leaky bucket) or the number of requests (fixed window)
+		level float64
+		last  time.Time
+		// log has the timestamps of accepted requests (sliding log)
+		log []time.Time
+	}
+)
+
+func NewRateLimiters() *RateLimiters {
+	return &RateLimiters{limiters: make(map[string]*limiter)}
+}
+
+// TrustProxies allows requests coming from the given networks to set the
+// address of the client with the X-Forwarded-For header, it must be called
+// before limiters are used
+func (r *RateLimiters) TrustProxies(networks []*net.IPNet) {
+	r.trusted = networks
+}
+
+// ParseNetworks parses a list of CIDRs or IP addresses
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if ip := net.ParseIP(v); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("ratelimit: invalid address or network %q", v)
+		}
+		out = append(out, network)
+	}
+	return out, nil
+}
+
+// Limiter returns the named limiter, creating it if needed. If the limiter already
+// exists with a different configuration, it is replaced.
+func (r *RateLimiters) Limiter(name string, cfg LimiterConfig) (*limiter, error) {
+	if err := cfg.normalize(); err != nil {
+		return nil, err
+	}
+	var l *limiter
+	mutex.Run(r.Exclusive(), func() {
+		l = r.limiters[name]
+		if l == nil || l.config != cfg {
+			l = &limiter{config: cfg, keys: make(map[string]*limiterKey)}
+			r.limiters[name] = l
+		}
+	})
+	return l, nil
+}
+
+func (r *RateLimiters) get(name string) *limiter {
+	var l *limiter
+	mutex.Run(r.Shared(), func() {
+		l = r.limiters[name]
+	})
+	return l
+}
+
+func (c *LimiterConfig) normalize() error {
+	c.Algorithm = strings.ToLower(c.Algorithm)
+	switch c.Algorithm {
+	case "":
+		c.Algorithm = AlgorithmTokenBucket
+	case AlgorithmTokenBucket, AlgorithmLeakyBucket, AlgorithmFixedWindow, AlgorithmSlidingLog:
+	default:
+		return fmt.Errorf("ratelimit: unknown algorithm %q", c.Algorithm)
+	}
+	if c.Limit <= 0 {
+		return fmt.Errorf("ratelimit: limit must be positive")
+	}
+	if c.Period <= 0 {
+		c.Period = time.Second
+	}
+	if c.Burst <= 0 {
+		c.Burst = c.Limit
+	}
+	if c.KeyBy != "" && c.KeyBy != "ip" && !strings.HasPrefix(c.KeyBy, "header:") {
+		return fmt.Errorf("ratelimit: key must be ip or header:<name>, got %q", c.KeyBy)
+	}
+	return nil
+}
+
+// rate returns how many requests are allowed per second
+func (c LimiterConfig) rate() float64 {
+	return float64(c.Limit) / c.Period.Seconds()
+}
+
+// capacity returns how many units can be taken at once
+func (c LimiterConfig) capacity() int {
+	switch c.Algorithm {
+	case AlgorithmTokenBucket, AlgorithmLeakyBucket:
+		return c.Burst
+	}
+	return c.Limit
+}
+
+// take tries to consume cost units for key
+func (l *limiter) take(key string, cost int, now time.Time) LimitResult {
+	l.Lock()
+	defer l.Unlock()
+	k := l.keys[key]
+	if k == nil {
+		l.cleanup(now)
+		k = &limiterKey{last: now}
+		switch l.config.Algorithm {
+		case AlgorithmTokenBucket:
+			k.level = float64(l.config.Burst)
+		}
+		l.keys[key] = k
+	}
+	switch l.config.Algorithm {
+	case AlgorithmLeakyBucket:
+		return l.leakyBucket(k, cost, now)
+	case AlgorithmFixedWindow:
+		return l.fixedWindow(k, cost, now)
+	case AlgorithmSlidingLog:
+		return l.slidingLog(k, cost, now)
+	}
+	return l.tokenBucket(k, cost, now)
+}
+
+func (l *limiter) tokenBucket(k *limiterKey, cost int, now time.Time) LimitResult {
+	capacity := float64(l.config.Burst)
+	rate := l.config.rate()
+	k.level = math.Min(capacity, k.level+now.Sub(k.last).Seconds()*rate)
+	k.last = now
+	res := LimitResult{Limit: l.config.Burst}
+	if k.level >= float64(cost) {
+		k.level -= float64(cost)
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsToDuration((float64(cost) - k.level) / rate)
+	}
+	res.Remaining = int(k.level)
+	res.Reset = secondsToDuration((capacity - k.level) / rate)
+	return res
+}
+
+// leakyBucket works as a meter: each request adds water to the bucket, which leaks at a constant rate,
+// requests that would overflow the bucket are rejected
+func (l *limiter) leakyBucket(k *limiterKey, cost int, now time.Time) LimitResult {
+	capacity := float64(l.config.Burst)
+	rate := l.config.rate()
+	k.level = math.Max(0, k.level-now.Sub(k.last).Seconds()*rate)
+	k.last = now
+	res := LimitResult{Limit: l.config.Burst}
+	if k.level+float64(cost) <= capacity {
+		k.level += float64(cost)
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsToDuration((k.level + float64(cost) - capacity) / rate)
+	}
+	res.Remaining = int(capacity - k.level)
+	res.Reset = secondsToDuration(k.level / rate)
+	return res
+}
+
+// fixedWindow counts requests in consecutive windows, which start at the first request of each key
+func (l *limiter) fixedWindow(k *limiterKey, cost int, now time.Time) LimitResult {
+	if elapsed := now.Sub(k.last); elapsed >= l.config.Period {
+		k.last = k.last.Add(elapsed - elapsed%l.config.Period)
+		k.level = 0
+	}
+	res := LimitResult{Limit: l.config.Limit, Reset: k.last.Add(l.config.Period).Sub(now)}
+	if int(k.level)+cost <= l.config.Limit {
+		k.level += float64(cost)
+		res.Allowed = true
+	} else {
+		res.RetryAfter = res.Reset
+	}
+	res.Remaining = l.config.Limit - int(k.level)
+	return res
+}
+
+func (l *limiter) slidingLog(k *limiterKey, cost int, now time.Time) LimitResult {
+	start := now.Add(-l.config.Period)
+	idx := 0
+	for idx < len(k.log) && !k.log[idx].After(start) {
+		idx++
+	}
+	k.log = append(k.log[:0], k.log[idx:]...)
+	res := LimitResult{Limit: l.config.Limit}
+	if len(k.log)+cost <= l.config.Limit {
+		for i := 0; i < cost; i++ {
+			k.log = append(k.log, now)
+		}
+		res.Allowed = true
+	} else if len(k.log) > 0 {
+		res.RetryAfter = k.log[0].Add(l.config.Period).Sub(now)
+	}
+	res.Remaining = l.config.Limit - len(k.log)
+	if len(k.log) > 0 {
+		res.Reset = k.log[len(k.log)-1].Add(l.config.Period).Sub(now)
+	}
+	return res
+}
+
+// cleanup removes keys which have been idle for longer than a full period,
+// it only runs when the limiter is tracking too many keys
+func (l *limiter) cleanup(now time.Time) {
+	if len(l.keys) < maxLimiterKeys {
+		return
+	}
+	for key, k := range l.keys {
+		last := k.last
+		if len(k.log) > 0 {
+			last = k.log[len(k.log)-1]
+		}
+		if now.Sub(last) > l.config.Period*2 {
+			delete(l.keys, key)
+		}
+	}
+}
+
+// RateLimitLoader exposes limiters as the "ratelimit" module.
+//
+// req is used to compute the key of limiters configured with KeyBy,
+// it might be nil when the module is used outside of a request.
+func RateLimitLoader(req *http.Request, limiters *RateLimiters) func(L *lua.LState) int {
+	return func(L *lua.LState) int {
+		take := func(L *lua.LState, l *limiter, idx int) int {
+			key := L.OptString(idx, "")
+			if key == "" {
+				key = requestKey(req, l.config.KeyBy, limiters.trusted)
+			}
+			if key == "" {
+				L.ArgError(idx, "key is required")
+				return 0
+			}
+			cost := L.OptInt(idx+1, 1)
+			if cost < 1 {
+				L.ArgError(idx+1, "cost must be positive")
+				return 0
+			}
+			// the limiter would never allow it
+			if capacity := l.config.capacity(); cost > capacity {
+				L.ArgError(idx+1, fmt.Sprintf("cost must not be greater than %v", capacity))
+				return 0
+			}
+			L.Push(limitResultToTable(L, l.take(key, cost, time.Now())))
+			return 1
+		}
+		registerType(L, limiterTypeName, map[string]lua.LGFunction{
+			"take": func(L *lua.LState) int {
+				l, ok := L.CheckUserData(1).Value.(*limiter)
+				if !ok {
+					L.ArgError(1, "limiter expected")
+					return 0
+				}
+				return take(L, l, 2)
+			},
+		})
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"limiter": func(L *lua.LState) int {
+				tbl := L.CheckTable(1)
+				name := lua.LVAsString(tbl.RawGetString("name"))
+				if name == "" {
+					L.ArgError(1, "name is required")
+					return 0
+				}
+				cfg := LimiterConfig{
+					Algorithm: lua.LVAsString(tbl.RawGetString("algorithm")),
+					Limit:     int(lua.LVAsNumber(tbl.RawGetString("limit"))),
+					Period:    secondsToDuration(float64(lua.LVAsNumber(tbl.RawGetString("per")))),
+					Burst:     int(lua.LVAsNumber(tbl.RawGetString("burst"))),
+					KeyBy:     lua.LVAsString(tbl.RawGetString("key")),
+				}
+				l, err := limiters.Limiter(name, cfg)
+				if err != nil {
+					L.ArgError(1, err.Error())
+					return 0
+				}
+				L.Push(newTypedUserData(L, l, limiterTypeName))
+				return 1
+			},
+			"take": func(L *lua.LState) int {
+				name := L.CheckString(1)
+				l := limiters.get(name)
+				if l == nil {
+					L.RaiseError("ratelimit: limiter %v does not exist", name)
+					return 0
+				}
+				return take(L, l, 2)
+			},
+			"headers": func(L *lua.LState) int {
+				res := L.CheckTable(1)
+				headers := L.NewTable()
+				headers.RawSetString("RateLimit-Limit", lua.LString(res.RawGetString("limit").String()))
+				headers.RawSetString("RateLimit-Remaining", lua.LString(res.RawGetString("remaining").String()))
+				headers.RawSetString("RateLimit-Reset", lua.LString(ceilSeconds(res.RawGetString("reset"))))
+				if !lua.LVAsBool(res.RawGetString("allowed")) {
+					headers.RawSetString("Retry-After", lua.LString(ceilSeconds(res.RawGetString("retryAfter"))))
+				}
+				L.Push(headers)
+				return 1
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+// requestKey returns the key used to identify the client of req
+func requestKey(req *http.Request, keyBy string, trusted []*net.IPNet) string {
+	if req == nil {
+		return ""
+	}
+	switch {
+	case keyBy == "ip":
+		return clientIP(req, trusted)
+	case strings.HasPrefix(keyBy, "header:"):
+		return req.Header.Get(strings.TrimPrefix(keyBy, "header:"))
+	}
+	return ""
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only used when
+// the request comes from a trusted proxy, in which case the last address which
+// was not added by a trusted proxy is the client.
+func clientIP(req *http.Request, trusted []*net.IPNet) string {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	if !isTrusted(client, trusted) {
+		return client
+	}
+	hops := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		client = hop
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+	return client
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func limitResultToTable(L *lua.LState, res LimitResult) *lua.LTable {
+	tbl := L.CreateTable(0, 5)
+	tbl.RawSetString("allowed", lua.LBool(res.Allowed))
+	tbl.RawSetString("limit", lua.LNumber(res.Limit))
+	tbl.RawSetString("remaining", lua.LNumber(res.Remaining))
+	tbl.RawSetString("reset", lua.LNumber(res.Reset.Seconds()))
+	tbl.RawSetString("retryAfter", lua.LNumber(res.RetryAfter.Seconds()))
+	return tbl
+}
+
+// ceilSeconds formats a number of seconds as an integer, as required by HTTP headers
+func ceilSeconds(v lua.LValue) string {
+	return strconv.Itoa(int(math.Ceil(float64(lua.LVAsNumber(v)))))
+}
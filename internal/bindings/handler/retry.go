@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	BackoffNone         = "none"
+	BackoffFull         = "full"
+	BackoffDecorrelated = "decorrelated"
+
+	// DefaultRetryRatio is how many retries are allowed for each call
+	DefaultRetryRatio = 0.2
+	// DefaultMinRetriesPerSecond is how many retries are always allowed,
+	// even if the instance didn't make many calls
+	DefaultMinRetriesPerSecond = 5
+)
+
+type (
+	// retryPolicy describes when and how a call should be retried
+	retryPolicy struct {
+		attempts int
+		on       map[string]bool
+		backoff  string
+		base     time.Duration
+		cap      time.Duration
+	}
+
+	// RetryBudget limits how many retries an instance can make,
+	// so retries can't multiply the load on a service which is already failing.
+	//
+	// Every call deposits ratio tokens and every retry withdraws a full token,
+	// in addition to that minPerSecond tokens are added each second.
+	RetryBudget struct {
+		sync.Mutex
+		ratio        float64
+		minPerSecond float64
+		tokens       float64
+		max          float64
+		last         time.Time
+	}
+)
+
+// NewRetryBudget returns a budget which allows ratio retries per call,
+// plus minPerSecond retries each second
+func NewRetryBudget(ratio, minPerSecond float64) *RetryBudget {
+	b := &RetryBudget{}
+	b.Configure(ratio, minPerSecond)
+	b.tokens = b.max
+	return b
+}
+
+// Configure changes the parameters of the budget
+func (b *RetryBudget) Configure(ratio, minPerSecond float64) {
+	b.Lock()
+	defer b.Unlock()
+	if ratio < 0 {
+		ratio = 0
+	}
+	if minPerSecond < 0 {
+		minPerSecond = 0
+	}
+	b.ratio = ratio
+	b.minPerSecond = minPerSecond
+	// allow bursts of up to 10 seconds worth of retries
+	b.max = math.Max(minPerSecond*10, 1)
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+	b.last = time.Now()
+}
+
+// deposit is called once for every call (not counting retries)
+func (b *RetryBudget) deposit() {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	b.tokens = math.Min(b.max, b.tokens+b.ratio)
+}
+
+// withdraw returns true if a retry is allowed
+func (b *RetryBudget) withdraw() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *RetryBudget) refill() {
+	now := time.Now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.tokens = math.Min(b.max, b.tokens+elapsed*b.minPerSecond)
+}
+
+// checkRetryPolicy reads the retry policy from the "retry" field of a call table.
+//
+// It returns nil when the field is absent, which means the call is not retried.
+func checkRetryPolicy(L *lua.LState, tbl *lua.LTable) *retryPolicy {
+	var policy *retryPolicy
+	switch val := tbl.RawGetString("retry").(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LBool:
+		if !val {
+			return nil
+		}
+		policy = defaultRetryPolicy()
+	case lua.LNumber:
+		policy = defaultRetryPolicy()
+		policy.attempts = int(val)
+	case *lua.LTable:
+		policy = defaultRetryPolicy()
+		if n, ok := val.RawGetString("attempts").(lua.LNumber); ok {
+			policy.attempts = int(n)
+		}
+		if on, ok := val.RawGetString("on").(*lua.LTable); ok {
+			policy.on = map[string]bool{}
+			on.ForEach(func(_, v lua.LValue) {
+				policy.on[v.String()] = true
+			})
+		}
+		if backoff, ok := val.RawGetString("backoff").(lua.LString); ok {
+			policy.backoff = string(backoff)
+		}
+		if base, ok := val.RawGetString("base").(lua.LNumber); ok {
+			policy.base = secondsToDuration(float64(base))
+		}
+		if cap, ok := val.RawGetString("cap").(lua.LNumber); ok {
+			policy.cap = secondsToDuration(float64(cap))
+		}
+	default:
+		L.RaiseError("services: retry must be a boolean, number or table")
+		return nil
+	}
+	switch policy.backoff {
+	case BackoffNone, BackoffFull, BackoffDecorrelated:
+	default:
+		L.RaiseError("services: unknown backoff %q", policy.backoff)
+	}
+	if policy.attempts < 1 {
+		policy.attempts = 1
+	}
+	return policy
+}
+
+func defaultRetryPolicy() *retryPolicy {
+	return &retryPolicy{
+		attempts: 3,
+		on: map[string]bool{
+			errCodeTransport: true,
+			"502":            true,
+			"503":            true,
+			"504":            true,
+		},
+		backoff: BackoffFull,
+		base:    50 * time.Millisecond,
+		cap:     time.Second,
+	}
+}
+
+// retryable returns true if the outcome of an attempt should be retried
+func (p *retryPolicy) retryable(res *callResult, err *callError) bool {
+	if err != nil {
+		return p.on[err.code]
+	}
+	return p.on[strconv.Itoa(res.status)]
+}
+
+// wait sleeps before the next attempt, prev is the previous sleep (used by decorrelated jitter).
+//
+// It returns the duration of the sleep and false if ctx was cancelled while waiting.
+func (p *retryPolicy) wait(ctx context.Context, attempt int, prev time.Duration) (time.Duration, bool) {
+	var sleep time.Duration
+	switch p.backoff {
+	case BackoffFull:
+		// sleep = random(0, min(cap, base * 2^attempt))
+		ceil := math.Min(float64(p.cap), float64(p.base)*math.Pow(2, float64(attempt)))
+		sleep = time.Duration(rand.Float64() * ceil)
+	case BackoffDecorrelated:
+		// sleep = min(cap, random(base, prev * 3))
+		if prev < p.base {
+			prev = p.base
+		}
+		upper := float64(prev) * 3
+		sleep = time.Duration(math.Min(float64(p.cap), float64(p.base)+rand.Float64()*(upper-float64(p.base))))
+	}
+	if sleep <= 0 {
+		return 0, ctx.Err() == nil
+	}
+	timer := time.NewTimer(sleep)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return sleep, true
+	case <-ctx.Done():
+		return sleep, false
+	}
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type (
+	// RouteObserver is notified about the route that matched the request,
+	// unmatched requests are reported as "404" or "405"
+	RouteObserver func(route string)
+
+	luaRoute struct {
+		method string
+		path   string
+		fn     *lua.LFunction
+	}
+)
+
+// RouterLoader exposes the "router" module, which dispatches req to the
+// Lua function registered for its method and path.
+func RouterLoader(req *http.Request, res http.ResponseWriter, observer RouteObserver) func(L *lua.LState) int {
+	var routes []luaRoute
+	var middlewares []*lua.LFunction
+	var notFound, methodNotAllowed *lua.LFunction
+	if observer == nil {
+		observer = func(string) {}
+	}
+
+	route := func(method string) lua.LGFunction {
+		return func(L *lua.LState) int {
+			routes = append(routes, luaRoute{
+				method: method,
+				path:   L.CheckString(1),
+				fn:     L.CheckFunction(2),
+			})
+			return 0
+		}
+	}
+
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"get":     route(http.MethodGet),
+			"post":    route(http.MethodPost),
+			"put":     route(http.MethodPut),
+			"patch":   route(http.MethodPatch),
+			"delete":  route(http.MethodDelete),
+			"head":    route(http.MethodHead),
+			"options": route(http.MethodOptions),
+			"handle": func(L *lua.LState) int {
+				routes = append(routes, luaRoute{
+					method: strings.ToUpper(L.CheckString(1)),
+					path:   L.CheckString(2),
+					fn:     L.CheckFunction(3),
+				})
+				return 0
+			},
+			"use": func(L *lua.LState) int {
+				middlewares = append(middlewares, L.CheckFunction(1))
+				return 0
+			},
+			"notFound": func(L *lua.LState) int {
+				notFound = L.CheckFunction(1)
+				return 0
+			},
+			"methodNotAllowed": func(L *lua.LState) int {
+				methodNotAllowed = L.CheckFunction(1)
+				return 0
+			},
+			"serve": func(L *lua.LState) int {
+				var matched *luaRoute
+				var params httprouter.Params
+				var fallback *lua.LFunction
+
+				router := httprouter.New()
+				router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					observer("404")
+					if notFound == nil {
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					fallback = notFound
+				})
+				router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					observer("405")
+					if methodNotAllowed == nil {
+						http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+						return
+					}
+					fallback = methodNotAllowed
+				})
+				err := registerRoutes(router, routes, func(r *luaRoute, p httprouter.Params) {
+					observer(fmt.Sprintf("%v %v", r.method, r.path))
+					matched = r
+					params = p
+				})
+				if err != nil {
+					L.RaiseError("router: %v", err)
+					return 0
+				}
+				router.ServeHTTP(res, req)
+
+				var fn *lua.LFunction
+				switch {
+				case matched != nil:
+					fn = matched.fn
+				case fallback != nil:
+					fn = fallback
+				default:
+					// httprouter already sent a response
+					return 0
+				}
+				paramTable := L.CreateTable(0, len(params))
+				for _, p := range params {
+					paramTable.RawSetString(p.Key, lua.LString(p.Value))
+				}
+				callChain(L, middlewares, fn, paramTable)
+				return 0
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+// registerRoutes adds all routes to router, converting the panics raised by httprouter
+// for conflicting routes into errors
+func registerRoutes(router *httprouter.Router, routes []luaRoute, onMatch func(*luaRoute, httprouter.Params)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid route, cause %v", r)
+		}
+	}()
+	for i := range routes {
+		r := &routes[i]
+		router.Handle(r.method, r.path, func(_ http.ResponseWriter, _ *http.Request, p httprouter.Params) {
+			onMatch(r, p)
+		})
+	}
+	return nil
+}
+
+// callChain calls each middleware passing a "next" function that continues the chain,
+// once all middlewares are called, fn is called with the route parameters.
+func callChain(L *lua.LState, middlewares []*lua.LFunction, fn *lua.LFunction, params *lua.LTable) {
+	var next func(idx int) *lua.LFunction
+	next = func(idx int) *lua.LFunction {
+		return L.NewFunction(func(L *lua.LState) int {
+			if idx == len(middlewares) {
+				L.Push(fn)
+				L.Push(params)
+				L.Call(1, 0)
+				return 0
+			}
+			L.Push(middlewares[idx])
+			L.Push(next(idx + 1))
+			L.Push(params)
+			L.Call(2, 0)
+			return 0
+		})
+	}
+	L.Push(next(0))
+	L.Call(0, 0)
+}
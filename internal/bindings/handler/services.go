@@ -4,56 +4,231 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/andrebq/learn-system-design/control"
 	"github.com/andrebq/learn-system-design/internal/logutil"
+	"github.com/andrebq/learn-system-design/internal/metrics"
+	"github.com/andrebq/learn-system-design/internal/tracing"
 	lua "github.com/yuin/gopher-lua"
 )
 
-func ServicesLoader(ctx context.Context, options []*control.Server) func(L *lua.LState) int {
+const (
+	serviceErrorTypeName = "services.error"
+
+	// error codes returned to Lua when a call fails
+	errCodeNoServer  = "no_server"
+	errCodeRequest   = "invalid_request"
+	errCodeTransport = "transport"
+	errCodeTimeout   = "timeout"
+	errCodeCanceled  = "canceled"
+	errCodeTooLarge  = "response_too_large"
+
+	errCodeCircuitOpen = "circuit_open"
+
+	// DeadlineHeader carries the time (in milliseconds) the caller is still willing to wait,
+	// a relative value is used so instances don't depend on synchronized clocks
+	DeadlineHeader = "X-Request-Timeout-Ms"
+)
+
+type (
+	// callSpec describes a call made to another service
+	callSpec struct {
+		service string
+		method  string
+		path    string
+		headers http.Header
+		body    string
+		timeout time.Duration
+
+		// balancer is the strategy used to pick the server,
+		// and key is used by strategies based on hashing
+		balancer string
+		key      string
+
+		retry *retryPolicy
+	}
+
+	// callResult is the response received from another service
+	callResult struct {
+		endpoint string
+		status   int
+		headers  http.Header
+		body     []byte
+		latency  time.Duration
+		attempts int
+	}
+
+	// callError is returned to Lua code (as a table) when a call fails
+	// before a response is received
+	callError struct {
+		code     string
+		message  string
+		endpoint string
+		attempts int
+	}
+
+	// Client holds the state shared by all calls to other services
+	// made by an instance
+	Client struct {
+		Balancer *Balancer
+		Retries  *RetryBudget
+		Breakers *Breakers
+		// Tracer creates a client span for every attempt, nil disables tracing
+		Tracer *tracing.Tracer
+		// CallLatency records the latency of calls (including retries), by service and status
+		CallLatency *metrics.Histogram
+
+		stats ClientStats
+	}
+
+	// ClientStats counts calls made to other services
+	ClientStats struct {
+		// Calls made by Lua code
+		Calls int64
+		// Attempts is the total number of requests sent, including retries
+		Attempts int64
+		// Retries is the number of attempts after the first one
+		Retries int64
+		// RetriesDenied counts retries which were not sent because the
+		// retry budget was exhausted
+		RetriesDenied int64
+	}
+)
+
+// NewClient returns a client which uses the given load-balancing strategy by default
+func NewClient(strategy string) (*Client, error) {
+	lb, err := NewBalancer(strategy)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		Balancer: lb,
+		Retries:  NewRetryBudget(DefaultRetryRatio, DefaultMinRetriesPerSecond),
+		Breakers: NewBreakers(),
+	}, nil
+}
+
+// Stats returns a copy of the call counters
+func (c *Client) Stats() ClientStats {
+	return ClientStats{
+		Calls:         atomic.LoadInt64(&c.stats.Calls),
+		Attempts:      atomic.LoadInt64(&c.stats.Attempts),
+		Retries:       atomic.LoadInt64(&c.stats.Retries),
+		RetriesDenied: atomic.LoadInt64(&c.stats.RetriesDenied),
+	}
+}
+
+func (c *callError) Error() string {
+	return fmt.Sprintf("%v: %v", c.code, c.message)
+}
+
+func ServicesLoader(ctx context.Context, options []*control.Server, client *Client) func(L *lua.LState) int {
+	return DynamicServicesLoader(ctx, func() []*control.Server { return options }, client)
+}
+
+// DynamicServicesLoader works like ServicesLoader but asks for the list of servers on every call,
+// which is required by states that outlive a single request
+func DynamicServicesLoader(ctx context.Context, servers func() []*control.Server, client *Client) func(L *lua.LState) int {
+	if client == nil {
+		client, _ = NewClient(StrategyRandom)
+	}
 	return func(L *lua.LState) int {
+		registerType(L, serviceErrorTypeName, nil)
+		L.SetField(L.GetTypeMetatable(serviceErrorTypeName), "__tostring", L.NewFunction(func(L *lua.LState) int {
+			tbl := L.CheckTable(1)
+			L.Push(lua.LString(fmt.Sprintf("%v: %v", L.GetField(tbl, "code"), L.GetField(tbl, "message"))))
+			return 1
+		}))
+		registerType(L, futureTypeName, futureMethods(ctx))
 		// register functions to the table
 		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"setBalancer": func(L *lua.LState) int {
+				if err := client.Balancer.SetStrategy(L.CheckString(1), L.CheckString(2)); err != nil {
+					L.ArgError(2, err.Error())
+				}
+				return 0
+			},
+			"breaker": func(L *lua.LState) int {
+				client.Breakers.Configure(L.CheckString(1), checkBreakerConfig(L, 2))
+				return 0
+			},
+			"retryBudget": func(L *lua.LState) int {
+				tbl := L.CheckTable(1)
+				ratio, minPerSecond := float64(DefaultRetryRatio), float64(DefaultMinRetriesPerSecond)
+				if n, ok := tbl.RawGetString("ratio").(lua.LNumber); ok {
+					ratio = float64(n)
+				}
+				if n, ok := tbl.RawGetString("minPerSecond").(lua.LNumber); ok {
+					minPerSecond = float64(n)
+				}
+				client.Retries.Configure(ratio, minPerSecond)
+				return 0
+			},
 			"call": func(L *lua.LState) int {
-				var name, body string
-				name = L.CheckString(1)
-				if L.GetTop() > 1 {
-					body = L.CheckString(2)
+				if L.Get(1).Type() == lua.LTTable {
+					spec := checkCallSpec(L, 1)
+					res, err := client.call(callContext(ctx, L), servers(), spec)
+					return pushCallResult(L, res, err)
 				}
 
-				log := logutil.Acquire(L.Context()).With().Str("targetService", name).Logger()
-				ctx = L.Context()
-
-				server := randomOptionByName(options, name)
-				if server == nil {
-					log.Error().Err(errors.New("unable to find server")).Send()
-					L.RaiseError("handler: unable to find any server that implements service %v", name)
-					return 0
-				}
-				log = log.With().Str("endpoint", server.Endpoint).Logger()
-				req, err := http.NewRequestWithContext(ctx, "POST", server.Endpoint, bytes.NewBufferString(body))
-				if err != nil {
-					L.RaiseError("handler: unable create POST request on %v for service %v", server.Endpoint, name)
-					return 0
+				// simple form: services.call(name, body) returns the response body
+				// and raises an error if the call fails
+				spec := callSpec{service: L.CheckString(1), method: "POST"}
+				if L.GetTop() > 1 {
+					spec.body = L.CheckString(2)
 				}
-				res, err := http.DefaultClient.Do(req)
+				res, err := client.call(callContext(ctx, L), servers(), spec)
 				if err != nil {
-					log.Error().Err(err).Send()
-					L.RaiseError("handler: unable perform POST request on %v for service %v", server.Endpoint, name)
+					L.RaiseError("handler: unable to call service %v, cause %v", spec.service, err)
 					return 0
 				}
-				defer res.Body.Close()
-				resBody, err := ioutil.ReadAll(res.Body)
-				if err != nil {
-					L.RaiseError("handler: unable read response for POST on %v for service %v", server.Endpoint, body)
-					return 0
+				L.Push(lua.LString(string(res.body)))
+				return 1
+			},
+			"callAsync": func(L *lua.LState) int {
+				spec := callSpec{method: "POST"}
+				if L.Get(1).Type() == lua.LTTable {
+					spec = checkCallSpec(L, 1)
+				} else {
+					spec.service = L.CheckString(1)
+					spec.body = L.OptString(2, "")
 				}
-				L.Push(lua.LString(string(resBody)))
+				f := client.callAsync(callContext(ctx, L), servers(), spec)
+				L.Push(newTypedUserData(L, f, futureTypeName))
 				return 1
 			},
+			"await": func(L *lua.LState) int {
+				return awaitAll(callContext(ctx, L), L, checkFutures(L, 1))
+			},
+			"awaitAny": func(L *lua.LState) int {
+				idx, res, err := awaitAny(callContext(ctx, L), checkFutures(L, 1))
+				if idx < 0 {
+					L.Push(lua.LNil)
+				} else {
+					L.Push(lua.LNumber(idx + 1))
+				}
+				return 1 + pushCallResult(L, res, err)
+			},
+			"callAll": func(L *lua.LState) int {
+				list := L.CheckTable(1)
+				callCtx := callContext(ctx, L)
+				var futures []*future
+				for i := 1; i <= list.Len(); i++ {
+					L.Push(list.RawGetInt(i))
+					spec := checkCallSpec(L, L.GetTop())
+					L.Pop(1)
+					futures = append(futures, client.callAsync(callCtx, servers(), spec))
+				}
+				return awaitAll(callCtx, L, futures)
+			},
 		})
 
 		// returns the module
@@ -62,19 +237,257 @@ func ServicesLoader(ctx context.Context, options []*control.Server) func(L *lua.
 	}
 }
 
-func randomOptionByName(options []*control.Server, name string) *control.Server {
-	var validOptions []int
-	for i, v := range options {
-		if v.Service == name {
-			validOptions = append(validOptions, i)
+// callContext returns the context of L, falling back to ctx when L doesn't have one
+func callContext(ctx context.Context, L *lua.LState) context.Context {
+	if c := Context(L); c != nil {
+		return c
+	}
+	return ctx
+}
+
+// checkCallSpec reads a call description from the table at idx
+func checkCallSpec(L *lua.LState, idx int) callSpec {
+	tbl := L.CheckTable(idx)
+	spec := callSpec{
+		service: lua.LVAsString(tbl.RawGetString("service")),
+		method:  strings.ToUpper(lua.LVAsString(tbl.RawGetString("method"))),
+		path:    lua.LVAsString(tbl.RawGetString("path")),
+		body:    lua.LVAsString(tbl.RawGetString("body")),
+		timeout: time.Duration(float64(lua.LVAsNumber(tbl.RawGetString("timeout"))) * float64(time.Second)),
+		headers: http.Header{},
+
+		balancer: lua.LVAsString(tbl.RawGetString("balancer")),
+		key:      lua.LVAsString(tbl.RawGetString("key")),
+
+		retry: checkRetryPolicy(L, tbl),
+	}
+	if spec.service == "" {
+		L.ArgError(idx, "service is required")
+	}
+	if spec.method == "" {
+		spec.method = "POST"
+	}
+	if _, err := NormalizeStrategy(spec.balancer); err != nil {
+		L.ArgError(idx, err.Error())
+	}
+	if headers, ok := tbl.RawGetString("headers").(*lua.LTable); ok {
+		headers.ForEach(func(k, v lua.LValue) {
+			spec.headers.Add(k.String(), v.String())
+		})
+	}
+	return spec
+}
+
+// call sends the request described by spec, retrying it according to its policy.
+//
+// Retries avoid endpoints which already failed, unless there are no other
+// endpoints left.
+func (c *Client) call(ctx context.Context, options []*control.Server, spec callSpec) (*callResult, *callError) {
+	atomic.AddInt64(&c.stats.Calls, 1)
+	start := time.Now()
+	c.Retries.deposit()
+	candidates := serversByName(options, spec.service)
+	tried := map[string]bool{}
+
+	var res *callResult
+	var err *callError
+	var sleep time.Duration
+	attempt := 0
+	for {
+		attempt++
+		atomic.AddInt64(&c.stats.Attempts, 1)
+		res, err = c.attempt(ctx, untried(candidates, tried), spec)
+		switch {
+		case res != nil:
+			tried[res.endpoint] = true
+		case err.endpoint != "":
+			tried[err.endpoint] = true
+		}
+		if spec.retry == nil || attempt >= spec.retry.attempts || ctx.Err() != nil || !spec.retry.retryable(res, err) {
+			break
 		}
+		if !c.Retries.withdraw() {
+			atomic.AddInt64(&c.stats.RetriesDenied, 1)
+			break
+		}
+		var ok bool
+		if sleep, ok = spec.retry.wait(ctx, attempt, sleep); !ok {
+			break
+		}
+		atomic.AddInt64(&c.stats.Retries, 1)
+	}
+	if err != nil {
+		err.attempts = attempt
+		c.CallLatency.Observe(time.Since(start).Seconds(), spec.service, err.code)
+		return nil, err
+	}
+	res.attempts = attempt
+	c.CallLatency.Observe(time.Since(start).Seconds(), spec.service, strconv.Itoa(res.status))
+	return res, nil
+}
+
+// untried returns the candidates which were not tried yet,
+// or all candidates if every one of them was already tried
+func untried(candidates []*control.Server, tried map[string]bool) []*control.Server {
+	var valid []*control.Server
+	for _, c := range candidates {
+		if !tried[c.Endpoint] {
+			valid = append(valid, c)
+		}
+	}
+	if len(valid) == 0 {
+		return candidates
+	}
+	return valid
+}
+
+// attempt uses the balancer to pick one of the candidates and sends the request to it
+//
+// Candidates with an open circuit breaker are skipped, and calls fail fast
+// if all breakers are open.
+func (c *Client) attempt(ctx context.Context, candidates []*control.Server, spec callSpec) (*callResult, *callError) {
+	log := logutil.Acquire(ctx).With().Str("targetService", spec.service).Logger()
+	if len(candidates) == 0 {
+		log.Error().Err(errors.New("unable to find server")).Send()
+		return nil, &callError{code: errCodeNoServer, message: fmt.Sprintf("unable to find any server that implements service %v", spec.service)}
+	}
+	circuitOpen := &callError{code: errCodeCircuitOpen, message: fmt.Sprintf("circuit breaker for service %v is open", spec.service)}
+	lb := c.Balancer
+	server, err := lb.pick(c.Breakers.available(spec.service, candidates), spec.service, spec.balancer, spec.key)
+	if err != nil {
+		return nil, &callError{code: errCodeRequest, message: err.Error()}
+	}
+	if server == nil {
+		return nil, circuitOpen
 	}
-	switch len(validOptions) {
-	case 0:
-		return nil
-	case 1:
-		return options[validOptions[0]]
+	br, allowed := c.Breakers.acquire(spec.service, server.Endpoint)
+	if !allowed {
+		circuitOpen.endpoint = server.Endpoint
+		return nil, circuitOpen
+	}
+	done := lb.track(server.Endpoint)
+	defer done()
+	ctx, span := c.Tracer.Start(ctx, spec.method+" "+spec.service, tracing.SpanKindClient)
+	defer span.End()
+	span.SetAttribute("peer.service", spec.service)
+	span.SetAttribute("http.method", spec.method)
+	span.SetAttribute("http.url", server.Endpoint)
+	start := time.Now()
+	res, callErr := send(ctx, server.Endpoint, spec)
+	if callErr != nil {
+		span.SetError(callErr.Error())
+	} else {
+		span.SetAttribute("http.status_code", res.status)
+		if res.status >= 500 {
+			span.SetError(http.StatusText(res.status))
+		}
+	}
+	switch {
+	case br == nil:
+	case ctx.Err() != nil:
+		// the caller cancelled the call or ran out of time, which is not a failure of the server
+		br.release()
+	default:
+		br.record(time.Now(), callErr != nil || res.status >= 500, time.Since(start))
+	}
+	return res, callErr
+}
+
+// send performs the request described by spec against the given endpoint
+func send(ctx context.Context, endpoint string, spec callSpec) (*callResult, *callError) {
+	if spec.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, spec.timeout)
+		defer cancel()
+	}
+	url := endpoint
+	if spec.path != "" {
+		url = fmt.Sprintf("%v/%v", strings.TrimRight(endpoint, "/"), strings.TrimLeft(spec.path, "/"))
+	}
+	req, err := http.NewRequestWithContext(ctx, spec.method, url, bytes.NewBufferString(spec.body))
+	if err != nil {
+		return nil, &callError{code: errCodeRequest, endpoint: endpoint, message: fmt.Sprintf("unable to create %v request on %v for service %v", spec.method, url, spec.service)}
+	}
+	for k, v := range spec.headers {
+		req.Header[k] = v
+	}
+	tracing.Inject(ctx, req.Header)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(DeadlineHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log := logutil.Acquire(ctx)
+		log.Error().Err(err).Str("targetService", spec.service).Str("endpoint", endpoint).Send()
+		return nil, contextError(ctx, endpoint, err)
+	}
+	defer res.Body.Close()
+	// read one extra byte to detect bodies which are too large
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, MaxBodySize+1))
+	if err != nil {
+		return nil, contextError(ctx, endpoint, err)
+	}
+	if len(body) > MaxBodySize {
+		return nil, &callError{code: errCodeTooLarge, endpoint: endpoint, message: fmt.Sprintf("response body from %v is larger than %v bytes", spec.service, MaxBodySize)}
+	}
+	return &callResult{
+		endpoint: endpoint,
+		status:   res.StatusCode,
+		headers:  res.Header,
+		body:     body,
+		latency:  time.Since(start),
+	}, nil
+}
+
+// ParseDeadline returns the timeout sent by the caller in the DeadlineHeader of req,
+// ok is false if the header is missing or invalid
+func ParseDeadline(req *http.Request) (time.Duration, bool) {
+	value := req.Header.Get(DeadlineHeader)
+	if value == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if ms < 0 {
+		// the deadline already passed while the request was in transit
+		ms = 0
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// contextError checks if err was caused by ctx and returns the appropriate callError
+func contextError(ctx context.Context, endpoint string, err error) *callError {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return &callError{code: errCodeTimeout, endpoint: endpoint, message: err.Error()}
+	case errors.Is(ctx.Err(), context.Canceled):
+		return &callError{code: errCodeCanceled, endpoint: endpoint, message: err.Error()}
+	}
+	return &callError{code: errCodeTransport, endpoint: endpoint, message: err.Error()}
+}
+
+func callResultToTable(L *lua.LState, res *callResult) *lua.LTable {
+	tbl := L.CreateTable(0, 5)
+	tbl.RawSetString("status", lua.LNumber(res.status))
+	tbl.RawSetString("headers", valuesToTable(L, res.headers))
+	tbl.RawSetString("body", lua.LString(string(res.body)))
+	tbl.RawSetString("latency", lua.LNumber(res.latency.Seconds()))
+	tbl.RawSetString("endpoint", lua.LString(res.endpoint))
+	tbl.RawSetString("attempts", lua.LNumber(res.attempts))
+	return tbl
+}
+
+func callErrorToTable(L *lua.LState, err *callError) *lua.LTable {
+	tbl := L.CreateTable(0, 4)
+	tbl.RawSetString("code", lua.LString(err.code))
+	tbl.RawSetString("message", lua.LString(err.message))
+	tbl.RawSetString("attempts", lua.LNumber(err.attempts))
+	if err.endpoint != "" {
+		tbl.RawSetString("endpoint", lua.LString(err.endpoint))
 	}
-	idx := rand.Intn(len(validOptions))
-	return options[validOptions[idx]]
+	L.SetMetatable(tbl, L.GetTypeMetatable(serviceErrorTypeName))
+	return tbl
 }
@@ -0,0 +1,331 @@
+package handler
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/andrebq/learn-system-design/internal/mutex"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	counterTypeName = "state.counter"
+	mapTypeName     = "state.map"
+	listTypeName    = "state.list"
+)
+
+type (
+	// SharedState holds values that live for as long as the instance is running
+	// and are visible to every Lua state created by it.
+	//
+	// Values are copied in/out of Lua, so changing a table returned by
+	// the state module does not change the stored value.
+	SharedState struct {
+		mutex.Zone
+		values   map[string]interface{}
+		counters map[string]*int64
+		maps     map[string]*sharedMap
+		lists    map[string]*sharedList
+	}
+
+	sharedMap struct {
+		mutex.Zone
+		items map[string]interface{}
+	}
+
+	sharedList struct {
+		mutex.Zone
+		items []interface{}
+	}
+)
+
+// NewSharedState returns an empty state
+func NewSharedState() *SharedState {
+	return &SharedState{
+		values:   make(map[string]interface{}),
+		counters: make(map[string]*int64),
+		maps:     make(map[string]*sharedMap),
+		lists:    make(map[string]*sharedList),
+	}
+}
+
+// StateLoader exposes s as the "state" module
+func StateLoader(s *SharedState) func(L *lua.LState) int {
+	return func(L *lua.LState) int {
+		registerStateTypes(L)
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"set": func(L *lua.LState) int {
+				key := L.CheckString(1)
+				val := checkShareable(L, 2)
+				mutex.Run(s.Exclusive(), func() {
+					if val == nil {
+						delete(s.values, key)
+						return
+					}
+					s.values[key] = val
+				})
+				return 0
+			},
+			"get": func(L *lua.LState) int {
+				key := L.CheckString(1)
+				var val interface{}
+				var found bool
+				mutex.Run(s.Shared(), func() {
+					val, found = s.values[key]
+				})
+				if !found {
+					L.Push(L.Get(2))
+					return 1
+				}
+				L.Push(toLuaValue(L, val))
+				return 1
+			},
+			"counter": func(L *lua.LState) int {
+				name := L.CheckString(1)
+				var c *int64
+				mutex.Run(s.Exclusive(), func() {
+					c = s.counters[name]
+					if c == nil {
+						c = new(int64)
+						s.counters[name] = c
+					}
+				})
+				L.Push(newTypedUserData(L, c, counterTypeName))
+				return 1
+			},
+			"map": func(L *lua.LState) int {
+				name := L.CheckString(1)
+				var m *sharedMap
+				mutex.Run(s.Exclusive(), func() {
+					m = s.maps[name]
+					if m == nil {
+						m = &sharedMap{items: make(map[string]interface{})}
+						s.maps[name] = m
+					}
+				})
+				L.Push(newTypedUserData(L, m, mapTypeName))
+				return 1
+			},
+			"list": func(L *lua.LState) int {
+				name := L.CheckString(1)
+				var l *sharedList
+				mutex.Run(s.Exclusive(), func() {
+					l = s.lists[name]
+					if l == nil {
+						l = &sharedList{}
+						s.lists[name] = l
+					}
+				})
+				L.Push(newTypedUserData(L, l, listTypeName))
+				return 1
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+func registerStateTypes(L *lua.LState) {
+	registerType(L, counterTypeName, map[string]lua.LGFunction{
+		"incr": func(L *lua.LState) int {
+			c := checkCounter(L)
+			delta := L.OptInt64(2, 1)
+			L.Push(lua.LNumber(atomic.AddInt64(c, delta)))
+			return 1
+		},
+		"get": func(L *lua.LState) int {
+			L.Push(lua.LNumber(atomic.LoadInt64(checkCounter(L))))
+			return 1
+		},
+		"set": func(L *lua.LState) int {
+			atomic.StoreInt64(checkCounter(L), L.CheckInt64(2))
+			return 0
+		},
+	})
+	registerType(L, mapTypeName, map[string]lua.LGFunction{
+		"get": func(L *lua.LState) int {
+			m := checkMap(L)
+			key := L.CheckString(2)
+			var val interface{}
+			var found bool
+			mutex.Run(m.Shared(), func() {
+				val, found = m.items[key]
+			})
+			if !found {
+				L.Push(L.Get(3))
+				return 1
+			}
+			L.Push(toLuaValue(L, val))
+			return 1
+		},
+		"put": func(L *lua.LState) int {
+			m := checkMap(L)
+			key := L.CheckString(2)
+			val := checkShareable(L, 3)
+			mutex.Run(m.Exclusive(), func() {
+				if val == nil {
+					delete(m.items, key)
+					return
+				}
+				m.items[key] = val
+			})
+			return 0
+		},
+		"delete": func(L *lua.LState) int {
+			m := checkMap(L)
+			key := L.CheckString(2)
+			var found bool
+			mutex.Run(m.Exclusive(), func() {
+				_, found = m.items[key]
+				delete(m.items, key)
+			})
+			L.Push(lua.LBool(found))
+			return 1
+		},
+		"len": func(L *lua.LState) int {
+			m := checkMap(L)
+			var sz int
+			mutex.Run(m.Shared(), func() {
+				sz = len(m.items)
+			})
+			L.Push(lua.LNumber(sz))
+			return 1
+		},
+		"keys": func(L *lua.LState) int {
+			m := checkMap(L)
+			var keys []string
+			mutex.Run(m.Shared(), func() {
+				keys = make([]string, 0, len(m.items))
+				for k := range m.items {
+					keys = append(keys, k)
+				}
+			})
+			sort.Strings(keys)
+			tbl := L.CreateTable(len(keys), 0)
+			for _, k := range keys {
+				tbl.Append(lua.LString(k))
+			}
+			L.Push(tbl)
+			return 1
+		},
+	})
+	registerType(L, listTypeName, map[string]lua.LGFunction{
+		"push": func(L *lua.LState) int {
+			l := checkList(L)
+			val := checkShareable(L, 2)
+			var sz int
+			mutex.Run(l.Exclusive(), func() {
+				l.items = append(l.items, val)
+				sz = len(l.items)
+			})
+			L.Push(lua.LNumber(sz))
+			return 1
+		},
+		"pop": func(L *lua.LState) int {
+			l := checkList(L)
+			var val interface{}
+			mutex.Run(l.Exclusive(), func() {
+				if len(l.items) == 0 {
+					return
+				}
+				last := len(l.items) - 1
+				val = l.items[last]
+				l.items[last] = nil
+				l.items = l.items[:last]
+			})
+			L.Push(toLuaValue(L, val))
+			return 1
+		},
+		"shift": func(L *lua.LState) int {
+			l := checkList(L)
+			var val interface{}
+			mutex.Run(l.Exclusive(), func() {
+				if len(l.items) == 0 {
+					return
+				}
+				val = l.items[0]
+				l.items[0] = nil
+				l.items = l.items[1:]
+			})
+			L.Push(toLuaValue(L, val))
+			return 1
+		},
+		"get": func(L *lua.LState) int {
+			l := checkList(L)
+			idx := L.CheckInt(2)
+			var val interface{}
+			mutex.Run(l.Shared(), func() {
+				if idx < 1 || idx > len(l.items) {
+					return
+				}
+				val = l.items[idx-1]
+			})
+			L.Push(toLuaValue(L, val))
+			return 1
+		},
+		"len": func(L *lua.LState) int {
+			l := checkList(L)
+			var sz int
+			mutex.Run(l.Shared(), func() {
+				sz = len(l.items)
+			})
+			L.Push(lua.LNumber(sz))
+			return 1
+		},
+		"items": func(L *lua.LState) int {
+			l := checkList(L)
+			var items []interface{}
+			mutex.Run(l.Shared(), func() {
+				items = append(items, l.items...)
+			})
+			L.Push(toLuaValue(L, items))
+			return 1
+		},
+	})
+}
+
+// registerType creates (or replaces) the metatable used by userdata values of the given type
+func registerType(L *lua.LState, name string, methods map[string]lua.LGFunction) {
+	mt := L.NewTypeMetatable(name)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), methods))
+}
+
+func newTypedUserData(L *lua.LState, value interface{}, typeName string) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = value
+	L.SetMetatable(ud, L.GetTypeMetatable(typeName))
+	return ud
+}
+
+func checkShareable(L *lua.LState, idx int) interface{} {
+	val, err := toGoValue(L.Get(idx))
+	if err != nil {
+		L.ArgError(idx, err.Error())
+		return nil
+	}
+	return val
+}
+
+func checkCounter(L *lua.LState) *int64 {
+	if c, ok := L.CheckUserData(1).Value.(*int64); ok {
+		return c
+	}
+	L.ArgError(1, "counter expected")
+	return nil
+}
+
+func checkMap(L *lua.LState) *sharedMap {
+	if m, ok := L.CheckUserData(1).Value.(*sharedMap); ok {
+		return m
+	}
+	L.ArgError(1, "map expected")
+	return nil
+}
+
+func checkList(L *lua.LState) *sharedList {
+	if l, ok := L.CheckUserData(1).Value.(*sharedList); ok {
+		return l
+	}
+	L.ArgError(1, "list expected")
+	return nil
+}
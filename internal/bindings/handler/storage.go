@@ -0,0 +1,514 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrebq/learn-system-design/internal/mutex"
+	"github.com/andrebq/learn-system-design/internal/randdist"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	StorageGet    = "get"
+	StoragePut    = "put"
+	StorageDelete = "delete"
+	StorageScan   = "scan"
+	StorageCAS    = "cas"
+
+	// DefaultStoragePoolSize is how many operations can run at the same time
+	DefaultStoragePoolSize = 10
+	// defaultScanLimit is how many rows are returned by a scan without a limit
+	defaultScanLimit = 100
+)
+
+var (
+	errPoolTimeout = errors.New("storage: timed out waiting for a connection")
+	errLockTimeout = errors.New("storage: timed out waiting for a row lock")
+
+	storageOperations = []string{StorageGet, StoragePut, StorageDelete, StorageScan, StorageCAS}
+)
+
+type (
+	// StorageConfig controls how the simulated database behaves
+	StorageConfig struct {
+		// PoolSize is the number of connections, operations wait when all of them are in use
+		PoolSize int
+		// PoolTimeout is how long an operation waits for a connection (or a row lock)
+		PoolTimeout time.Duration
+		// Latency of each operation, in seconds
+		Latency map[string]randdist.Distribution
+		// SizeFactor makes operations slower as the dataset grows, latency is multiplied
+		// by 1 + SizeFactor * log2(1 + keys), like looking up a key in a tree
+		SizeFactor float64
+		// PerRow is added to the latency for each row scanned
+		PerRow time.Duration
+	}
+
+	// Storage is an in-memory key-value database shared by all requests of an instance,
+	// with a limited number of connections and configurable latency.
+	Storage struct {
+		mutex.Zone
+		config StorageConfig
+		pool   chan struct{}
+		data   map[string]interface{}
+		// keys is kept sorted, to allow range scans
+		keys []string
+
+		lockZone mutex.Zone
+		locks    map[string]*rowLock
+
+		waiting   int64
+		lockWaits int64
+	}
+
+	// StorageStats describes the current load of a storage
+	StorageStats struct {
+		Keys      int64
+		PoolSize  int64
+		InUse     int64
+		Waiting   int64
+		LockWaits int64
+	}
+
+	rowLock struct {
+		ch   chan struct{}
+		refs int
+	}
+)
+
+// DefaultStorageConfig returns the configuration used by new storages
+func DefaultStorageConfig() StorageConfig {
+	cfg := StorageConfig{
+		PoolSize:    DefaultStoragePoolSize,
+		PoolTimeout: time.Second,
+		Latency:     map[string]randdist.Distribution{},
+	}
+	for _, op := range storageOperations {
+		cfg.Latency[op] = randdist.Distribution{Kind: randdist.Fixed, Mean: 0.001}
+	}
+	return cfg
+}
+
+func NewStorage() *Storage {
+	s := &Storage{
+		data:  make(map[string]interface{}),
+		locks: make(map[string]*rowLock),
+	}
+	s.Configure(DefaultStorageConfig())
+	return s
+}
+
+// Configure changes the pool and latency model, the data is kept.
+//
+// Operations that are already holding a connection return it to the old pool.
+func (s *Storage) Configure(cfg StorageConfig) {
+	if cfg.PoolSize < 1 {
+		cfg.PoolSize = 1
+	}
+	if cfg.PoolTimeout <= 0 {
+		cfg.PoolTimeout = time.Second
+	}
+	mutex.Run(s.Exclusive(), func() {
+		s.config = cfg
+		s.pool = make(chan struct{}, cfg.PoolSize)
+	})
+}
+
+// Stats returns the current load of the storage
+func (s *Storage) Stats() StorageStats {
+	var st StorageStats
+	mutex.Run(s.Shared(), func() {
+		st.Keys = int64(len(s.keys))
+		st.PoolSize = int64(cap(s.pool))
+		st.InUse = int64(len(s.pool))
+	})
+	st.Waiting = atomic.LoadInt64(&s.waiting)
+	st.LockWaits = atomic.LoadInt64(&s.lockWaits)
+	return st
+}
+
+// acquire waits for a free connection, the returned pool must be passed to release
+func (s *Storage) acquire(ctx context.Context) (chan struct{}, error) {
+	var pool chan struct{}
+	var timeout time.Duration
+	mutex.Run(s.Shared(), func() {
+		pool, timeout = s.pool, s.config.PoolTimeout
+	})
+	select {
+	case pool <- struct{}{}:
+		return pool, nil
+	default:
+	}
+	atomic.AddInt64(&s.waiting, 1)
+	defer atomic.AddInt64(&s.waiting, -1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case pool <- struct{}{}:
+		return pool, nil
+	case <-timer.C:
+		return nil, errPoolTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func release(pool chan struct{}) {
+	<-pool
+}
+
+// exec runs fn using a connection and waits for the latency of op.
+//
+// If held is not nil, it is used instead of acquiring a new connection.
+// fn returns how many rows it touched.
+func (s *Storage) exec(ctx context.Context, held chan struct{}, op string, fn func() int) error {
+	if held == nil {
+		pool, err := s.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release(pool)
+	}
+	rows := fn()
+	if !sleep(ctx, s.latency(op, rows)) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *Storage) latency(op string, rows int) time.Duration {
+	var dist randdist.Distribution
+	var size int
+	var cfg StorageConfig
+	mutex.Run(s.Shared(), func() {
+		cfg = s.config
+		dist = s.config.Latency[op]
+		size = len(s.keys)
+	})
+	seconds := dist.Sample() * (1 + cfg.SizeFactor*math.Log2(1+float64(size)))
+	return secondsToDuration(seconds) + cfg.PerRow*time.Duration(rows)
+}
+
+// lockRow waits until key is not locked by any other request, the returned
+// function releases the lock.
+func (s *Storage) lockRow(ctx context.Context, key string, timeout time.Duration) (func(), error) {
+	var l *rowLock
+	mutex.Run(s.lockZone.Exclusive(), func() {
+		l = s.locks[key]
+		if l == nil {
+			l = &rowLock{ch: make(chan struct{}, 1)}
+			s.locks[key] = l
+		}
+		l.refs++
+	})
+	unref := func() {
+		mutex.Run(s.lockZone.Exclusive(), func() {
+			l.refs--
+			if l.refs == 0 {
+				delete(s.locks, key)
+			}
+		})
+	}
+	unlock := func() {
+		<-l.ch
+		unref()
+	}
+	select {
+	case l.ch <- struct{}{}:
+		return unlock, nil
+	default:
+	}
+	atomic.AddInt64(&s.lockWaits, 1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.ch <- struct{}{}:
+		return unlock, nil
+	case <-timer.C:
+		unref()
+		return nil, errLockTimeout
+	case <-ctx.Done():
+		unref()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Storage) get(key string) (interface{}, bool) {
+	var val interface{}
+	var found bool
+	mutex.Run(s.Shared(), func() {
+		val, found = s.data[key]
+	})
+	return val, found
+}
+
+func (s *Storage) put(key string, val interface{}) {
+	mutex.Run(s.Exclusive(), func() {
+		s.putLocked(key, val)
+	})
+}
+
+func (s *Storage) putLocked(key string, val interface{}) {
+	if _, found := s.data[key]; !found {
+		idx := sort.SearchStrings(s.keys, key)
+		s.keys = append(s.keys, "")
+		copy(s.keys[idx+1:], s.keys[idx:])
+		s.keys[idx] = key
+	}
+	s.data[key] = val
+}
+
+func (s *Storage) delete(key string) bool {
+	var found bool
+	mutex.Run(s.Exclusive(), func() {
+		found = s.deleteLocked(key)
+	})
+	return found
+}
+
+func (s *Storage) deleteLocked(key string) bool {
+	if _, found := s.data[key]; !found {
+		return false
+	}
+	delete(s.data, key)
+	idx := sort.SearchStrings(s.keys, key)
+	s.keys = append(s.keys[:idx], s.keys[idx+1:]...)
+	return true
+}
+
+// compareAndSet replaces the value of key with val if the current value is equal to expected,
+// a nil expected means the key must not exist and a nil val deletes the key.
+func (s *Storage) compareAndSet(key string, expected, val interface{}) bool {
+	var swapped bool
+	mutex.Run(s.Exclusive(), func() {
+		current, found := s.data[key]
+		if (expected == nil && found) || (expected != nil && (!found || !reflect.DeepEqual(current, expected))) {
+			return
+		}
+		swapped = true
+		if val == nil {
+			s.deleteLocked(key)
+			return
+		}
+		s.putLocked(key, val)
+	})
+	return swapped
+}
+
+// scan returns up to limit keys in the range [from, to), an empty to means no upper bound
+func (s *Storage) scan(from, to string, limit int) ([]string, []interface{}) {
+	var keys []string
+	var values []interface{}
+	mutex.Run(s.Shared(), func() {
+		for idx := sort.SearchStrings(s.keys, from); idx < len(s.keys) && len(keys) < limit; idx++ {
+			key := s.keys[idx]
+			if to != "" && key >= to {
+				break
+			}
+			keys = append(keys, key)
+			values = append(values, s.data[key])
+		}
+	})
+	return keys, values
+}
+
+// StorageLoader exposes s as the "storage" module, operations are cancelled when ctx is done
+func StorageLoader(ctx context.Context, s *Storage) func(L *lua.LState) int {
+	return func(L *lua.LState) int {
+		// held is the connection used by the current request while it holds a row lock
+		var held chan struct{}
+		fail := func(L *lua.LState, first lua.LValue, err error) int {
+			L.Push(first)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"configure": func(L *lua.LState) int {
+				s.Configure(checkStorageConfig(L, 1))
+				return 0
+			},
+			"get": func(L *lua.LState) int {
+				key := L.CheckString(1)
+				var val interface{}
+				err := s.exec(ctx, held, StorageGet, func() int {
+					val, _ = s.get(key)
+					return 1
+				})
+				if err != nil {
+					return fail(L, lua.LNil, err)
+				}
+				L.Push(toLuaValue(L, val))
+				return 1
+			},
+			"put": func(L *lua.LState) int {
+				key := L.CheckString(1)
+				val := checkShareable(L, 2)
+				if val == nil {
+					L.ArgError(2, "value cannot be nil, use delete instead")
+					return 0
+				}
+				err := s.exec(ctx, held, StoragePut, func() int {
+					s.put(key, val)
+					return 1
+				})
+				if err != nil {
+					return fail(L, lua.LFalse, err)
+				}
+				L.Push(lua.LTrue)
+				return 1
+			},
+			"delete": func(L *lua.LState) int {
+				key := L.CheckString(1)
+				var found bool
+				err := s.exec(ctx, held, StorageDelete, func() int {
+					found = s.delete(key)
+					return 1
+				})
+				if err != nil {
+					return fail(L, lua.LFalse, err)
+				}
+				L.Push(lua.LBool(found))
+				return 1
+			},
+			"cas": func(L *lua.LState) int {
+				key := L.CheckString(1)
+				expected := checkShareable(L, 2)
+				val := checkShareable(L, 3)
+				var swapped bool
+				err := s.exec(ctx, held, StorageCAS, func() int {
+					swapped = s.compareAndSet(key, expected, val)
+					return 1
+				})
+				if err != nil {
+					return fail(L, lua.LFalse, err)
+				}
+				L.Push(lua.LBool(swapped))
+				return 1
+			},
+			"scan": func(L *lua.LState) int {
+				from := L.OptString(1, "")
+				to := L.OptString(2, "")
+				limit := L.OptInt(3, defaultScanLimit)
+				var keys []string
+				var values []interface{}
+				err := s.exec(ctx, held, StorageScan, func() int {
+					keys, values = s.scan(from, to, limit)
+					return len(keys)
+				})
+				if err != nil {
+					return fail(L, lua.LNil, err)
+				}
+				rows := L.CreateTable(len(keys), 0)
+				for i, key := range keys {
+					row := L.CreateTable(0, 2)
+					row.RawSetString("key", lua.LString(key))
+					row.RawSetString("value", toLuaValue(L, values[i]))
+					rows.Append(row)
+				}
+				L.Push(rows)
+				return 1
+			},
+			"withLock": func(L *lua.LState) int {
+				key := L.CheckString(1)
+				fn := L.CheckFunction(2)
+				var timeout time.Duration
+				mutex.Run(s.Shared(), func() {
+					timeout = s.config.PoolTimeout
+				})
+				if n, ok := L.Get(3).(lua.LNumber); ok {
+					timeout = secondsToDuration(float64(n))
+				}
+				// a row lock holds its connection until it is released,
+				// just like a transaction in a real database
+				if held == nil {
+					pool, err := s.acquire(ctx)
+					if err != nil {
+						return fail(L, lua.LFalse, err)
+					}
+					held = pool
+					defer func() {
+						held = nil
+						release(pool)
+					}()
+				}
+				unlock, err := s.lockRow(ctx, key, timeout)
+				if err != nil {
+					return fail(L, lua.LFalse, err)
+				}
+				defer unlock()
+				base := L.GetTop()
+				L.Push(fn)
+				if err := L.PCall(0, lua.MultRet, nil); err != nil {
+					L.RaiseError("%v", err.Error())
+					return 0
+				}
+				L.Insert(lua.LTrue, base+1)
+				return L.GetTop() - base
+			},
+			"stats": func(L *lua.LState) int {
+				st := s.Stats()
+				tbl := L.CreateTable(0, 5)
+				tbl.RawSetString("keys", lua.LNumber(st.Keys))
+				tbl.RawSetString("poolSize", lua.LNumber(st.PoolSize))
+				tbl.RawSetString("inUse", lua.LNumber(st.InUse))
+				tbl.RawSetString("waiting", lua.LNumber(st.Waiting))
+				tbl.RawSetString("lockWaits", lua.LNumber(st.LockWaits))
+				L.Push(tbl)
+				return 1
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+// checkStorageConfig reads a storage configuration from the table at idx,
+// missing fields use the values from DefaultStorageConfig.
+//
+// latency can be a single distribution used by all operations, or a table
+// with one distribution per operation.
+func checkStorageConfig(L *lua.LState, idx int) StorageConfig {
+	cfg := DefaultStorageConfig()
+	tbl := L.CheckTable(idx)
+	if n, ok := tbl.RawGetString("poolSize").(lua.LNumber); ok {
+		cfg.PoolSize = int(n)
+	}
+	if n, ok := tbl.RawGetString("poolTimeout").(lua.LNumber); ok {
+		cfg.PoolTimeout = secondsToDuration(float64(n))
+	}
+	if n, ok := tbl.RawGetString("sizeFactor").(lua.LNumber); ok {
+		cfg.SizeFactor = float64(n)
+	}
+	if n, ok := tbl.RawGetString("perRow").(lua.LNumber); ok {
+		cfg.PerRow = secondsToDuration(float64(n))
+	}
+	latency := tbl.RawGetString("latency")
+	if latency == lua.LNil {
+		return cfg
+	}
+	// distributions are read from the top of the stack
+	read := func(v lua.LValue) randdist.Distribution {
+		L.Push(v)
+		defer L.Pop(1)
+		return checkDistribution(L, L.GetTop())
+	}
+	if t, ok := latency.(*lua.LTable); ok && t.RawGetString("kind") == lua.LNil {
+		for _, op := range storageOperations {
+			if v := t.RawGetString(op); v != lua.LNil {
+				cfg.Latency[op] = read(v)
+			}
+		}
+		return cfg
+	}
+	d := read(latency)
+	for _, op := range storageOperations {
+		cfg.Latency[op] = d
+	}
+	return cfg
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/andrebq/learn-system-design/internal/tracing"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TraceLoader exposes tracing as the "trace" module.
+//
+// Spans use the context of the state, so it works with states that are reused
+// across requests. When tracer is nil spans are not recorded, but functions
+// passed to trace.span are still called.
+func TraceLoader(tracer *tracing.Tracer) func(L *lua.LState) int {
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"span": func(L *lua.LState) int {
+				name := L.CheckString(1)
+				fn := L.CheckFunction(2)
+				attrs := L.OptTable(3, nil)
+
+				parent := Context(L)
+				if parent == nil {
+					parent = context.Background()
+				}
+				ctx, span := tracer.Start(parent, name, tracing.SpanKindInternal)
+				defer span.End()
+				if attrs != nil {
+					attrs.ForEach(func(k, v lua.LValue) {
+						span.SetAttribute(k.String(), attributeValue(v))
+					})
+				}
+
+				// calls made by fn (eg.: services.call) become children of the new span
+				setContext(L, ctx)
+				top := L.GetTop()
+				L.Push(fn)
+				err := L.PCall(0, lua.MultRet, nil)
+				if Context(L) == ctx {
+					restoreContext(L, parent)
+				}
+				if err != nil {
+					span.SetError(err.Error())
+					L.RaiseError("%v", err.Error())
+					return 0
+				}
+				return L.GetTop() - top
+			},
+			"setAttribute": func(L *lua.LState) int {
+				if ctx := Context(L); ctx != nil {
+					tracing.FromContext(ctx).SetAttribute(L.CheckString(1), attributeValue(L.CheckAny(2)))
+				}
+				return 0
+			},
+			"traceId": func(L *lua.LState) int {
+				ctx := Context(L)
+				if ctx == nil {
+					L.Push(lua.LNil)
+					return 1
+				}
+				sc := tracing.FromContext(ctx).Context()
+				if !sc.IsValid() {
+					L.Push(lua.LNil)
+					return 1
+				}
+				L.Push(lua.LString(sc.TraceID.String()))
+				return 1
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+// restoreContext sets ctx as the context of L, states without a context
+// are left without one
+func restoreContext(L *lua.LState, ctx context.Context) {
+	if ctx == context.Background() {
+		L.RemoveContext()
+		return
+	}
+	setContext(L, ctx)
+}
+
+// attributeValue converts v to one of the types accepted as span attributes
+func attributeValue(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		if float64(v) == float64(int64(v)) {
+			return int64(v)
+		}
+		return float64(v)
+	default:
+		return v.String()
+	}
+}
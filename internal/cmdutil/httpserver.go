@@ -7,20 +7,65 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/andrebq/learn-system-design/internal/metrics"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// closeTimeout is how long Close can take after the server shuts down
+	closeTimeout = 30 * time.Second
+)
+
+type (
+	// Drainer is implemented by handlers which need to stop receiving requests
+	// before the server shuts down (eg.: by leaving the control plane)
+	Drainer interface {
+		Drain(ctx context.Context)
+	}
+
+	// Closer is implemented by handlers which have work left once the server
+	// shuts down (eg.: exporting the spans of the last requests)
+	Closer interface {
+		Close(ctx context.Context) error
+	}
+
+	// detached keeps the values of a context, but is never cancelled
+	detached struct {
+		context.Context
+	}
+)
+
+// RunHTTPServer serves h at bind until parentCtx is done.
+//
+// If h is a Drainer, Drain is called before the server shuts down, requests
+// served meanwhile are not cancelled. If h is a Closer, Close is called after
+// the server shuts down.
 func RunHTTPServer(parentCtx context.Context, h http.Handler, bind string) error {
 	rootCtx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
-	server := &http.Server{Addr: bind, Handler: h, BaseContext: func(l net.Listener) context.Context { return parentCtx }}
+	baseCtx, cancelBase := context.WithCancel(detached{parentCtx})
+	defer cancelBase()
+	server := &http.Server{Addr: bind, Handler: h, BaseContext: func(l net.Listener) context.Context { return baseCtx }}
 	shutdown := make(chan struct{})
 	go func() {
 		defer close(shutdown)
 		<-rootCtx.Done()
-		ctx, cancel := context.WithTimeout(rootCtx, time.Minute)
+		ctx, cancel := context.WithTimeout(detached{rootCtx}, time.Minute)
 		defer cancel()
+		// drain only when asked to stop, not when the server failed to start
+		if d, ok := h.(Drainer); ok && parentCtx.Err() != nil {
+			log.Info().Str("binding", server.Addr).Msg("Draining server")
+			d.Drain(ctx)
+		}
 		server.Shutdown(ctx)
+		if c, ok := h.(Closer); ok {
+			// draining might have used all the time given to ctx
+			ctx, cancel := context.WithTimeout(detached{rootCtx}, closeTimeout)
+			defer cancel()
+			if err := c.Close(ctx); err != nil {
+				log.Error().Err(err).Str("binding", server.Addr).Msg("Unable to close handler")
+			}
+		}
 	}()
 
 	serveErr := make(chan error)
@@ -39,3 +84,34 @@ func RunHTTPServer(parentCtx context.Context, h http.Handler, bind string) error
 	<-shutdown
 	return err
 }
+
+// RunWithAdmin runs h at bind and, when adminBind is not empty, exposes the metrics
+// in r (plus runtime stats) at adminBind. Both servers stop when one of them stops.
+func RunWithAdmin(parentCtx context.Context, h http.Handler, bind string, adminBind string, r *metrics.Registry) error {
+	if adminBind == "" {
+		return RunHTTPServer(parentCtx, h, bind)
+	}
+	metrics.CollectRuntime(r)
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+	// metrics are still exposed while the main server drains
+	adminCtx, stopAdmin := context.WithCancel(detached{parentCtx})
+	defer stopAdmin()
+	adminErr := make(chan error, 1)
+	go func() {
+		defer cancel()
+		adminErr <- RunHTTPServer(adminCtx, metrics.AdminHandler(r), adminBind)
+	}()
+	err := RunHTTPServer(ctx, h, bind)
+	stopAdmin()
+	if aerr := <-adminErr; err == nil {
+		err = aerr
+	}
+	return err
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detached) Done() <-chan struct{} { return nil }
+
+func (detached) Err() error { return nil }
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// HTTPMetrics counts requests served by a process
+	HTTPMetrics struct {
+		Requests *Counter
+		Duration *Histogram
+		InFlight *Gauge
+	}
+
+	statusRecorder struct {
+		http.ResponseWriter
+		status int
+	}
+)
+
+// NewHTTPMetrics registers the metrics of incoming requests, labeled by route and status
+func NewHTTPMetrics(r *Registry) *HTTPMetrics {
+	return &HTTPMetrics{
+		Requests: r.Counter("lsd_http_requests", "Requests served, by route and status code", "route", "status"),
+		Duration: r.Histogram("lsd_http_request_duration_seconds", "Time taken to answer requests, by route and status code", DefaultBuckets, "route", "status"),
+		InFlight: r.Gauge("lsd_http_requests_in_flight", "Requests being served"),
+	}
+}
+
+// Observe records a request which finished with the given status
+func (m *HTTPMetrics) Observe(route string, status int, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	code := strconv.Itoa(status)
+	m.Requests.Inc(route, code)
+	m.Duration.Observe(elapsed.Seconds(), route, code)
+}
+
+// Handler records the requests served by next, route maps a request to the
+// value of the route label (which should have a low cardinality)
+func (m *HTTPMetrics) Handler(next http.Handler, route func(*http.Request) string) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		m.InFlight.Add(1)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			m.InFlight.Add(-1)
+			m.Observe(route(req), rec.status, time.Since(start))
+		}()
+		next.ServeHTTP(rec, req)
+	})
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// FirstSegment uses the first segment of the path as the route (eg.: /faults/1 becomes /faults)
+func FirstSegment(req *http.Request) string {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if idx := strings.Index(path, "/"); idx >= 0 {
+		path = path[:idx]
+	}
+	return "/" + path
+}
+
+// AdminHandler returns the handler served on the admin bind of lsd processes
+func AdminHandler(r *Registry) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	return mux
+}
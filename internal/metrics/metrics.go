@@ -0,0 +1,295 @@
+// Package metrics implements counters, gauges and histograms which are exposed
+// using the OpenMetrics text format, so they can be scraped by Prometheus.
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+var (
+	// DefaultBuckets are the upper bounds (in seconds) used by latency histograms
+	DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+type (
+	// Registry holds the metrics of a process
+	Registry struct {
+		sync.Mutex
+		families   []*family
+		collectors []Collector
+	}
+
+	// Collector adds metrics computed when the registry is scraped
+	Collector func(e *Emitter)
+
+	// Emitter receives the values produced by collectors
+	Emitter struct {
+		families []*family
+		byName   map[string]*family
+	}
+
+	// Counter is a value which only goes up, partitioned by labels.
+	// A nil counter ignores all calls.
+	Counter struct{ f *family }
+
+	// Gauge is a value which can go up and down, partitioned by labels.
+	// A nil gauge ignores all calls.
+	Gauge struct{ f *family }
+
+	// Histogram counts observations in buckets, partitioned by labels.
+	// A nil histogram ignores all calls.
+	Histogram struct{ f *family }
+
+	family struct {
+		sync.Mutex
+		name    string
+		help    string
+		typ     string
+		labels  []string
+		buckets []float64
+		series  map[string]*series
+	}
+
+	series struct {
+		labelValues []string
+		value       float64
+		counts      []uint64
+		count       uint64
+		sum         float64
+	}
+)
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Counter registers a new counter, name should not include the _total suffix
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, typeCounter, labels, nil)}
+}
+
+// Gauge registers a new gauge
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, typeGauge, labels, nil)}
+}
+
+// Histogram registers a new histogram, buckets are the upper bounds of each bucket
+// in increasing order, +Inf is added automatically
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	return &Histogram{r.register(name, help, typeHistogram, labels, append([]float64(nil), buckets...))}
+}
+
+// Collect registers a function which adds metrics every time the registry is scraped
+func (r *Registry) Collect(c Collector) {
+	r.Lock()
+	defer r.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *Registry) register(name, help, typ string, labels []string, buckets []float64) *family {
+	f := newFamily(name, help, typ, labels, buckets)
+	r.Lock()
+	defer r.Unlock()
+	r.families = append(r.families, f)
+	return f
+}
+
+// gather returns a copy of all families, including the ones produced by collectors
+func (r *Registry) gather() []*family {
+	r.Lock()
+	families := append([]*family(nil), r.families...)
+	collectors := append([]Collector(nil), r.collectors...)
+	r.Unlock()
+
+	out := make([]*family, 0, len(families))
+	for _, f := range families {
+		out = append(out, f.snapshot())
+	}
+	e := &Emitter{byName: make(map[string]*family)}
+	for _, c := range collectors {
+		c(e)
+	}
+	return append(out, e.families...)
+}
+
+func newFamily(name, help, typ string, labels []string, buckets []float64) *family {
+	return &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  append([]string(nil), labels...),
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+// get returns the series for the given label values, creating it if needed.
+//
+// Callers must hold the lock of f.
+func (f *family) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s := f.series[key]
+	if s == nil {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.typ == typeHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// snapshot returns a copy of f with its series sorted by label values
+func (f *family) snapshot() *family {
+	f.Lock()
+	defer f.Unlock()
+	c := newFamily(f.name, f.help, f.typ, f.labels, f.buckets)
+	for k, s := range f.series {
+		cs := *s
+		cs.counts = append([]uint64(nil), s.counts...)
+		c.series[k] = &cs
+	}
+	return c
+}
+
+// sorted returns the series of f ordered by their label values
+func (f *family) sorted() []*series {
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*series, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, f.series[k])
+	}
+	return out
+}
+
+// checkLabels pads or truncates labelValues so it matches the labels of f
+func (f *family) checkLabels(labelValues []string) []string {
+	if len(labelValues) == len(f.labels) {
+		return labelValues
+	}
+	out := make([]string, len(f.labels))
+	copy(out, labelValues)
+	return out
+}
+
+// Add increments the counter by v, negative values are ignored
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if c == nil || v < 0 {
+		return
+	}
+	c.f.Lock()
+	defer c.f.Unlock()
+	c.f.get(c.f.checkLabels(labelValues)).value += v
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Each calls fn with the value of every series
+func (c *Counter) Each(fn func(labelValues []string, value float64)) {
+	if c == nil {
+		return
+	}
+	for _, s := range c.f.snapshot().sorted() {
+		fn(s.labelValues, s.value)
+	}
+}
+
+// Set changes the value of the gauge
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.f.Lock()
+	defer g.f.Unlock()
+	g.f.get(g.f.checkLabels(labelValues)).value = v
+}
+
+// Add changes the value of the gauge by v, which can be negative
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.f.Lock()
+	defer g.f.Unlock()
+	g.f.get(g.f.checkLabels(labelValues)).value += v
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value(labelValues ...string) float64 {
+	if g == nil {
+		return 0
+	}
+	g.f.Lock()
+	defer g.f.Unlock()
+	return g.f.get(g.f.checkLabels(labelValues)).value
+}
+
+// Observe records v (eg.: a latency in seconds)
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	h.f.Lock()
+	defer h.f.Unlock()
+	s := h.f.get(h.f.checkLabels(labelValues))
+	// counts are not cumulative, they are accumulated when the histogram is written
+	idx := sort.SearchFloat64s(h.f.buckets, v)
+	if idx < len(s.counts) {
+		s.counts[idx]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// Each calls fn with the number of observations and their sum for every series
+func (h *Histogram) Each(fn func(labelValues []string, count uint64, sum float64)) {
+	if h == nil {
+		return
+	}
+	for _, s := range h.f.snapshot().sorted() {
+		fn(s.labelValues, s.count, s.sum)
+	}
+}
+
+// Counter adds a sample to the counter family name, labels are pairs of names and values
+func (e *Emitter) Counter(name, help string, value float64, labels ...string) {
+	e.emit(name, help, typeCounter, value, labels)
+}
+
+// Gauge adds a sample to the gauge family name, labels are pairs of names and values
+func (e *Emitter) Gauge(name, help string, value float64, labels ...string) {
+	e.emit(name, help, typeGauge, value, labels)
+}
+
+func (e *Emitter) emit(name, help, typ string, value float64, labels []string) {
+	var names, values []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		names = append(names, labels[i])
+		values = append(values, labels[i+1])
+	}
+	f := e.byName[name]
+	if f == nil {
+		f = newFamily(name, help, typ, names, nil)
+		e.byName[name] = f
+		e.families = append(e.families, f)
+	}
+	f.get(values).value = value
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ContentType is the media type of the OpenMetrics text format
+	ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// WriteTo writes all metrics using the OpenMetrics text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range r.gather() {
+		f.write(cw)
+	}
+	io.WriteString(cw, "# EOF\n")
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.(*bufio.Writer).Flush()
+}
+
+// ServeHTTP exposes the metrics, so the registry can be used as the handler of /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+func (f *family) write(w io.Writer) {
+	io.WriteString(w, "# TYPE "+f.name+" "+f.typ+"\n")
+	if f.help != "" {
+		io.WriteString(w, "# HELP "+f.name+" "+helpEscaper.Replace(f.help)+"\n")
+	}
+	for _, s := range f.sorted() {
+		switch f.typ {
+		case typeCounter:
+			writeSample(w, f.name+"_total", f.labels, s.labelValues, "", "", s.value)
+		case typeGauge:
+			writeSample(w, f.name, f.labels, s.labelValues, "", "", s.value)
+		case typeHistogram:
+			var cumulative uint64
+			for i, upper := range f.buckets {
+				cumulative += s.counts[i]
+				writeSample(w, f.name+"_bucket", f.labels, s.labelValues, "le", formatFloat(upper), float64(cumulative))
+			}
+			writeSample(w, f.name+"_bucket", f.labels, s.labelValues, "le", "+Inf", float64(s.count))
+			writeSample(w, f.name+"_count", f.labels, s.labelValues, "", "", float64(s.count))
+			writeSample(w, f.name+"_sum", f.labels, s.labelValues, "", "", s.sum)
+		}
+	}
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, extraLabel, extraValue string, value float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 || extraLabel != "" {
+		io.WriteString(w, "{")
+		for i, l := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, l+`="`+labelEscaper.Replace(values[i])+`"`)
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, extraLabel+`="`+extraValue+`"`)
+		}
+		io.WriteString(w, "}")
+	}
+	io.WriteString(w, " "+formatFloat(value)+"\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(buf []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(buf)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// CollectRuntime adds goroutine, memory and garbage collector stats to r
+func CollectRuntime(r *Registry) {
+	r.Collect(func(e *Emitter) {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		e.Gauge("go_goroutines", "Number of goroutines that currently exist", float64(runtime.NumGoroutine()))
+		e.Gauge("go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects", float64(ms.HeapAlloc))
+		e.Gauge("go_memstats_heap_objects", "Number of allocated heap objects", float64(ms.HeapObjects))
+		e.Gauge("go_memstats_sys_bytes", "Bytes of memory obtained from the OS", float64(ms.Sys))
+		e.Counter("go_memstats_alloc_bytes", "Bytes allocated for heap objects, even if they were freed", float64(ms.TotalAlloc))
+		e.Counter("go_gc_cycles", "Number of completed GC cycles", float64(ms.NumGC))
+		e.Counter("go_gc_pause_seconds", "Time spent in GC stop-the-world pauses", time.Duration(ms.PauseTotalNs).Seconds())
+	})
+}
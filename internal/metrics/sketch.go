@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// sketchAccuracy is the relative error of quantiles computed by sketches
+	sketchAccuracy = 0.01
+	// sketchMinValue is the smallest value tracked by its own bin, smaller values are counted as zero
+	sketchMinValue = 1e-9
+)
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+type (
+	// Sketch summarizes a distribution of positive values (eg.: latencies in seconds).
+	//
+	// Values are counted in logarithmic bins, so quantiles have a bounded relative error
+	// and sketches from different processes can be merged by adding their bins.
+	// Sketches are not safe for concurrent use.
+	Sketch struct {
+		Bins  map[int]uint64 `json:"bins,omitempty"`
+		Zero  uint64         `json:"zero,omitempty"`
+		Count uint64         `json:"count"`
+		Sum   float64        `json:"sum"`
+		Max   float64        `json:"max"`
+	}
+)
+
+func NewSketch() *Sketch {
+	return &Sketch{Bins: make(map[int]uint64)}
+}
+
+// Add records v, negative values are counted as zero
+func (s *Sketch) Add(v float64) {
+	if s.Bins == nil {
+		s.Bins = make(map[int]uint64)
+	}
+	if v <= sketchMinValue {
+		s.Zero++
+	} else {
+		s.Bins[int(math.Ceil(math.Log(v)/sketchLogGamma))]++
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+}
+
+// Merge adds all values recorded by other to s
+func (s *Sketch) Merge(other *Sketch) {
+	if other == nil || other.Count == 0 {
+		return
+	}
+	if s.Bins == nil {
+		s.Bins = make(map[int]uint64)
+	}
+	for idx, c := range other.Bins {
+		s.Bins[idx] += c
+	}
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+	s.Zero += other.Zero
+	s.Count += other.Count
+	s.Sum += other.Sum
+}
+
+// Quantile returns an estimate of the value at q (between 0 and 1), or 0 if s is empty
+func (s *Sketch) Quantile(q float64) float64 {
+	if s == nil || s.Count == 0 {
+		return 0
+	}
+	switch {
+	case q <= 0:
+		q = 0
+	case q >= 1:
+		return s.Max
+	}
+	rank := uint64(q * float64(s.Count-1))
+	if rank < s.Zero {
+		return 0
+	}
+	seen := s.Zero
+	keys := make([]int, 0, len(s.Bins))
+	for idx := range s.Bins {
+		keys = append(keys, idx)
+	}
+	sort.Ints(keys)
+	for _, idx := range keys {
+		seen += s.Bins[idx]
+		if seen > rank {
+			// the middle of the bin, which is within the accuracy of the sketch
+			return math.Min(2*math.Pow(sketchGamma, float64(idx))/(sketchGamma+1), s.Max)
+		}
+	}
+	return s.Max
+}
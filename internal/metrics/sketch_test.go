@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSketchQuantile(t *testing.T) {
+	distributions := map[string]func(i int) float64{
+		// 1ms to 1s
+		"uniform": func(i int) float64 { return float64(i+1) / 1000 },
+		// from 1µs to ~1000s, most values are small
+		"exponential": func(i int) float64 { return 1e-6 * math.Pow(1.021, float64(i)) },
+	}
+	for name, value := range distributions {
+		s := NewSketch()
+		for i := 999; i >= 0; i-- {
+			s.Add(value(i))
+		}
+		for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99, 0.999} {
+			expected := value(int(q * 999))
+			if actual := s.Quantile(q); math.Abs(actual-expected) > expected*sketchAccuracy {
+				t.Errorf("%v: quantile %v should be within %v of %v got %v", name, q, sketchAccuracy, expected, actual)
+			}
+		}
+		if actual := s.Quantile(1); actual != value(999) {
+			t.Errorf("%v: quantile 1 should be the maximum %v got %v", name, value(999), actual)
+		}
+	}
+
+	s := NewSketch()
+	if s.Quantile(0.5) != 0 {
+		t.Errorf("empty sketches should return 0")
+	}
+	for _, v := range []float64{0, 0, 0, -1, 2} {
+		s.Add(v)
+	}
+	if s.Quantile(0.5) != 0 || s.Quantile(1) != 2 {
+		t.Errorf("values smaller than the minimum should be counted as zero, got %v and %v", s.Quantile(0.5), s.Quantile(1))
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	all, even, odd := NewSketch(), NewSketch(), &Sketch{}
+	for i := 0; i < 1000; i++ {
+		v := float64(i) / 1000
+		all.Add(v)
+		if i%2 == 0 {
+			even.Add(v)
+		} else {
+			odd.Add(v)
+		}
+	}
+	merged := NewSketch()
+	merged.Merge(even)
+	merged.Merge(odd)
+	merged.Merge(nil)
+	merged.Merge(NewSketch())
+	if merged.Count != all.Count || merged.Zero != all.Zero || merged.Max != all.Max || !reflect.DeepEqual(merged.Bins, all.Bins) ||
+		math.Abs(merged.Sum-all.Sum) > 1e-9 {
+		t.Fatalf("merging should be the same as adding all values to a single sketch, got %#v expecting %#v", merged, all)
+	}
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+		if merged.Quantile(q) != all.Quantile(q) {
+			t.Errorf("quantile %v of merged sketch should be %v got %v", q, all.Quantile(q), merged.Quantile(q))
+		}
+	}
+}
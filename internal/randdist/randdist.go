@@ -0,0 +1,113 @@
+// Package randdist samples random values from common distributions,
+// used to simulate latency and other sources of variability
+package randdist
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+const (
+	Fixed       = "fixed"
+	Uniform     = "uniform"
+	Normal      = "normal"
+	Exponential = "exponential"
+	LogNormal   = "lognormal"
+	Pareto      = "pareto"
+)
+
+type (
+	// Distribution describes how values are sampled, the unit of each
+	// field is decided by the caller.
+	//
+	// Fixed uses Mean, Uniform uses Min and Max, Normal uses Mean and StdDev,
+	// Exponential uses Mean, LogNormal uses Mean and StdDev (of the samples, not of their logarithm)
+	// and Pareto uses Min as its scale and Shape as its tail index.
+	//
+	// Samples are never lower than Min and, if Max is positive, never higher than Max.
+	Distribution struct {
+		Kind   string  `json:"kind"`
+		Min    float64 `json:"min,omitempty"`
+		Max    float64 `json:"max,omitempty"`
+		Mean   float64 `json:"mean,omitempty"`
+		StdDev float64 `json:"stdDev,omitempty"`
+		Shape  float64 `json:"shape,omitempty"`
+	}
+)
+
+// Validate normalizes the kind of d and checks if its parameters make sense
+func (d *Distribution) Validate() error {
+	d.Kind = strings.ToLower(strings.TrimSpace(d.Kind))
+	if d.Min < 0 || d.Max < 0 || d.Mean < 0 || d.StdDev < 0 || d.Shape < 0 {
+		return fmt.Errorf("randdist: parameters cannot be negative")
+	}
+	if d.Max > 0 && d.Max < d.Min {
+		return fmt.Errorf("randdist: max must be greater than min")
+	}
+	switch d.Kind {
+	case "", "constant":
+		d.Kind = Fixed
+	case Fixed, Normal, Exponential:
+	case LogNormal:
+		if d.Mean == 0 {
+			return fmt.Errorf("randdist: lognormal distribution requires mean")
+		}
+	case Pareto:
+		if d.Min == 0 || d.Shape == 0 {
+			return fmt.Errorf("randdist: pareto distribution requires min and shape")
+		}
+	case Uniform:
+		if d.Max == 0 {
+			return fmt.Errorf("randdist: uniform distribution requires max")
+		}
+	default:
+		return fmt.Errorf("randdist: unknown distribution %q", d.Kind)
+	}
+	return nil
+}
+
+// Sample returns a random value from d
+func (d Distribution) Sample() float64 {
+	var v float64
+	switch d.Kind {
+	case Uniform:
+		v = d.Min + rand.Float64()*(d.Max-d.Min)
+	case Normal:
+		v = d.Mean + rand.NormFloat64()*d.StdDev
+	case Exponential:
+		v = rand.ExpFloat64() * d.Mean
+	case LogNormal:
+		// convert the mean and deviation of the samples into the parameters of the underlying normal
+		sigma2 := math.Log(1 + (d.StdDev*d.StdDev)/(d.Mean*d.Mean))
+		mu := math.Log(d.Mean) - sigma2/2
+		v = math.Exp(mu + rand.NormFloat64()*math.Sqrt(sigma2))
+	case Pareto:
+		// 1 - Float64 is in (0, 1], which avoids dividing by zero
+		v = d.Min / math.Pow(1-rand.Float64(), 1/d.Shape)
+	default:
+		v = d.Mean
+	}
+	v = math.Max(v, d.Min)
+	if d.Max > 0 {
+		v = math.Min(v, d.Max)
+	}
+	return v
+}
+
+func (d Distribution) String() string {
+	switch d.Kind {
+	case Uniform:
+		return fmt.Sprintf("uniform(%v, %v)", d.Min, d.Max)
+	case Normal:
+		return fmt.Sprintf("normal(%v, %v)", d.Mean, d.StdDev)
+	case Exponential:
+		return fmt.Sprintf("exponential(%v)", d.Mean)
+	case LogNormal:
+		return fmt.Sprintf("lognormal(%v, %v)", d.Mean, d.StdDev)
+	case Pareto:
+		return fmt.Sprintf("pareto(%v, %v)", d.Min, d.Shape)
+	}
+	return fmt.Sprintf("fixed(%v)", d.Mean)
+}
@@ -0,0 +1,335 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrebq/learn-system-design/internal/logutil"
+)
+
+const (
+	// DefaultBatchSize is the maximum number of spans sent in a single export
+	DefaultBatchSize = 512
+	// DefaultFlushInterval is how often spans are exported
+	DefaultFlushInterval = time.Second
+
+	// queueSize is the number of spans waiting to be exported, spans are dropped once the queue is full
+	queueSize = 4096
+
+	scopeName = "github.com/andrebq/learn-system-design"
+)
+
+type (
+	// Tracer creates spans for a service and exports them to an OTLP/HTTP endpoint.
+	//
+	// A nil tracer doesn't create spans, so instrumented code doesn't need to check
+	// if tracing is enabled.
+	Tracer struct {
+		service  string
+		endpoint string
+		queue    chan *Span
+		client   *http.Client
+
+		stop     chan struct{}
+		stopOnce sync.Once
+		done     chan struct{}
+
+		dropped  int64
+		exported int64
+	}
+
+	// otlp* types are the JSON encoding of the OTLP trace export request
+
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// NewTracer returns a tracer which exports the spans of service to endpoint,
+// the base address of an OTLP/HTTP receiver (eg.: http://localhost:4318).
+//
+// It returns nil if endpoint is empty, which disables tracing.
+// Spans are exported in background until Close is called, ctx is only used for logging,
+// so spans created while the process shuts down are not lost.
+func NewTracer(ctx context.Context, service, endpoint string) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+	t := &Tracer{
+		service:  service,
+		endpoint: strings.TrimRight(endpoint, "/") + "/v1/traces",
+		queue:    make(chan *Span, queueSize),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run(ctx)
+	return t
+}
+
+// Close stops the tracer after exporting the spans which are waiting in the queue,
+// spans ended after Close are dropped. It returns early if ctx is done.
+func (t *Tracer) Close(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start returns a new span and a context which holds it.
+//
+// The span is a child of the span in ctx (or of the remote parent added by Extract),
+// otherwise it starts a new trace.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	if parent, ok := parentContext(ctx); ok && parent.IsValid() {
+		s.context = SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Sampled: parent.Sampled}
+		s.parent = parent.SpanID
+	} else {
+		s.context = SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Sampled: true}
+	}
+	return WithSpan(ctx, s), s
+}
+
+// Stats returns how many spans were exported and dropped
+func (t *Tracer) Stats() (exported, dropped int64) {
+	if t == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&t.exported), atomic.LoadInt64(&t.dropped)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case <-t.stop:
+		atomic.AddInt64(&t.dropped, 1)
+		return
+	default:
+	}
+	select {
+	case t.queue <- s:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+// run exports spans in batches, until Close is called
+func (t *Tracer) run(ctx context.Context) {
+	defer close(t.done)
+	log := logutil.Acquire(ctx)
+	tick := time.NewTicker(DefaultFlushInterval)
+	defer tick.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			atomic.AddInt64(&t.dropped, int64(len(batch)))
+			log.Error().Err(err).Str("endpoint", t.endpoint).Int("spans", len(batch)).Msg("Unable to export spans")
+		} else {
+			atomic.AddInt64(&t.exported, int64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= DefaultBatchSize {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		case <-t.stop:
+			// export what is left, so short-lived processes don't lose their spans
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{attribute("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: scopeName},
+			Spans: make([]otlpSpan, 0, len(spans)),
+		}},
+	}}}
+	scope := &req.ResourceSpans[0].ScopeSpans[0]
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, s.toOTLP())
+	}
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	// spans are exported after the request which created them is done,
+	// so a new context is used
+	ctx, cancel := context.WithTimeout(context.Background(), t.client.Timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, bytes.NewBuffer(buf))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	res, err := t.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("tracing: unexpected status from collector %v", res.Status)
+	}
+	return nil
+}
+
+func (s *Span) toOTLP() otlpSpan {
+	s.Lock()
+	defer s.Unlock()
+	span := otlpSpan{
+		TraceID:           s.context.TraceID.String(),
+		SpanID:            s.context.SpanID.String(),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: s.status, Message: s.message},
+	}
+	if s.parent != (SpanID{}) {
+		span.ParentSpanID = s.parent.String()
+	}
+	for k, v := range s.attributes {
+		span.Attributes = append(span.Attributes, attribute(k, v))
+	}
+	return span
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	attr := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case string:
+		attr.Value.StringValue = &v
+	case bool:
+		attr.Value.BoolValue = &v
+	case int:
+		i := strconv.FormatInt(int64(v), 10)
+		attr.Value.IntValue = &i
+	case int64:
+		i := strconv.FormatInt(v, 10)
+		attr.Value.IntValue = &i
+	case float64:
+		attr.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		attr.Value.StringValue = &s
+	}
+	return attr
+}
+
+// Transport returns a RoundTripper which creates a client span for each request,
+// using name as the span name, and propagates the trace context to the server
+func (t *Tracer) Transport(base http.RoundTripper, name string) http.RoundTripper {
+	if t == nil {
+		return base
+	}
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		ctx, span := t.Start(req.Context(), name, SpanKindClient)
+		defer span.End()
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.url", req.URL.String())
+		req = req.Clone(ctx)
+		Inject(ctx, req.Header)
+		res, err := base.RoundTrip(req)
+		if err != nil {
+			span.SetError(err.Error())
+			return nil, err
+		}
+		span.SetAttribute("http.status_code", res.StatusCode)
+		if res.StatusCode >= 500 {
+			span.SetError(res.Status)
+		}
+		return res, nil
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (r roundTripper) RoundTrip(req *http.Request) (*http.Response, error) { return r(req) }
@@ -0,0 +1,218 @@
+// Package tracing implements the small subset of OpenTelemetry used by lsd:
+// spans, W3C trace context propagation and export using OTLP/HTTP (JSON encoding).
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SpanKindInternal is used by spans created by Lua code
+	SpanKindInternal = 1
+	// SpanKindServer is used by spans of incoming requests
+	SpanKindServer = 2
+	// SpanKindClient is used by spans of outgoing requests
+	SpanKindClient = 3
+
+	statusOK    = 1
+	statusError = 2
+
+	// TraceParentHeader carries the trace context, as defined by https://www.w3.org/TR/trace-context/
+	TraceParentHeader = "traceparent"
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+
+	// SpanContext identifies a span, possibly created by another process
+	SpanContext struct {
+		TraceID TraceID
+		SpanID  SpanID
+		Sampled bool
+	}
+
+	// Span is an operation which is part of a trace, a nil span ignores all calls
+	Span struct {
+		sync.Mutex
+		tracer *Tracer
+
+		name       string
+		kind       int
+		context    SpanContext
+		parent     SpanID
+		start      time.Time
+		end        time.Time
+		attributes map[string]interface{}
+		status     int
+		message    string
+		ended      bool
+	}
+
+	spanKey   struct{}
+	remoteKey struct{}
+)
+
+// String returns the hex encoding of the trace id
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// String returns the hex encoding of the span id
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// IsValid returns true if neither the trace nor the span id are zeros
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// FromContext returns the span stored in ctx, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// WithSpan returns a context which holds s, spans started from it are children of s
+func WithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// parentContext returns the span context of the parent of spans started from ctx
+func parentContext(ctx context.Context) (SpanContext, bool) {
+	if s := FromContext(ctx); s != nil {
+		return s.context, true
+	}
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Extract reads the trace context sent by the caller, spans started from
+// the returned context are part of the same trace.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := ParseTraceParent(header.Get(TraceParentHeader))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject adds the trace context of the span in ctx to header
+func Inject(ctx context.Context, header http.Header) {
+	sc, ok := parentContext(ctx)
+	if !ok || !sc.IsValid() {
+		return
+	}
+	header.Set(TraceParentHeader, FormatTraceParent(sc))
+}
+
+// ParseTraceParent parses the value of the traceparent header
+func ParseTraceParent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// FormatTraceParent returns the value of the traceparent header for sc
+func FormatTraceParent(sc SpanContext) string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%v-%v-%v", sc.TraceID, sc.SpanID, flags)
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+// Context returns the span context of s
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute records a value (string, bool, integer or float) on s
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks s as failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.status, s.message = statusError, message
+}
+
+// SetOK marks s as successful, which overrides errors set by instrumentation
+func (s *Span) SetOK() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.status, s.message = statusOK, ""
+}
+
+// End records the end of s and sends it to the exporter, only the first call has any effect
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.Unlock()
+	if s.context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"runtime"
@@ -13,7 +14,9 @@ import (
 
 	"github.com/andrebq/learn-system-design/control"
 	"github.com/andrebq/learn-system-design/internal/logutil"
+	"github.com/andrebq/learn-system-design/internal/metrics"
 	"github.com/andrebq/learn-system-design/internal/render"
+	"github.com/andrebq/learn-system-design/internal/tracing"
 	"github.com/julienschmidt/httprouter"
 	vegeta "github.com/tsenart/vegeta/lib"
 )
@@ -34,6 +37,25 @@ type (
 		controlEndpoint string
 		name            string
 		publicEndpoint  string
+
+		tracer  *tracing.Tracer
+		results *metrics.Counter
+		latency *metrics.Histogram
+		running *metrics.Gauge
+
+		drainPeriod      time.Duration
+		drainOnce        sync.Once
+		draining         chan struct{}
+		registrationDone chan struct{}
+	}
+
+	// Option changes how the stressor is configured
+	Option func(*options)
+
+	options struct {
+		traceEndpoint string
+		metrics       *metrics.Registry
+		drainPeriod   time.Duration
 	}
 
 	StressTest struct {
@@ -47,19 +69,51 @@ type (
 	}
 )
 
-func Handler(ctx context.Context, name string, controlEndpoint, publicEndpoint string) http.Handler {
+// WithTracing starts a new trace for every request sent by a test, spans are exported
+// to the OTLP/HTTP endpoint (eg.: http://localhost:4318)
+func WithTracing(endpoint string) Option {
+	return func(o *options) {
+		o.traceEndpoint = endpoint
+	}
+}
+
+// WithMetrics registers the metrics of the stressor in r, including the status
+// and latency of every request sent by a test
+func WithMetrics(r *metrics.Registry) Option {
+	return func(o *options) {
+		o.metrics = r
+	}
+}
+
+func Handler(ctx context.Context, name string, controlEndpoint, publicEndpoint string, opts ...Option) http.Handler {
+	o := options{drainPeriod: DefaultDrainPeriod}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	router := httprouter.New()
 	handler := &h{
 		name:            name,
 		publicEndpoint:  publicEndpoint,
 		controlEndpoint: controlEndpoint,
+		tracer:          tracing.NewTracer(ctx, "stressor", o.traceEndpoint),
+
+		drainPeriod:      o.drainPeriod,
+		draining:         make(chan struct{}),
+		registrationDone: make(chan struct{}),
 	}
 	router.HandlerFunc("GET", "/reports/hdr-histogram.txt", handler.getHDRHistogram)
 	router.HandlerFunc("POST", "/start-test", handler.startTest)
 	router.HandlerFunc("GET", "/", handler.getStatus)
+	router.HandlerFunc("GET", "/healthz", handler.getHealth)
+	router.HandlerFunc("GET", "/readyz", handler.getReady)
 	go handler.registration(ctx)
-	_ = handler
-	return router
+	if o.metrics == nil {
+		return server{Handler: router, h: handler}
+	}
+	handler.results = o.metrics.Counter("lsd_stress_requests", "Requests sent by stress tests, by test and status code", "test", "status")
+	handler.latency = o.metrics.Histogram("lsd_stress_request_duration_seconds", "Latency of requests sent by stress tests", metrics.DefaultBuckets, "test")
+	handler.running = o.metrics.Gauge("lsd_stress_test_in_progress", "1 while a stress test is running")
+	return server{Handler: metrics.NewHTTPMetrics(o.metrics).Handler(router, metrics.FirstSegment), h: handler}
 }
 
 func (h *h) getHDRHistogram(rw http.ResponseWriter, req *http.Request) {
@@ -155,8 +209,18 @@ func (h *h) performTest(test StressTest) {
 	}()
 	h.testLock.Lock()
 	defer h.testLock.Unlock()
+	h.running.Set(1)
+	defer h.running.Set(0)
 
-	a := vegeta.NewAttacker(vegeta.Workers(uint64(test.Workers)), vegeta.Timeout(test.Timeout))
+	attackOpts := []func(*vegeta.Attacker){vegeta.Workers(uint64(test.Workers))}
+	if h.tracer != nil {
+		// the client must be replaced before the timeout is set
+		attackOpts = append(attackOpts, vegeta.Client(&http.Client{
+			Transport: h.tracer.Transport(attackTransport(), "stress "+test.Name),
+		}))
+	}
+	attackOpts = append(attackOpts, vegeta.Timeout(test.Timeout))
+	a := vegeta.NewAttacker(attackOpts...)
 	rate := vegeta.ConstantPacer{
 		Freq: test.RequestsPerSecond,
 		Per:  time.Second,
@@ -187,6 +251,8 @@ func (h *h) performTest(test StressTest) {
 	for r := range results {
 		i++
 		metrics.Add(r)
+		h.results.Inc(test.Name, strconv.Itoa(int(r.Code)))
+		h.latency.Observe(r.Latency.Seconds(), test.Name)
 		if i%100 == 0 {
 			h.notifyStatusChange(context.TODO())
 			h.reportResults(&metrics)
@@ -196,6 +262,21 @@ func (h *h) performTest(test StressTest) {
 
 }
 
+// attackTransport is configured like the one used by vegeta, so tests keep
+// the same connections whether they are traced or not
+func attackTransport() *http.Transport {
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: vegeta.DefaultLocalAddr.IP, Zone: vegeta.DefaultLocalAddr.Zone},
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     vegeta.DefaultTLSConfig,
+		MaxIdleConnsPerHost: vegeta.DefaultConnections,
+	}
+}
+
 func (h *h) reportResults(m *vegeta.Metrics) {
 	h.Lock()
 	defer h.Unlock()
@@ -212,6 +293,7 @@ func (h *h) reportResults(m *vegeta.Metrics) {
 }
 
 func (h *h) registration(ctx context.Context) {
+	defer close(h.registrationDone)
 	if h.controlEndpoint == "" {
 		return
 	}
@@ -233,10 +315,16 @@ func (h *h) registration(ctx context.Context) {
 		case <-tick.C:
 		case <-ctx.Done():
 			return
+		case <-h.draining:
+			return
 		}
 	}
 }
 
 func (h *h) notifyStatusChange(ctx context.Context) error {
+	if h.isDraining() {
+		// tests which finish while draining would add the stressor back
+		return nil
+	}
 	return control.RegisterStressor(ctx, h.controlEndpoint, h.name, h.publicEndpoint, h.ongoing)
 }
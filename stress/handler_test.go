@@ -3,12 +3,15 @@ package stress
 import (
 	"context"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/andrebq/learn-system-design/control"
+	"github.com/andrebq/learn-system-design/internal/cmdutil"
 	"github.com/steinfletcher/apitest"
 )
 
@@ -49,3 +52,150 @@ func toJson(t *testing.T, body interface{}) string {
 	}
 	return string(buf)
 }
+
+func TestStressTracing(t *testing.T) {
+	var traced int32
+	underTest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("traceparent") != "" {
+			atomic.AddInt32(&traced, 1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer underTest.Close()
+	var roots int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						ParentSpanID string `json:"parentSpanId"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					if s.ParentSpanID == "" {
+						atomic.AddInt32(&roots, 1)
+					}
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target := StressTest{
+		Name:              "test",
+		Target:            underTest.URL,
+		Method:            "GET",
+		Workers:           1,
+		Sustain:           time.Millisecond * 100,
+		RequestsPerSecond: 20,
+	}
+	handler := Handler(ctx, "test", "", "", WithTracing(collector.URL))
+	apitest.Handler(handler).Post("/start-test").Body(toJson(t, target)).Expect(t).Status(http.StatusCreated).End()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&traced) == 0 || atomic.LoadInt32(&roots) < atomic.LoadInt32(&traced) {
+		if time.Now().After(deadline) {
+			t.Fatalf("every request should start a trace, got %v traced requests and %v root spans", atomic.LoadInt32(&traced), atomic.LoadInt32(&roots))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStressTracingConnections(t *testing.T) {
+	connections := func(opts ...Option) int32 {
+		var conns int32
+		underTest := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// answer in batches, so many connections become idle at the same time
+			time.Sleep(time.Until(time.Now().Truncate(20 * time.Millisecond).Add(20 * time.Millisecond)))
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		underTest.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&conns, 1)
+			}
+		}
+		underTest.Start()
+		defer underTest.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		target := StressTest{
+			Name:              "test",
+			Target:            underTest.URL,
+			Method:            "GET",
+			Workers:           10,
+			Sustain:           time.Millisecond * 300,
+			RequestsPerSecond: 1000,
+		}
+		handler := Handler(ctx, "test", "", "", opts...)
+		apitest.Handler(handler).Post("/start-test").Body(toJson(t, target)).Expect(t).Status(http.StatusCreated).End()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code == http.StatusOK {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("test should finish")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return atomic.LoadInt32(&conns)
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+
+	plain := connections()
+	traced := connections(WithTracing(collector.URL))
+	t.Logf("Connections opened without tracing: %v, with tracing: %v", plain, traced)
+	// idle connections are kept in both cases, so the number of connections
+	// depends only on how many requests were sent at the same time
+	if traced > 2*plain {
+		t.Fatalf("tracing should reuse connections like vegeta does, got %v connections instead of %v", traced, plain)
+	}
+}
+
+func TestStressDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	controlPlane := httptest.NewServer(control.Handler())
+	defer controlPlane.Close()
+	stressors := func() int {
+		res, err := http.Get(controlPlane.URL + "/registry")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var registry struct {
+			Stressors []*control.Stressor `json:"stressor"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&registry); err != nil {
+			t.Fatal(err)
+		}
+		return len(registry.Stressors)
+	}
+
+	handler := Handler(ctx, "drained", controlPlane.URL, "http://stressor.localhost", WithDrainPeriod(10*time.Millisecond))
+	deadline := time.Now().Add(5 * time.Second)
+	for stressors() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("stressor should register itself in the control plane")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	apitest.Handler(handler).Get("/readyz").Expect(t).Status(http.StatusOK).Body("ready\n").End()
+	handler.(cmdutil.Drainer).Drain(ctx)
+	apitest.Handler(handler).Get("/readyz").Expect(t).Status(http.StatusServiceUnavailable).Body("draining\n").End()
+	apitest.Handler(handler).Get("/healthz").Expect(t).Status(http.StatusOK).End()
+	if n := stressors(); n != 0 {
+		t.Errorf("a drained stressor should leave the control plane, got %v stressors", n)
+	}
+}
@@ -0,0 +1,88 @@
+package stress
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/andrebq/learn-system-design/control"
+	"github.com/andrebq/learn-system-design/internal/logutil"
+)
+
+const (
+	// DefaultDrainPeriod is how long a draining stressor waits before it shuts down,
+	// so tests in progress can finish
+	DefaultDrainPeriod = 6 * time.Second
+)
+
+type (
+	// server is the handler returned to callers, it can be drained and closed by cmdutil.RunHTTPServer
+	server struct {
+		http.Handler
+		h *h
+	}
+)
+
+// WithDrainPeriod changes how long the stressor waits after it leaves the control plane
+func WithDrainPeriod(period time.Duration) Option {
+	return func(o *options) {
+		o.drainPeriod = period
+	}
+}
+
+func (s server) Drain(ctx context.Context) {
+	s.h.drain(ctx)
+}
+
+// Close exports the spans of requests sent while the stressor was draining
+func (s server) Close(ctx context.Context) error {
+	return s.h.tracer.Close(ctx)
+}
+
+func (h *h) getHealth(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	io.WriteString(rw, "ok\n")
+}
+
+func (h *h) getReady(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if h.isDraining() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(rw, "draining\n")
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	io.WriteString(rw, "ready\n")
+}
+
+func (h *h) isDraining() bool {
+	select {
+	case <-h.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain removes the stressor from the control plane and waits for the drain period
+func (h *h) drain(ctx context.Context) {
+	log := logutil.Acquire(ctx)
+	h.drainOnce.Do(func() { close(h.draining) })
+	select {
+	case <-h.registrationDone:
+	case <-ctx.Done():
+		return
+	}
+	if h.controlEndpoint != "" {
+		if err := control.DeregisterStressor(ctx, h.controlEndpoint, h.name); err != nil {
+			log.Error().Err(err).Str("control", h.controlEndpoint).Str("name", h.name).Msg("Unable to deregister")
+		}
+	}
+	log.Info().Dur("drainPeriod", h.drainPeriod).Msg("Draining stressor")
+	select {
+	case <-time.After(h.drainPeriod):
+	case <-ctx.Done():
+	}
+}